@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 按文件路径共享的访问日志输出，路径为空时写标准输出
+type AccessLogWriters struct {
+	mu      sync.Mutex
+	writers map[string]*accessLogFile
+}
+
+type accessLogFile struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewAccessLogWriters() *AccessLogWriters {
+	return &AccessLogWriters{writers: make(map[string]*accessLogFile)}
+}
+
+func (a *AccessLogWriters) file(path string) *accessLogFile {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if f, ok := a.writers[path]; ok {
+		return f
+	}
+
+	f := &accessLogFile{w: os.Stdout}
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Errorf("打开访问日志文件失败: %v, 改为写入标准输出", err)
+		} else {
+			f.w = file
+		}
+	}
+	a.writers[path] = f
+	return f
+}
+
+func (a *AccessLogWriters) Write(config *AccessLogConfig, r *http.Request, rec *statusRecorder, start time.Time) {
+	line := formatAccessLog(config.Format, r, rec.Status(), rec.bytes, start)
+	f := a.file(config.File)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := io.WriteString(f.w, line); err != nil {
+		log.Warnf("写入访问日志失败: %v", err)
+	}
+}
+
+func (a *AccessLogWriters) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for path, f := range a.writers {
+		if closer, ok := f.w.(io.Closer); ok && f.w != os.Stdout {
+			closer.Close()
+		}
+		delete(a.writers, path)
+	}
+}
+
+// Apache Common Log Format，combined在其后追加Referer和User-Agent
+func formatAccessLog(format string, r *http.Request, status int, bytes int64, start time.Time) string {
+	user := "-"
+	if name, _, ok := r.BasicAuth(); ok && name != "" {
+		user = name
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s", clientIP(r), user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto)), status, size)
+	if format == "combined" {
+		line += fmt.Sprintf(" %s %s", quoteOrDash(r.Referer()), quoteOrDash(r.UserAgent()))
+	}
+	return line + "\n"
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// 记录写给客户端的状态码和响应体大小
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
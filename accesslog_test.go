@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatAccessLog(t *testing.T) {
+	start := time.Date(2026, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+	request := func(method, target string, headers map[string]string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Del("User-Agent")
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		return r
+	}
+	authed := request(http.MethodGet, "/apache_pb.gif?a=1", map[string]string{
+		"Referer":    "http://www.example.com/start.html",
+		"User-Agent": `Mozilla/4.08 "quoted"`,
+	})
+	authed.RemoteAddr = "127.0.0.1:5555"
+	authed.SetBasicAuth("frank", "secret")
+
+	cases := []struct {
+		name   string
+		format string
+		r      *http.Request
+		status int
+		bytes  int64
+		want   string
+	}{
+		{"common", "common", authed, 200, 2326, `127.0.0.1 - frank [10/Oct/2026:13:55:36 -0700] "GET /apache_pb.gif?a=1 HTTP/1.1" 200 2326`},
+		{"combined", "combined", authed, 200, 2326, `127.0.0.1 - frank [10/Oct/2026:13:55:36 -0700] "GET /apache_pb.gif?a=1 HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""`},
+		// 没有用户、响应体和Referer时写-
+		{"空字段", "combined", request(http.MethodHead, "/", nil), 304, 0, `192.0.2.1 - - [10/Oct/2026:13:55:36 -0700] "HEAD / HTTP/1.1" 304 - "-" "-"`},
+	}
+	for _, c := range cases {
+		if got := formatAccessLog(c.format, c.r, c.status, c.bytes, start); got != c.want+"\n" {
+			t.Errorf("%s:\n%q\n期望:\n%q", c.name, got, c.want+"\n")
+		}
+	}
+}
+
+// 代理在请求结束后把访问日志写入配置的文件
+func TestAccessLogFile(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "access.log")
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "access_log": {"format": "common", "file": "`+path+`"}}}}`)
+
+	serveProxy(handler, httptest.NewRequest(http.MethodPost, "http://a.test/orders", strings.NewReader("x")))
+	handler.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := string(data); !strings.HasPrefix(line, "192.0.2.1 - - [") || !strings.HasSuffix(line, `] "POST http://a.test/orders HTTP/1.1" 201 7`+"\n") {
+		t.Errorf("访问日志: %q", line)
+	}
+}
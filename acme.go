@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// 通过ACME（如Let's Encrypt）为转发规则中的域名自动申请和续期证书，
+// 只为当前配置允许的域名申请，配置重新加载后立即生效
+func newCertManager(config *ACMEConfig, handler *ProxyHandler) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(config.CacheDir),
+		Email:  config.Email,
+		HostPolicy: func(_ context.Context, host string) error {
+			if !acmeHostAllowed(handler.state.Load().config, host) {
+				return fmt.Errorf("域名 %s 不在证书申请范围内, 不申请证书", host)
+			}
+			return nil
+		},
+	}
+}
+
+// 只允许transit_map中精确配置的域名和acme.hosts中列出的域名；通配符、正则和默认规则
+// 匹配的域名不申请，否则任意客户端都能通过SNI触发为随机子域名申请证书，耗尽颁发机构的频率限制
+func acmeHostAllowed(config *Config, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := config.TransitMap[host]; ok && !isHostPattern(host) {
+		return true
+	}
+	if acme := config.Server.ACME; acme != nil {
+		for _, allowed := range acme.Hosts {
+			if allowed == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 在80端口处理HTTP-01验证请求，其他请求重定向到https
+func serveHTTPChallenge(manager *autocert.Manager) {
+	log.Infof("ACME HTTP-01验证地址监听: :80")
+	if err := http.ListenAndServe(":80", manager.HTTPHandler(nil)); err != nil {
+		log.Errorf("ACME HTTP-01验证服务启动失败: %v", err)
+	}
+}
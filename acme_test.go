@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestACMEHostAllowed(t *testing.T) {
+	config, err := ParseConfig([]byte(`{
+		"server": {"acme": {"hosts": ["Listed.Example.com"]}},
+		"transit_map": {
+			"api.example.com": {"backend_base": "http://127.0.0.1:9001"},
+			"*.example.com": {"backend_base": "http://127.0.0.1:9002"},
+			"~^svc-[0-9]+\\.example\\.org$": {"backend_base": "http://127.0.0.1:9003"},
+			"*": {"backend_base": "http://127.0.0.1:9004"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"api.example.com":    true,
+		"API.example.com.":   true,
+		"listed.example.com": true,
+		"random.example.com": false, // 只匹配通配符规则
+		"svc-1.example.org":  false, // 只匹配正则规则
+		"other.test":         false, // 只匹配默认规则
+		"*.example.com":      false,
+		"*":                  false,
+	}
+	for host, want := range cases {
+		if got := acmeHostAllowed(config, host); got != want {
+			t.Errorf("acmeHostAllowed(%q) = %t, 期望 %t", host, got, want)
+		}
+	}
+}
+
+func TestACMEHostsRejectPatterns(t *testing.T) {
+	for _, host := range []string{"*.example.com", "~^a$", ""} {
+		_, err := ParseConfig([]byte(`{"server": {"acme": {"hosts": ["` + host + `"]}}, "transit_map": {}}`))
+		if err == nil {
+			t.Errorf("acme.hosts中的 %q 应被拒绝", host)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// 审计记录可选字段，未配置fields时使用defaultAuditFields
+var auditFields = map[string]struct{}{
+	"time": {}, "host": {}, "rule": {}, "method": {}, "url": {}, "backend_url": {}, "status": {}, "duration": {}, "error": {},
+	"wire_size": {}, "decoded_size": {}, "client_ip": {}, "request_headers": {}, "transit_headers": {}, "response_headers": {}, "request_body": {}, "response_body": {},
+}
+
+var defaultAuditFields = []string{"time", "host", "method", "url", "backend_url", "status", "duration", "error"}
+
+// 审计记录的写入目标
+type AuditSink interface {
+	Write(ctx context.Context, records [][]byte) error
+	Close() error
+}
+
+// 异步批量写入审计记录，缓冲区满时丢弃记录而不阻塞转发
+type AuditWriter struct {
+	sink    AuditSink
+	records chan []byte
+	dropped atomic.Int64
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool // Close之后提交的记录直接丢弃
+}
+
+func NewAuditWriter(sink AuditSink, bufferSize int) *AuditWriter {
+	a := &AuditWriter{sink: sink, records: make(chan []byte, bufferSize), done: make(chan struct{})}
+	go a.run()
+	return a
+}
+
+func (a *AuditWriter) Submit(record []byte) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.dropped.Add(1)
+		return
+	}
+	select {
+	case a.records <- record:
+	default:
+		if dropped := a.dropped.Add(1); dropped%1000 == 1 {
+			log.Warnf("审计缓冲区已满, 累计丢弃记录: %d", dropped)
+		}
+	}
+}
+
+func (a *AuditWriter) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+func (a *AuditWriter) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, 100)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := a.sink.Write(ctx, batch); err != nil {
+			log.Warnf("写入审计记录失败, 丢弃 %d 条: %v", len(batch), err)
+			a.dropped.Add(int64(len(batch)))
+		}
+		cancel()
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case record, ok := <-a.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) == cap(batch) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// 写完缓冲区中剩余的记录后关闭写入目标
+func (a *AuditWriter) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.records)
+	a.mu.Unlock()
+	<-a.done
+	return a.sink.Close()
+}
+
+// 去重时额外记录<field>_sha256，最近出现过的内容不记录正文并标记<field>_repeated
+func recordBody(record map[string]interface{}, field string, body []byte, bodies *RecentHashes) {
+	if bodies == nil || len(body) == 0 {
+		record[field] = string(body)
+		return
+	}
+	sum := sha256.Sum256(body)
+	record[field+"_sha256"] = hex.EncodeToString(sum[:])
+	if bodies.Seen(sum) {
+		record[field+"_repeated"] = true
+		return
+	}
+	record[field] = string(body)
+}
+
+// 固定容量的最近哈希集合，超出容量时淘汰最早加入的哈希
+type RecentHashes struct {
+	mu   sync.Mutex
+	set  map[[sha256.Size]byte]struct{}
+	ring [][sha256.Size]byte
+	next int
+}
+
+func NewRecentHashes(size int) *RecentHashes {
+	return &RecentHashes{set: make(map[[sha256.Size]byte]struct{}, size), ring: make([][sha256.Size]byte, 0, size)}
+}
+
+// 返回哈希是否已在集合中，不在时加入集合
+func (h *RecentHashes) Seen(sum [sha256.Size]byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.set[sum]; ok {
+		return true
+	}
+	if len(h.ring) < cap(h.ring) {
+		h.ring = append(h.ring, sum)
+	} else {
+		delete(h.set, h.ring[h.next])
+		h.ring[h.next] = sum
+		h.next = (h.next + 1) % len(h.ring)
+	}
+	h.set[sum] = struct{}{}
+	return false
+}
+
+func NewAuditSink(config *AuditConfig) (AuditSink, error) {
+	if config.Kafka != nil {
+		return newKafkaAuditSink(config.Kafka), nil
+	}
+	return nil, fmt.Errorf("未配置审计写入目标")
+}
+
+type kafkaAuditSink struct {
+	writer *kafka.Writer
+}
+
+func newKafkaAuditSink(config *KafkaAuditConfig) *kafkaAuditSink {
+	return &kafkaAuditSink{writer: &kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers...),
+		Topic:        config.Topic,
+		Balancer:     &kafka.LeastBytes{},
+		BatchTimeout: 10 * time.Millisecond,
+	}}
+}
+
+func (s *kafkaAuditSink) Write(ctx context.Context, records [][]byte) error {
+	messages := make([]kafka.Message, len(records))
+	for i, record := range records {
+		messages[i] = kafka.Message{Value: record}
+	}
+	return s.writer.WriteMessages(ctx, messages...)
+}
+
+func (s *kafkaAuditSink) Close() error {
+	return s.writer.Close()
+}
+
+// 按规则配置的字段从ProxyTrace生成审计记录，bodies不为空时重复出现的请求体/响应体只记录哈希
+func buildAuditRecord(r *http.Request, trace *ProxyTrace, fields []string, bodies *RecentHashes) []byte {
+	record := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		switch field {
+		case "time":
+			record[field] = trace.StartTime.Format(time.RFC3339Nano)
+		case "host":
+			record[field] = r.Host
+		case "rule":
+			record[field] = trace.Rule
+		case "method":
+			record[field] = trace.Method
+		case "url":
+			record[field] = trace.RequestURL
+		case "backend_url":
+			record[field] = trace.BackendURL
+		case "status":
+			record[field] = trace.StatusCode
+		case "duration":
+			record[field] = trace.Duration.Milliseconds()
+		case "error":
+			if trace.Error != nil {
+				record[field] = trace.Error.Error()
+			}
+		case "wire_size":
+			record[field] = trace.WireSize
+		case "decoded_size":
+			record[field] = trace.DecodedSize
+		case "client_ip":
+			record[field] = clientIP(r)
+		case "request_headers":
+			record[field] = trace.RequestHeaders
+		case "transit_headers":
+			record[field] = trace.TransitHeaders
+		case "response_headers":
+			record[field] = trace.ResponseHeaders
+		case "request_body":
+			recordBody(record, field, trace.RequestBody, bodies)
+		case "response_body":
+			recordBody(record, field, trace.ResponseBody, bodies)
+		}
+	}
+
+	data, _ := json.Marshal(record)
+	return data
+}
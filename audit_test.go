@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录写入内容的审计目标，block不为空时Write等待其关闭
+type fakeAuditSink struct {
+	mu      sync.Mutex
+	records []string
+	block   chan struct{}
+	err     error
+}
+
+func (s *fakeAuditSink) Write(ctx context.Context, records [][]byte) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		s.records = append(s.records, string(record))
+	}
+	return s.err
+}
+
+func (s *fakeAuditSink) Close() error { return nil }
+
+// 关闭时写完缓冲区中的记录，写入失败的记录计入丢弃数
+func TestAuditWriter(t *testing.T) {
+	cases := []struct {
+		name        string
+		err         error
+		submit      []string
+		wantDropped int64
+	}{
+		{"写入成功", nil, []string{"a", "b", "c"}, 0},
+		{"写入失败", errors.New("kafka不可用"), []string{"a", "b"}, 2},
+	}
+	for _, c := range cases {
+		sink := &fakeAuditSink{err: c.err}
+		writer := NewAuditWriter(sink, 10)
+		for _, record := range c.submit {
+			writer.Submit([]byte(record))
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sink.records, c.submit) || writer.Dropped() != c.wantDropped {
+			t.Errorf("%s: 写入 %q, 丢弃 %d, 期望写入 %q, 丢弃 %d", c.name, sink.records, writer.Dropped(), c.submit, c.wantDropped)
+		}
+	}
+}
+
+// 写入目标阻塞时缓冲区满后丢弃记录而不阻塞转发
+func TestAuditWriterDropsWhenFull(t *testing.T) {
+	sink := &fakeAuditSink{block: make(chan struct{})}
+	writer := NewAuditWriter(sink, 1)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 200; i++ {
+			writer.Submit([]byte("x"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("缓冲区满时Submit阻塞")
+	}
+	close(sink.block)
+	writer.Close()
+	if writer.Dropped() == 0 || int(writer.Dropped())+len(sink.records) != 200 {
+		t.Errorf("写入 %d 条, 丢弃 %d 条", len(sink.records), writer.Dropped())
+	}
+}
+
+// 关闭期间和关闭后提交的记录被丢弃，不会向已关闭的缓冲区发送
+func TestAuditWriterSubmitAfterClose(t *testing.T) {
+	sink := &fakeAuditSink{}
+	writer := NewAuditWriter(sink, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				writer.Submit([]byte("x"))
+			}
+		}()
+	}
+	writer.Close()
+	wg.Wait()
+	writer.Submit([]byte("x"))
+	if int(writer.Dropped())+len(sink.records) != 401 {
+		t.Errorf("写入 %d 条, 丢弃 %d 条, 期望共401条", len(sink.records), writer.Dropped())
+	}
+}
+
+func TestBuildAuditRecord(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://a.test/x", nil)
+	trace := &ProxyTrace{Method: http.MethodPost, RequestURL: "a.test/x", BackendURL: "http://b/x", StatusCode: 502,
+		Duration: 1500 * time.Millisecond, Error: errors.New("连接失败"), RequestBody: []byte("body")}
+
+	cases := []struct {
+		fields []string
+		want   map[string]interface{}
+	}{
+		{
+			[]string{"host", "method", "url", "backend_url", "status", "duration", "error"},
+			map[string]interface{}{"host": "a.test", "method": "POST", "url": "a.test/x", "backend_url": "http://b/x", "status": 502.0, "duration": 1500.0, "error": "连接失败"},
+		},
+		{
+			[]string{"request_body", "client_ip"},
+			map[string]interface{}{"request_body": "body", "client_ip": "192.0.2.1"},
+		},
+	}
+	for _, c := range cases {
+		var record map[string]interface{}
+		if err := json.Unmarshal(buildAuditRecord(r, trace, c.fields, nil), &record); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(record, c.want) {
+			t.Errorf("审计记录: %v, 期望 %v", record, c.want)
+		}
+	}
+}
+
+func TestAuditDedupBodies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://a.test/x", nil)
+	bodies := NewRecentHashes(2)
+	fields := []string{"request_body"}
+
+	cases := []struct {
+		name     string
+		body     string
+		repeated bool
+	}{
+		{"首次出现", "a", false},
+		{"重复内容", "a", true},
+		{"空请求体不去重", "", false},
+		{"第二个内容", "b", false},
+		{"第三个内容淘汰最早的哈希", "c", false},
+		{"被淘汰的内容重新记录", "a", false},
+		{"仍在集合中的内容", "c", true},
+	}
+	for _, c := range cases {
+		trace := &ProxyTrace{RequestBody: []byte(c.body)}
+		var record map[string]interface{}
+		if err := json.Unmarshal(buildAuditRecord(r, trace, fields, bodies), &record); err != nil {
+			t.Fatal(err)
+		}
+		_, hasBody := record["request_body"]
+		if record["request_body_repeated"] == true != c.repeated || hasBody == c.repeated {
+			t.Errorf("%s: 审计记录 %v", c.name, record)
+		}
+		if _, ok := record["request_body_sha256"]; ok != (c.body != "") {
+			t.Errorf("%s: 审计记录 %v", c.name, record)
+		}
+	}
+
+	if _, err := ParseConfig([]byte(`{"audit": {"kafka": {"brokers": ["k:9092"], "topic": "t"}},
+		"transit_map": {"a.test": {"backend": "http://b", "audit": {"dedup_bodies": -1}}}}`)); err == nil {
+		t.Error("dedup_bodies为负数时期望加载失败")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// 按策略和权重在规则的多个后端之间分配请求，least_conn按进行中的请求数与权重之比选择
+type LoadBalancer struct {
+	config  *LoadBalanceConfig
+	mu      sync.Mutex
+	next    int
+	active  []int // 各后端进行中的请求数
+	current []int // 平滑加权轮询的当前权重
+}
+
+func NewLoadBalancer(config *LoadBalanceConfig) *LoadBalancer {
+	return &LoadBalancer{config: config, active: make([]int, len(config.Backends)), current: make([]int, len(config.Backends))}
+}
+
+// 选择available的后端，请求结束后需调用返回的release；没有可用后端时返回false
+func (b *LoadBalancer) Acquire(available func(backend string) bool) (string, func(), bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(b.config.Backends)
+	weights := make([]int, n)
+	total := 0
+	for i, backend := range b.config.Backends {
+		if available == nil || available(backend) {
+			weights[i] = b.config.Weights[i]
+			total += weights[i]
+		}
+	}
+	if total == 0 {
+		return "", nil, false
+	}
+
+	index := -1
+	switch b.config.Strategy {
+	case "random":
+		pick := rand.Intn(total)
+		for index = 0; pick >= weights[index]; index++ {
+			pick -= weights[index]
+		}
+	case "least_conn":
+		// 负载相同时轮流选择，避免总是选中第一个；权重为0的后端不参与
+		for i := 0; i < n; i++ {
+			candidate := (b.next + i) % n
+			if weights[candidate] == 0 {
+				continue
+			}
+			if index < 0 || b.active[candidate]*weights[index] < b.active[index]*weights[candidate] {
+				index = candidate
+			}
+		}
+		b.next++
+	default:
+		// 平滑加权轮询，权重高的后端不会连续集中被选中
+		for i := range b.current {
+			b.current[i] += weights[i]
+			if index < 0 || b.current[i] > b.current[index] {
+				index = i
+			}
+		}
+		b.current[index] -= total
+	}
+
+	b.active[index]++
+	return b.config.Backends[index], func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.active[index]--
+	}, true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 按字节计数的令牌桶，令牌不足时预支并等待补足
+type ByteLimiter struct {
+	rate float64 // 每秒字节数
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewByteLimiter(rate int64) *ByteLimiter {
+	return &ByteLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *ByteLimiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 限制响应写出速度的ResponseWriter
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *ByteLimiter
+}
+
+func (w *throttledResponseWriter) Write(data []byte) (int, error) {
+	// 分块写出，避免单次大块写入造成突发流量
+	chunk := min(32*1024, int(w.limiter.rate))
+	written := 0
+	for written < len(data) {
+		end := min(written+chunk, len(data))
+		if err := w.limiter.Wait(w.ctx, end-written); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(data[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (w *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 桶中初始有1秒的令牌，之后按rate写出；shared时同一规则的请求共享令牌桶
+func TestBandwidthLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Write(make([]byte, size))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		shared   bool
+		sizes    []int
+		min, max time.Duration
+	}{
+		{false, []int{30000}, 400 * time.Millisecond, time.Second},
+		{false, []int{15000, 15000}, 0, 200 * time.Millisecond},
+		{true, []int{15000, 15000}, 400 * time.Millisecond, time.Second},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "bandwidth_limit": {"rate": 20000, "shared": `+strconv.FormatBool(c.shared)+`}}}}`)
+		start := time.Now()
+		for _, size := range c.sizes {
+			if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/?size="+strconv.Itoa(size), nil)); rec.Body.Len() != size {
+				t.Fatalf("响应体 %d 字节, 期望 %d", rec.Body.Len(), size)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < c.min || elapsed > c.max {
+			t.Errorf("shared=%t 以20000B/s写出 %v 字节耗时 %v, 期望 %v ~ %v", c.shared, c.sizes, elapsed, c.min, c.max)
+		}
+	}
+}
+
+func TestByteLimiterCanceled(t *testing.T) {
+	limiter := NewByteLimiter(1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, 1000); err != nil {
+		t.Fatalf("桶中令牌足够时等待失败: %v", err)
+	}
+	start := time.Now()
+	if err := limiter.Wait(ctx, 1000); err == nil {
+		t.Error("令牌不足且请求取消时未返回错误")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("请求取消后仍等待了 %v", elapsed)
+	}
+}
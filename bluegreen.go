@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 蓝绿发布的运行时状态，保存在ProxyHandler上，配置重新加载后保持不变
+type blueGreenState struct {
+	mu         sync.RWMutex
+	active     string
+	previous   string
+	switchedAt time.Time
+}
+
+type BlueGreenSwitch struct {
+	mu     sync.Mutex
+	states map[string]*blueGreenState
+}
+
+func NewBlueGreenSwitch() *BlueGreenSwitch {
+	return &BlueGreenSwitch{states: make(map[string]*blueGreenState)}
+}
+
+func (s *BlueGreenSwitch) state(host string, config *BlueGreenConfig) *blueGreenState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[host]
+	if !ok {
+		state = &blueGreenState{active: config.Active}
+		s.states[host] = state
+	}
+	return state
+}
+
+// 当前应使用的颜色，切换后的过渡期内旧颜色的流量占比线性递减至0
+func (s *BlueGreenSwitch) Color(host string, config *BlueGreenConfig) string {
+	state := s.state(host, config)
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	if state.previous != "" && config.Overlap > 0 {
+		elapsed := time.Since(state.switchedAt)
+		if elapsed < time.Duration(config.Overlap) && rand.Float64() > float64(elapsed)/float64(config.Overlap) {
+			return state.previous
+		}
+	}
+	return state.active
+}
+
+func (s *BlueGreenSwitch) Active(host string, config *BlueGreenConfig) string {
+	state := s.state(host, config)
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return state.active
+}
+
+func (s *BlueGreenSwitch) Switch(host string, config *BlueGreenConfig, color string) error {
+	if color != "blue" && color != "green" {
+		return fmt.Errorf("无效的颜色: %s", color)
+	}
+
+	state := s.state(host, config)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.active != color {
+		state.previous, state.active, state.switchedAt = state.active, color, time.Now()
+	}
+	return nil
+}
+
+func (c *BlueGreenConfig) Backend(color string) string {
+	if color == "green" {
+		return c.Green
+	}
+	return c.Blue
+}
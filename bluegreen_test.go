@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 通过管理接口切换颜色后，新请求发往对应颜色的后端
+func TestBlueGreenSwitchViaAdmin(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"blue_green": {"blue": "BACKEND/blue", "green": "BACKEND/green", "active": "blue"}}, "b.test": {"backend_base": "BACKEND"}}}`)
+	admin := NewAdminHandler(handler)
+
+	cases := []struct {
+		name       string
+		method     string
+		path, body string
+		wantCode   int
+		wantColor  string // 管理接口请求后转发请求到达的后端
+	}{
+		{"查询当前颜色", http.MethodGet, "/blue-green/a.test", "", http.StatusOK, "blue"},
+		{"切换到green", http.MethodPut, "/blue-green/a.test", `{"active": "green"}`, http.StatusOK, "green"},
+		{"无效的颜色", http.MethodPut, "/blue-green/a.test", `{"active": "red"}`, http.StatusBadRequest, "green"},
+		{"请求体格式错误", http.MethodPost, "/blue-green/a.test", `green`, http.StatusBadRequest, "green"},
+		{"不支持的请求方法", http.MethodDelete, "/blue-green/a.test", "", http.StatusMethodNotAllowed, "green"},
+		{"切换回blue", http.MethodPost, "/blue-green/a.test", `{"active": "blue"}`, http.StatusOK, "blue"},
+		{"未配置蓝绿发布的规则", http.MethodGet, "/blue-green/b.test", "", http.StatusNotFound, "blue"},
+	}
+	for _, c := range cases {
+		rec := serveProxy(admin, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if rec.Code != c.wantCode {
+			t.Errorf("%s: 状态 %d, 期望 %d: %s", c.name, rec.Code, c.wantCode, rec.Body)
+		}
+		if c.wantCode == http.StatusOK && !strings.Contains(rec.Body.String(), `"active":"`+c.wantColor+`"`) {
+			t.Errorf("%s: 管理接口返回 %s", c.name, rec.Body)
+		}
+		for i := 0; i < 5; i++ {
+			if got := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil)).Body.String(); got != "/"+c.wantColor+"/" {
+				t.Fatalf("%s: 请求发往 %s, 期望 %s", c.name, got, c.wantColor)
+			}
+		}
+	}
+}
+
+// 过渡期内旧颜色的流量从全部逐渐减少，过渡期结束后全部发往新颜色
+func TestBlueGreenOverlap(t *testing.T) {
+	s := NewBlueGreenSwitch()
+	config := &BlueGreenConfig{Blue: "http://blue", Green: "http://green", Active: "blue", Overlap: Duration(100 * time.Millisecond)}
+	s.Switch("a.test", config, "green")
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[s.Color("a.test", config)]++
+	}
+	if counts["blue"] < 900 {
+		t.Errorf("过渡期开始时旧颜色应承担绝大部分流量: %v", counts)
+	}
+	time.Sleep(110 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if color := s.Color("a.test", config); color != "green" {
+			t.Fatalf("过渡期结束后仍返回 %s", color)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 带有响应状态码的错误，用于在转发前以指定状态拒绝请求
+type HTTPError struct {
+	Status int
+	Err    error
+}
+
+func (e *HTTPError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// 错误对应的响应状态码，默认500
+func errorStatus(err error) int {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// 根据请求体内容判断实际类型，与声明的Content-Type明显不符时返回415，
+// 如声明为图片但内容不是该类图片，或声明为非HTML但内容是HTML/脚本
+func checkContentSniff(declared string, body []byte) error {
+	if len(body) == 0 || declared == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return nil
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	if sniffed == mediaType || sniffed == "application/octet-stream" {
+		return nil
+	}
+
+	declaredMajor, _, _ := strings.Cut(mediaType, "/")
+	sniffedMajor, _, _ := strings.Cut(sniffed, "/")
+	mismatch := false
+	switch declaredMajor {
+	case "image", "audio", "video", "font":
+		// SVG为XML文本，无法按二进制特征识别
+		mismatch = sniffedMajor != declaredMajor && mediaType != "image/svg+xml"
+	}
+	if sniffed == "text/html" && mediaType != "text/html" {
+		mismatch = true
+	}
+	if mismatch {
+		return &HTTPError{Status: http.StatusUnsupportedMediaType, Err: fmt.Errorf("请求体内容与Content-Type不符: 声明 %s, 实际 %s", mediaType, sniffed)}
+	}
+	return nil
+}
+
+// 逐个读取token计算JSON嵌套深度，超过maxDepth时返回400；
+// 非JSON请求体或JSON格式错误时不拦截，由后端处理
+func checkJSONDepth(contentType string, body []byte, maxDepth int) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || len(body) == 0 || mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			if depth++; depth > maxDepth {
+				return &HTTPError{Status: http.StatusBadRequest, Err: fmt.Errorf("请求体JSON嵌套深度超过上限: %d", maxDepth)}
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// 按规则配置转换请求体，需要时同步更新转发头中的Content-Type
+func (p *ProxyHandler) transformRequestBody(r *http.Request, headers http.Header, body []byte, rule TransitRule) ([]byte, error) {
+	if rule.Multipart != nil && len(body) > 0 {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err == nil && mediaType == "multipart/form-data" {
+			transformed, contentType, err := transformMultipart(body, params["boundary"], rule.Multipart)
+			if err != nil {
+				return nil, err
+			}
+			body = transformed
+			headers.Set("Content-Type", contentType)
+		}
+	}
+
+	if len(rule.BodyDefaults) > 0 && len(body) > 0 && r.Header.Get("Content-Encoding") == "" {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+			if merged, ok := applyBodyDefaults(body, rule.BodyDefaults); ok {
+				body = merged
+				headers.Set("Content-Length", strconv.Itoa(len(body)))
+			}
+		}
+	}
+
+	return body, nil
+}
+
+// 为顶层为对象的JSON请求体补充缺失的字段，嵌套对象逐层合并，客户端已提供的值（包括null）保持不变；
+// 请求体不是JSON对象或没有需要补充的字段时返回false
+func applyBodyDefaults(body []byte, defaults map[string]interface{}) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil || object == nil {
+		return nil, false
+	}
+	if !mergeDefaults(object, defaults) {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(object); err != nil {
+		return nil, false
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true
+}
+
+func mergeDefaults(object, defaults map[string]interface{}) bool {
+	changed := false
+	for key, value := range defaults {
+		existing, ok := object[key]
+		if !ok {
+			object[key] = value
+			changed = true
+			continue
+		}
+		child, isObject := existing.(map[string]interface{})
+		childDefaults, hasDefaults := value.(map[string]interface{})
+		if isObject && hasDefaults && mergeDefaults(child, childDefaults) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// 解析multipart请求体，删除或覆盖字段、检查单个part大小后以新的boundary重新编码
+func transformMultipart(body []byte, boundary string, config *MultipartConfig) ([]byte, string, error) {
+	if boundary == "" {
+		return nil, "", &HTTPError{Status: http.StatusBadRequest, Err: fmt.Errorf("multipart请求缺少boundary")}
+	}
+
+	skipped := make(map[string]struct{}, len(config.RemoveFields)+len(config.AddFields))
+	for _, name := range config.RemoveFields {
+		skipped[name] = struct{}{}
+	}
+	for name := range config.AddFields {
+		skipped[name] = struct{}{}
+	}
+
+	var buf bytes.Buffer
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	writer := multipart.NewWriter(&buf)
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", &HTTPError{Status: http.StatusBadRequest, Err: fmt.Errorf("解析multipart请求体失败: %v", err)}
+		}
+		if _, ok := skipped[part.FormName()]; ok {
+			continue
+		}
+
+		dst, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return nil, "", fmt.Errorf("编码multipart请求体失败: %v", err)
+		}
+		var src io.Reader = part
+		if config.MaxPartSize > 0 {
+			src = io.LimitReader(part, int64(config.MaxPartSize)+1)
+		}
+		n, err := io.Copy(dst, src)
+		if err != nil {
+			return nil, "", &HTTPError{Status: http.StatusBadRequest, Err: fmt.Errorf("读取multipart字段 %s 失败: %v", part.FormName(), err)}
+		}
+		if config.MaxPartSize > 0 && n > int64(config.MaxPartSize) {
+			return nil, "", &HTTPError{Status: http.StatusRequestEntityTooLarge, Err: fmt.Errorf("multipart字段 %s 超过大小限制 %d", part.FormName(), config.MaxPartSize)}
+		}
+	}
+
+	names := make([]string, 0, len(config.AddFields))
+	for name := range config.AddFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writer.WriteField(name, config.AddFields[name]); err != nil {
+			return nil, "", fmt.Errorf("编码multipart请求体失败: %v", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", fmt.Errorf("编码multipart请求体失败: %v", err)
+	}
+	return buf.Bytes(), writer.FormDataContentType(), nil
+}
+
+// 媒体类型是否匹配pattern，pattern支持text/*形式
+func mediaTypeMatches(mediaType, pattern string) bool {
+	if mediaType == pattern {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "/*")
+	return ok && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+// 校验后端响应的Content-Type，不符合时返回规则配置的状态码；无响应体时不校验
+func checkContentType(trace *ProxyTrace, rule TransitRule) error {
+	if len(trace.ResponseBody) == 0 {
+		return nil
+	}
+
+	actual := trace.ResponseHeaders.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(actual)
+	if err == nil && mediaTypeMatches(mediaType, rule.ExpectedContentType) {
+		return nil
+	}
+
+	log.Warnf("%s %s | 后端响应的Content-Type不符合预期: %q, 期望: %s, 状态码: %d", trace.Method, trace.RequestURL, actual, rule.ExpectedContentType, trace.StatusCode)
+	return &HTTPError{Status: rule.ContentTypeMismatchStatus, Err: fmt.Errorf("后端响应的Content-Type不符合预期: %s", actual)}
+}
+
+// 生成请求ID，客户端已携带时沿用
+func requestID(r *http.Request, header string) string {
+	if id := r.Header.Get(header); id != "" {
+		return id
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// 将请求ID写入JSON响应体的指定字段，字段以"."分隔表示嵌套对象，
+// 非JSON、压缩或顶层不是对象的响应体保持不变
+func injectRequestID(trace *ProxyTrace, field, id string) {
+	mediaType, _, _ := mime.ParseMediaType(trace.ResponseHeaders.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return
+	}
+	if encoding := trace.ResponseHeaders.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(trace.ResponseBody))
+	decoder.UseNumber()
+	var body map[string]interface{}
+	if err := decoder.Decode(&body); err != nil || body == nil {
+		return
+	}
+
+	keys := strings.Split(field, ".")
+	object := body
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			if _, exists := object[key]; exists {
+				return
+			}
+			child = make(map[string]interface{})
+			object[key] = child
+		}
+		object = child
+	}
+	object[keys[len(keys)-1]] = id
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(body); err != nil {
+		return
+	}
+	trace.ResponseBody = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	trace.ResponseHeaders.Set("Content-Length", strconv.Itoa(len(trace.ResponseBody)))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func multipartBody(fields map[string]string) ([]byte, string) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	writer.Close()
+	return buf.Bytes(), writer.Boundary()
+}
+
+func multipartFields(t *testing.T, body []byte, contentType string) map[string]string {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]string)
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return fields
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := io.ReadAll(part)
+		fields[part.FormName()] = string(value)
+	}
+}
+
+func TestTransformMultipart(t *testing.T) {
+	body, boundary := multipartBody(map[string]string{"keep": "1", "secret": "x", "source": "client", "big": "0123456789"})
+	cases := []struct {
+		name       string
+		body       []byte
+		boundary   string
+		config     MultipartConfig
+		wantStatus int // 0表示转换成功
+		want       map[string]string
+	}{
+		{"删除和覆盖字段", body, boundary, MultipartConfig{RemoveFields: []string{"secret", "big"}, AddFields: map[string]string{"source": "proxy", "added": "1"}}, 0,
+			map[string]string{"keep": "1", "source": "proxy", "added": "1"}},
+		{"字段等于max_part_size", body, boundary, MultipartConfig{MaxPartSize: 10}, 0,
+			map[string]string{"keep": "1", "secret": "x", "source": "client", "big": "0123456789"}},
+		{"字段超过max_part_size", body, boundary, MultipartConfig{MaxPartSize: 5}, http.StatusRequestEntityTooLarge, nil},
+		{"缺少boundary", body, "", MultipartConfig{}, http.StatusBadRequest, nil},
+		{"无效的请求体", []byte("garbage"), boundary, MultipartConfig{}, http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		transformed, contentType, err := transformMultipart(c.body, c.boundary, &c.config)
+		if c.wantStatus != 0 {
+			if errorStatus(err) != c.wantStatus {
+				t.Errorf("%s: %v, 期望状态 %d", c.name, err, c.wantStatus)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := multipartFields(t, transformed, contentType); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: 转换后的字段 %v, 期望 %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 转换后的请求体以新的Content-Type和Content-Length转发给后端
+func TestMultipartForwarded(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			http.Error(w, "Content-Length: "+r.Header.Get("Content-Length"), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(r.Header.Get("Content-Type") + "\n" + string(body)))
+	}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "multipart": {"remove_fields": ["secret"]}}}}`)
+
+	body, boundary := multipartBody(map[string]string{"keep": "1", "secret": "x"})
+	req := httptest.NewRequest(http.MethodPost, "http://a.test/upload", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	rec := serveProxy(handler, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态 %d: %s", rec.Code, rec.Body)
+	}
+	contentType, forwarded, _ := bytes.Cut(rec.Body.Bytes(), []byte("\n"))
+	if bytes.Contains(contentType, []byte(boundary)) {
+		t.Errorf("转发的Content-Type未使用新的boundary: %s", contentType)
+	}
+	if got := multipartFields(t, forwarded, string(contentType)); !reflect.DeepEqual(got, map[string]string{"keep": "1"}) {
+		t.Errorf("后端收到的字段: %v", got)
+	}
+}
+
+// 后端响应的Content-Type不符合expected_content_type时返回配置的状态码，没有响应体时不校验
+func TestExpectedContentType(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if r.URL.Query().Get("empty") == "" {
+			w.Write([]byte("body"))
+		}
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name     string
+		expected string
+		query    string
+		want     int
+	}{
+		{"类型相同", "application/json", "?type=application/json%3B+charset=utf-8", http.StatusOK},
+		{"类型不同", "application/json", "?type=text/html", http.StatusServiceUnavailable},
+		{"缺少Content-Type", "application/json", "?type=", http.StatusServiceUnavailable},
+		{"没有响应体", "application/json", "?type=text/html&empty=1", http.StatusOK},
+		{"通配符匹配", "text/*", "?type=text/html", http.StatusOK},
+		{"通配符不匹配", "text/*", "?type=textual/html", http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "expected_content_type": "`+c.expected+`", "content_type_mismatch_status": 503}}}`)
+		if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/"+c.query, nil)); rec.Code != c.want {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, rec.Code, c.want)
+		}
+	}
+}
+
+// 开启schema_drift时不符合schema的响应只记录warn日志，响应照常返回
+func TestSchemaDrift(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "user.json")
+	if err := os.WriteFile(schema, []byte(`{"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		io.WriteString(w, r.URL.Query().Get("body"))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name  string
+		query url.Values
+		drift bool
+	}{
+		{"符合schema", url.Values{"type": {"application/json"}, "body": {`{"id": 1}`}}, false},
+		{"缺少字段", url.Values{"type": {"application/json"}, "body": {`{"name": "a"}`}}, true},
+		{"字段类型变化", url.Values{"type": {"application/problem+json"}, "body": {`{"id": "1"}`}}, true},
+		{"无效的JSON", url.Values{"type": {"application/json"}, "body": {`{"id": `}}, true},
+		{"非JSON响应不校验", url.Values{"type": {"text/plain"}, "body": {`{"name": "a"}`}}, false},
+	}
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "schema_drift": {"schema": "`+filepath.ToSlash(schema)+`", "rate": 1}}}}`)
+	for _, c := range cases {
+		logs := captureLog(t)
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/user?"+c.query.Encode(), nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != c.query.Get("body") {
+			t.Errorf("%s: %d %q, 期望原样返回后端响应", c.name, rec.Code, rec.Body)
+		}
+		if got := logs.FilterMessageSnippet("不符合schema").Len(); got != 0 != c.drift {
+			t.Errorf("%s: schema日志 %d 条", c.name, got)
+		}
+	}
+
+	if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend": "http://b", "schema_drift": {"schema": "` + filepath.ToSlash(schema) + `", "rate": 2}}}}`)); err == nil {
+		t.Error("rate大于1时期望加载失败")
+	}
+}
+
+// body_defaults为JSON请求体补充缺失的字段，嵌套对象逐层合并，并更新Content-Length
+func TestBodyDefaults(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string // 为空表示原样转发
+	}{
+		{"缺失字段", "application/json", `{"name": "a"}`, `{"name": "a", "version": 1, "options": {"lang": "zh", "safe": true}}`},
+		{"已提供的字段", "application/json", `{"version": 2, "options": {"lang": "en", "safe": false}}`, ""},
+		{"null保持不变", "application/json", `{"version": null, "options": null}`, ""},
+		{"嵌套对象逐层合并", "application/vnd.api+json", `{"version": 2, "options": {"lang": "en", "extra": [1]}}`, `{"version": 2, "options": {"lang": "en", "safe": true, "extra": [1]}}`},
+		{"顶层不是对象", "application/json", `[1, 2]`, ""},
+		{"格式错误", "application/json", `{"name": `, ""},
+		{"非JSON类型", "text/plain", `{"name": "a"}`, ""},
+	}
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"forward_client": true},
+		"body_defaults": {"version": 1, "options": {"lang": "zh", "safe": true}}}}}`)
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "http://a.test/", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		rec := serveProxy(handler, req)
+		if rec.Header().Get("X-Content-Length") != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%s: 后端收到Content-Length %s, 请求体 %d 字节", c.name, rec.Header().Get("X-Content-Length"), rec.Body.Len())
+		}
+		if c.want == "" {
+			if rec.Body.String() != c.body {
+				t.Errorf("%s: 后端收到 %s, 期望原样转发", c.name, rec.Body)
+			}
+			continue
+		}
+		var got, want interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		json.Unmarshal([]byte(c.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: 后端收到 %s, 期望 %s", c.name, rec.Body, c.want)
+		}
+	}
+}
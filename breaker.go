@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 基于响应耗时的熔断器：窗口内p95耗时超过阈值时熔断，冷却后放行单个探测请求
+type CircuitBreaker struct {
+	config *CircuitBreakerConfig
+
+	mu        sync.Mutex
+	latencies []time.Duration // 最近请求耗时的环形窗口
+	next      int
+	openUntil time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker(config *CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{config: config, latencies: make([]time.Duration, 0, config.Window)}
+}
+
+// 是否允许请求通过，熔断冷却结束后仅放行一个探测请求
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// 记录请求耗时，返回本次记录是否触发熔断
+func (b *CircuitBreaker) Record(latency time.Duration, failed bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	threshold := time.Duration(b.config.LatencyThreshold)
+
+	// 探测请求的结果决定恢复还是继续熔断
+	if !b.openUntil.IsZero() {
+		if !b.probing {
+			return false
+		}
+		b.probing = false
+		if failed || latency > threshold {
+			b.openUntil = time.Now().Add(time.Duration(b.config.Cooldown))
+			return true
+		}
+		b.openUntil = time.Time{}
+		b.latencies, b.next = b.latencies[:0], 0
+		return false
+	}
+
+	if len(b.latencies) < b.config.Window {
+		b.latencies = append(b.latencies, latency)
+	} else {
+		b.latencies[b.next] = latency
+		b.next = (b.next + 1) % b.config.Window
+	}
+
+	if len(b.latencies) < b.config.MinRequests || b.percentile(0.95) <= threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(time.Duration(b.config.Cooldown))
+	b.latencies, b.next = b.latencies[:0], 0
+	return true
+}
+
+func (b *CircuitBreaker) percentile(q float64) time.Duration {
+	sorted := make([]time.Duration, len(b.latencies))
+	copy(sorted, b.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(float64(len(sorted))*q+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensOnP95(t *testing.T) {
+	fast, slow := 10*time.Millisecond, time.Second
+	repeat := func(latency time.Duration, n int) []time.Duration {
+		latencies := make([]time.Duration, n)
+		for i := range latencies {
+			latencies[i] = latency
+		}
+		return latencies
+	}
+	cases := []struct {
+		name      string
+		latencies []time.Duration
+		open      bool
+	}{
+		{"全部为快请求", repeat(fast, 20), false},
+		{"慢请求不超过5%", append(repeat(fast, 19), slow), false},
+		{"慢请求超过5%", append(repeat(fast, 18), slow, slow), true},
+		{"请求数不足min_requests", repeat(slow, 19), false},
+		{"持续慢请求", repeat(slow, 20), true},
+	}
+	for _, c := range cases {
+		b := NewCircuitBreaker(&CircuitBreakerConfig{LatencyThreshold: Duration(100 * time.Millisecond), Window: 20, MinRequests: 20, Cooldown: Duration(time.Minute)})
+		opened := false
+		for _, latency := range c.latencies {
+			opened = b.Record(latency, false) || opened
+		}
+		if opened != c.open || b.Allow() == c.open {
+			t.Errorf("%s: 熔断 %t, 期望 %t", c.name, opened, c.open)
+		}
+	}
+}
+
+// 冷却后只放行一个探测请求，探测成功后恢复，失败或耗时超过阈值时继续熔断
+func TestCircuitBreakerProbe(t *testing.T) {
+	cases := []struct {
+		latency time.Duration
+		failed  bool
+		reopen  bool
+	}{
+		{time.Millisecond, false, false},
+		{time.Millisecond, true, true},
+		{time.Second, false, true},
+	}
+	for _, c := range cases {
+		b := NewCircuitBreaker(&CircuitBreakerConfig{LatencyThreshold: Duration(100 * time.Millisecond), Window: 1, MinRequests: 1, Cooldown: Duration(20 * time.Millisecond)})
+		if !b.Record(time.Second, false) {
+			t.Fatal("慢请求未触发熔断")
+		}
+		time.Sleep(30 * time.Millisecond)
+		if !b.Allow() || b.Allow() {
+			t.Fatal("冷却后应只放行一个探测请求")
+		}
+		if reopened := b.Record(c.latency, c.failed); reopened != c.reopen || b.Allow() == c.reopen {
+			t.Errorf("探测请求耗时 %v 失败 %t: 继续熔断 %t, 期望 %t", c.latency, c.failed, reopened, c.reopen)
+		}
+	}
+}
+
+// 后端持续慢响应时熔断，之后的请求不再转发给后端
+func TestCircuitBreakerRejectsSlowBackend(t *testing.T) {
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "circuit_breaker": {"latency_threshold": "10ms", "window": 3, "min_requests": 3}}}}`)
+
+	for i := 0; i < 3; i++ {
+		serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil))
+	}
+	if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil)); rec.Code != http.StatusServiceUnavailable || requests.Load() != 3 {
+		t.Errorf("熔断后: 状态 %d, 后端收到 %d 个请求", rec.Code, requests.Load())
+	}
+}
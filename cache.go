@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 缓存条目数上限，超出后先清理过期条目，仍然超出则不再缓存新响应
+const maxCacheEntries = 10000
+
+type cacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	StoredAt   time.Time
+	Expires    time.Time
+}
+
+func (e *cacheEntry) Fresh() bool {
+	return time.Now().Before(e.Expires)
+}
+
+// 过期时长不超过maxStale的条目可在后端失败时返回
+func (e *cacheEntry) Usable(maxStale time.Duration) bool {
+	return time.Since(e.Expires) <= maxStale
+}
+
+type ResponseCache struct {
+	mu         sync.RWMutex
+	entries    map[string]*cacheEntry
+	varies     map[string][]string      // 各缓存键最近一次缓存的响应Vary中列出的请求头
+	refreshing map[string]chan struct{} // 正在刷新的缓存键，刷新结束时close
+}
+
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{entries: make(map[string]*cacheEntry), varies: make(map[string][]string), refreshing: make(map[string]chan struct{})}
+}
+
+// 缓存键包含转发规则、请求的域名和后端URL：不同规则或域名捕获注入的请求头不同，即使后端URL相同响应也不能共享
+func responseCacheKey(ruleKey, host, targetURL string) string {
+	return ruleKey + " " + host + " " + targetURL
+}
+
+// 同一缓存键按影响响应内容的请求头分别缓存：总是区分Accept-Encoding，以及响应Vary中列出的请求头
+func variantKey(key string, r *http.Request, vary []string) string {
+	var builder strings.Builder
+	builder.WriteString(key)
+	for _, name := range append([]string{"Accept-Encoding"}, vary...) {
+		builder.WriteString("\n" + name + ": " + strings.Join(r.Header.Values(name), ","))
+	}
+	return builder.String()
+}
+
+// 解析Vary响应头，返回除Accept-Encoding外的请求头名称，包含*时ok为false
+func parseVary(header http.Header) (vary []string, ok bool) {
+	seen := map[string]bool{"Accept-Encoding": true}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" && !seen[name] {
+				seen[name] = true
+				vary = append(vary, name)
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary, true
+}
+
+// 同一缓存键同时只允许一个请求刷新，获得刷新权时返回释放函数，
+// 已有请求在刷新时返回nil和刷新结束的通知
+func (c *ResponseCache) LockRefresh(key string) (func(), <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if done, ok := c.refreshing[key]; ok {
+		return nil, done
+	}
+	done := make(chan struct{})
+	c.refreshing[key] = done
+	return func() {
+		c.mu.Lock()
+		delete(c.refreshing, key)
+		c.mu.Unlock()
+		close(done)
+	}, nil
+}
+
+// 返回与请求匹配的缓存条目，key由responseCacheKey生成
+func (c *ResponseCache) Get(key string, r *http.Request) *cacheEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries[variantKey(key, r, c.varies[key])]
+}
+
+func (c *ResponseCache) Store(key string, r *http.Request, trace *ProxyTrace, config *CacheConfig) {
+	if trace.StatusCode != http.StatusOK || r.Header.Get("Authorization") != "" {
+		return
+	}
+	// 带Set-Cookie的响应属于特定客户端，不能返回给其他客户端
+	if len(trace.ResponseHeaders.Values("Set-Cookie")) > 0 {
+		return
+	}
+	vary, ok := parseVary(trace.ResponseHeaders)
+	if !ok {
+		return
+	}
+
+	directives := parseCacheControl(trace.ResponseHeaders.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return
+	}
+	if _, ok := directives["private"]; ok {
+		return
+	}
+
+	// 优先使用后端给出的缓存时间，no-cache的响应立即过期，仅用于后端失败时兜底
+	ttl, ok := cacheControlTTL(directives)
+	if config.TTLHeader != "" && (!ok || !config.TTLHeaderFallback) {
+		if headerTTL, headerOK := parseTTLHeader(trace.ResponseHeaders.Get(config.TTLHeader)); headerOK {
+			ttl, ok = headerTTL, true
+		}
+	}
+	if !ok {
+		ttl = time.Duration(config.TTL)
+	}
+	if _, ok := directives["no-cache"]; ok {
+		ttl = 0
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		StatusCode: trace.StatusCode,
+		Header:     trace.ResponseHeaders.Clone(),
+		Body:       trace.ResponseBody,
+		StoredAt:   now,
+		Expires:    now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	variant := variantKey(key, r, vary)
+	if _, ok := c.entries[variant]; !ok && len(c.entries) >= maxCacheEntries {
+		c.prune()
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	c.varies[key] = vary
+	c.entries[variant] = entry
+}
+
+// 清理过期条目，以及不再有条目的缓存键的Vary记录
+func (c *ResponseCache) prune() {
+	urls := make(map[string]bool, len(c.entries))
+	for k, e := range c.entries {
+		if !e.Fresh() {
+			delete(c.entries, k)
+			continue
+		}
+		url, _, _ := strings.Cut(k, "\n")
+		urls[url] = true
+	}
+	for url := range c.varies {
+		if !urls[url] {
+			delete(c.varies, url)
+		}
+	}
+}
+
+// 将缓存条目写回客户端，stale表示条目已过期，仅因后端失败而返回
+func (c *ResponseCache) Serve(w http.ResponseWriter, entry *cacheEntry, stale bool) error {
+	for key, values := range entry.Header {
+		// 复制切片，避免Add修改共享的缓存条目
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+	if stale {
+		w.Header().Add("Warning", `110 - "Response is Stale"`)
+	}
+	w.WriteHeader(entry.StatusCode)
+	_, err := w.Write(entry.Body)
+	return err
+}
+
+func cacheControlTTL(directives map[string]string) (time.Duration, bool) {
+	for _, key := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[key]; ok {
+			if seconds, err := strconv.Atoi(value); err == nil {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// 解析自定义缓存时间Header，支持秒数或"30s"形式的时长
+func parseTTLHeader(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if ttl, err := time.ParseDuration(value); err == nil && ttl >= 0 {
+		return ttl, true
+	}
+	return 0, false
+}
+
+// 请求要求不使用缓存
+func requestNoCache(r *http.Request) bool {
+	directives := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := directives["no-cache"]
+	_, noStore := directives["no-store"]
+	return noCache || noStore || r.Header.Get("Pragma") == "no-cache"
+}
+
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return directives
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cacheTrace(header http.Header, body string) *ProxyTrace {
+	return &ProxyTrace{StatusCode: http.StatusOK, ResponseHeaders: header, ResponseBody: []byte(body)}
+}
+
+func cacheRequest(header map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://a.test/x", nil)
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+	return r
+}
+
+var testCacheConfig = &CacheConfig{TTL: Duration(time.Minute)}
+
+// 后端返回5xx或不可达时在max_stale内返回过期缓存，超过max_stale后返回后端的错误
+func TestCacheServesStaleOnBackendFailure(t *testing.T) {
+	cases := []struct {
+		maxStale string
+		down     bool // 后端不可达，否则返回503
+		want     int
+	}{
+		{"1m", false, http.StatusOK},
+		{"1m", true, http.StatusOK},
+		{"10ms", false, http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		var failing atomic.Bool
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("v1"))
+		}))
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "cache": {"ttl": "20ms", "max_stale": "`+c.maxStale+`"}}}}`)
+		if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/x", nil)); rec.Body.String() != "v1" {
+			t.Fatalf("首次请求: %d %s", rec.Code, rec.Body)
+		}
+		time.Sleep(50 * time.Millisecond)
+		failing.Store(true)
+		if c.down {
+			backend.Close()
+		}
+
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/x", nil))
+		if rec.Code != c.want {
+			t.Errorf("max_stale=%s down=%t: 状态 %d, 期望 %d", c.maxStale, c.down, rec.Code, c.want)
+		}
+		if c.want == http.StatusOK && (rec.Body.String() != "v1" || rec.Header().Get("Warning") == "") {
+			t.Errorf("max_stale=%s down=%t: 过期缓存 %q, Warning: %q", c.maxStale, c.down, rec.Body, rec.Header().Get("Warning"))
+		}
+		backend.Close()
+	}
+}
+
+// ttl_header覆盖或补充Cache-Control给出的缓存时间
+func TestCacheTTLHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		header   http.Header
+		fallback bool
+		want     time.Duration
+	}{
+		{"秒数", http.Header{"X-Cache-Ttl": {"120"}}, false, 2 * time.Minute},
+		{"时长", http.Header{"X-Cache-Ttl": {"30s"}}, false, 30 * time.Second},
+		{"优先于max-age", http.Header{"X-Cache-Ttl": {"120"}, "Cache-Control": {"max-age=10"}}, false, 2 * time.Minute},
+		{"fallback时max-age优先", http.Header{"X-Cache-Ttl": {"120"}, "Cache-Control": {"max-age=10"}}, true, 10 * time.Second},
+		{"fallback时无max-age", http.Header{"X-Cache-Ttl": {"120"}}, true, 2 * time.Minute},
+		{"无效值使用默认ttl", http.Header{"X-Cache-Ttl": {"soon"}}, false, time.Minute},
+		{"负数使用s-maxage", http.Header{"X-Cache-Ttl": {"-5"}, "Cache-Control": {"s-maxage=20, max-age=10"}}, false, 20 * time.Second},
+	}
+	for _, c := range cases {
+		cache := NewResponseCache()
+		config := &CacheConfig{TTL: Duration(time.Minute), TTLHeader: "X-Cache-TTL", TTLHeaderFallback: c.fallback}
+		r := cacheRequest(nil)
+		cache.Store("http://b/x", r, cacheTrace(c.header, "body"), config)
+		entry := cache.Get("http://b/x", r)
+		if entry == nil {
+			t.Fatalf("%s: 未缓存", c.name)
+		}
+		if got := entry.Expires.Sub(entry.StoredAt); got != c.want {
+			t.Errorf("%s: 缓存时间 %v, 期望 %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 开启lock_timeout时缓存未命中或过期只由一个请求刷新，其他请求等待刷新结果，
+// 过期时间在stale_while_refresh内时直接返回过期缓存
+func TestCacheRefreshLock(t *testing.T) {
+	cases := []struct {
+		name      string
+		warm      bool   // 是否先写入缓存并等待其过期
+		stale     string // stale_while_refresh
+		wantBody  string // 等待的请求得到的响应体
+		wantStale bool
+	}{
+		{"未命中时合并请求", false, "0s", "v1", false},
+		{"过期时等待刷新", true, "0s", "v2", false},
+		{"刷新期间返回过期缓存", true, "1m", "v1", true},
+	}
+	for _, c := range cases {
+		var hits atomic.Int32
+		var block atomic.Bool
+		entered, release := make(chan struct{}, 1), make(chan struct{})
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := hits.Add(1)
+			if block.Load() {
+				entered <- struct{}{}
+				<-release
+			}
+			w.Write([]byte("v" + strconv.Itoa(int(n))))
+		}))
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "cache": {"ttl": "30ms", "lock_timeout": "2s", "stale_while_refresh": "`+c.stale+`"}}}}`)
+		if c.warm {
+			serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/x", nil))
+			time.Sleep(50 * time.Millisecond)
+		}
+		before := hits.Load()
+		block.Store(true)
+
+		refresher := make(chan *httptest.ResponseRecorder, 1)
+		go func() { refresher <- serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/x", nil)) }()
+		<-entered
+
+		var wg sync.WaitGroup
+		recs := make([]*httptest.ResponseRecorder, 5)
+		for i := range recs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				recs[i] = serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/x", nil))
+			}(i)
+		}
+		if c.wantStale {
+			// 返回过期缓存的请求不等待刷新
+			wg.Wait()
+		} else {
+			time.Sleep(20 * time.Millisecond)
+		}
+		close(release)
+		wg.Wait()
+		<-refresher
+
+		if got := hits.Load() - before; got != 1 {
+			t.Errorf("%s: 后端被请求 %d 次, 期望 1 次", c.name, got)
+		}
+		for _, rec := range recs {
+			if rec.Code != http.StatusOK || rec.Body.String() != c.wantBody || (rec.Header().Get("Warning") != "") != c.wantStale {
+				t.Errorf("%s: %d %q Warning %q, 期望 %q", c.name, rec.Code, rec.Body, rec.Header().Get("Warning"), c.wantBody)
+			}
+		}
+		backend.Close()
+	}
+}
+
+func TestCacheStoreSkipsSetCookie(t *testing.T) {
+	cache := NewResponseCache()
+	r := cacheRequest(nil)
+	cache.Store("http://b/x", r, cacheTrace(http.Header{"Set-Cookie": {"session=alice"}}, "alice"), testCacheConfig)
+	if entry := cache.Get("http://b/x", r); entry != nil {
+		t.Fatalf("带Set-Cookie的响应被缓存: %s", entry.Body)
+	}
+}
+
+func TestCacheStoreSkipsVaryStar(t *testing.T) {
+	cache := NewResponseCache()
+	r := cacheRequest(nil)
+	cache.Store("http://b/x", r, cacheTrace(http.Header{"Vary": {"*"}}, "body"), testCacheConfig)
+	if entry := cache.Get("http://b/x", r); entry != nil {
+		t.Fatal("Vary: *的响应被缓存")
+	}
+}
+
+func TestCacheKeyedByAcceptEncoding(t *testing.T) {
+	cache := NewResponseCache()
+	gzipped := cacheRequest(map[string]string{"Accept-Encoding": "gzip"})
+	cache.Store("http://b/x", gzipped, cacheTrace(http.Header{"Content-Encoding": {"gzip"}}, "gzip body"), testCacheConfig)
+
+	if entry := cache.Get("http://b/x", gzipped); entry == nil || string(entry.Body) != "gzip body" {
+		t.Fatal("相同Accept-Encoding的请求未命中缓存")
+	}
+	if entry := cache.Get("http://b/x", cacheRequest(nil)); entry != nil {
+		t.Fatal("gzip响应返回给了不支持gzip的客户端")
+	}
+}
+
+func TestCacheKeyedByVary(t *testing.T) {
+	cache := NewResponseCache()
+	alice := cacheRequest(map[string]string{"X-Tenant": "alice"})
+	bob := cacheRequest(map[string]string{"X-Tenant": "bob"})
+	cache.Store("http://b/x", alice, cacheTrace(http.Header{"Vary": {"x-tenant, Accept-Encoding"}}, "alice"), testCacheConfig)
+
+	if entry := cache.Get("http://b/x", alice); entry == nil || string(entry.Body) != "alice" {
+		t.Fatal("相同Vary请求头的请求未命中缓存")
+	}
+	if entry := cache.Get("http://b/x", bob); entry != nil {
+		t.Fatalf("Vary请求头不同的请求命中了缓存: %s", entry.Body)
+	}
+
+	cache.Store("http://b/x", bob, cacheTrace(http.Header{"Vary": {"X-Tenant"}}, "bob"), testCacheConfig)
+	if entry := cache.Get("http://b/x", alice); entry == nil || string(entry.Body) != "alice" {
+		t.Fatal("缓存其他变体后原有变体丢失")
+	}
+}
+
+// 指向同一后端的不同规则或不同域名注入的请求头不同，各自缓存
+func TestCacheKeyedByRule(t *testing.T) {
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(r.Header.Get("X-Tenant")))
+	}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {
+		"a.test": {"backend_base": "BACKEND", "headers": {"set": {"X-Tenant": "alice"}}, "cache": {"ttl": "1m"}},
+		"b.test": {"backend_base": "BACKEND", "headers": {"set": {"X-Tenant": "bob"}}, "cache": {"ttl": "1m"}},
+		"*.tenant.test": {"backend_base": "BACKEND", "headers": {"set": {"X-Tenant": "{host.1}"}}, "cache": {"ttl": "1m"}}
+	}}`)
+
+	cases := []struct{ host, want string }{
+		{"a.test", "alice"},
+		{"b.test", "bob"},
+		{"carol.tenant.test", "carol"},
+		{"dave.tenant.test", "dave"},
+	}
+	for round := 0; round < 2; round++ {
+		for _, c := range cases {
+			rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://"+c.host+"/x", nil))
+			if rec.Body.String() != c.want {
+				t.Errorf("%s: 响应 %q, 期望 %q", c.host, rec.Body, c.want)
+			}
+		}
+	}
+	if got := requests.Load(); got != int32(len(cases)) {
+		t.Errorf("后端收到 %d 个请求, 期望 %d", got, len(cases))
+	}
+}
+
+// 返回缓存时复制Header，添加Warning不修改缓存条目
+func TestCacheServeCopiesHeader(t *testing.T) {
+	warnings := make([]string, 1, 4)
+	warnings[0] = `199 - "from backend"`
+	entry := &cacheEntry{StatusCode: http.StatusOK, Header: http.Header{"Warning": warnings}, StoredAt: time.Now()}
+	cache := NewResponseCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			cache.Serve(rec, entry, true)
+			if got := len(rec.Header().Values("Warning")); got != 2 {
+				t.Errorf("Warning数量 %d, 期望 2", got)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := entry.Header.Values("Warning"); len(got) != 1 {
+		t.Errorf("缓存条目的Warning被修改: %q", got)
+	}
+}
+
+func TestCacheStoreHonorsCacheControl(t *testing.T) {
+	cache := NewResponseCache()
+	r := cacheRequest(nil)
+	for _, value := range []string{"no-store", "private, max-age=60"} {
+		cache.Store("http://b/x", r, cacheTrace(http.Header{"Cache-Control": {value}}, "body"), testCacheConfig)
+		if cache.Get("http://b/x", r) != nil {
+			t.Errorf("Cache-Control: %s 的响应被缓存", value)
+		}
+	}
+
+	cache.Store("http://b/x", r, cacheTrace(http.Header{"Cache-Control": {"max-age=0"}}, "body"), testCacheConfig)
+	if entry := cache.Get("http://b/x", r); entry == nil || entry.Fresh() {
+		t.Error("max-age=0的响应应缓存为已过期条目")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// 为后端未设置缓存头的响应补充ETag、Cache-Control和Vary，便于下游CDN缓存
+func applyCDNHeaders(r *http.Request, trace *ProxyTrace, config *CDNHeadersConfig) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || trace.StatusCode != http.StatusOK {
+		return
+	}
+	headers := trace.ResponseHeaders
+
+	if config.ETag && headers.Get("ETag") == "" {
+		sum := sha256.Sum256(trace.ResponseBody)
+		headers.Set("ETag", `W/"`+hex.EncodeToString(sum[:16])+`"`)
+	}
+	if config.CacheControl != "" && headers.Get("Cache-Control") == "" {
+		headers.Set("Cache-Control", config.CacheControl)
+	}
+
+	existing := make(map[string]struct{})
+	for _, value := range headers.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			existing[strings.ToLower(strings.TrimSpace(field))] = struct{}{}
+		}
+	}
+	if _, ok := existing["*"]; ok {
+		return
+	}
+	for _, field := range config.Vary {
+		if _, ok := existing[strings.ToLower(field)]; !ok {
+			headers.Add("Vary", field)
+			existing[strings.ToLower(field)] = struct{}{}
+		}
+	}
+}
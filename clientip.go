@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientAddrKey struct{}
+
+// 请求的真实客户端地址，ServeHTTP开始时按server.trusted_proxies确定
+type clientAddr struct {
+	ip           string
+	trustedProxy bool // 连接的对端是受信任的代理，客户端传入的X-Forwarded-For可信
+}
+
+// 客户端IP：对端是受信任的代理时取X-Forwarded-For中从右往左第一个不受信任的地址，否则取连接的对端地址
+func clientIP(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientAddrKey{}).(clientAddr); ok {
+		return addr.ip
+	}
+	return peerIP(r)
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 客户端传入的X-Forwarded-For是否来自受信任的代理；未配置trusted_proxies时不做区分
+func forwardedForTrusted(r *http.Request) bool {
+	addr, ok := r.Context().Value(clientAddrKey{}).(clientAddr)
+	return !ok || addr.trustedProxy
+}
+
+// 未配置trusted_proxies时不修改请求
+func withClientAddr(r *http.Request, trusted []*net.IPNet) *http.Request {
+	if len(trusted) == 0 {
+		return r
+	}
+	isTrusted := func(ip string) bool {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return false
+		}
+		for _, network := range trusted {
+			if network.Contains(parsed) {
+				return true
+			}
+		}
+		return false
+	}
+
+	addr := clientAddr{ip: peerIP(r)}
+	if isTrusted(addr.ip) {
+		addr.trustedProxy = true
+		var hops []string
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		// 全部为受信任的代理时取最左边的地址
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr.ip = hops[i]
+			if !isTrusted(hops[i]) {
+				break
+			}
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, addr))
+}
+
+// 解析trusted_proxies，单个IP视为/32或/128
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: proxy}
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
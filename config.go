@@ -1,14 +1,217 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.starlark.net/starlark"
 )
 
+// Duration 支持 "30s"、"5m" 形式的字符串，或以秒为单位的数字
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("无效的时长: %s", string(data))
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ByteSize 支持 "1MiB"、"500KB" 形式的字符串，或以字节为单位的数字
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*b = ByteSize(value)
+	case string:
+		size, err := humanize.ParseBytes(value)
+		if err != nil {
+			return err
+		}
+		*b = ByteSize(size)
+	default:
+		return fmt.Errorf("无效的字节数: %s", string(data))
+	}
+	return nil
+}
+
+// 可读形式会四舍五入，不能精确还原时输出字节数，保证序列化后重新解析的值不变
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	if text := humanize.IBytes(uint64(b)); mustParseBytes(text) == uint64(b) {
+		return json.Marshal(text)
+	}
+	return json.Marshal(int64(b))
+}
+
+func mustParseBytes(text string) uint64 {
+	size, _ := humanize.ParseBytes(text)
+	return size
+}
+
+// StringList 支持单个字符串或字符串数组
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case string:
+		*l = StringList{value}
+	case []interface{}:
+		list := make(StringList, 0, len(value))
+		for _, item := range value {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("无效的字符串列表: %s", string(data))
+			}
+			list = append(list, str)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("无效的字符串列表: %s", string(data))
+	}
+	return nil
+}
+
+type ResolveConfig struct {
+	DNS        StringList            `json:"dns"`         // 解析后端域名使用的DNS服务器，如8.8.8.8:53，未指定端口时使用53，DoT使用853；多个服务器时按顺序尝试
+	MinTTL     Duration              `json:"min_ttl"`     // 缓存解析结果的最短时间，默认5s
+	MaxTTL     Duration              `json:"max_ttl"`     // 缓存解析结果的最长时间，默认1h
+	TLS        bool                  `json:"tls"`         // 使用DNS-over-TLS查询
+	ServerName string                `json:"server_name"` // DoT的SNI和证书校验使用的域名，如dns.google，为空则按地址校验
+	CAFile     string                `json:"ca_file"`     // 校验DoT服务器证书使用的根证书文件（PEM），为空则使用系统根证书
+	Family     string                `json:"family"`      // 查询的地址类型：ipv4只查询A记录，ipv6只查询AAAA记录，auto同时查询并优先IPv6连接，默认ipv4
+	Hosts      map[string]StringList `json:"hosts"`       // 静态解析，域名到IP列表，优先于DNS查询和全局hosts
+}
+
+// 解析hosts配置，域名不区分大小写
+func parseStaticHosts(hosts map[string]StringList) (map[string][]net.IPAddr, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string][]net.IPAddr, len(hosts))
+	for name, ips := range hosts {
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("%s 未配置IP", name)
+		}
+		addrs := make([]net.IPAddr, 0, len(ips))
+		for _, ip := range ips {
+			parsedIP := net.ParseIP(ip)
+			if parsedIP == nil {
+				return nil, fmt.Errorf("%s 的IP无效: %s", name, ip)
+			}
+			addrs = append(addrs, net.IPAddr{IP: parsedIP})
+		}
+		parsed[strings.ToLower(strings.TrimSuffix(name, "."))] = addrs
+	}
+	return parsed, nil
+}
+
+// DoT使用的TLS配置
+func (c ResolveConfig) tlsConfig() (*tls.Config, error) {
+	return BackendTLSConfig{ServerName: c.ServerName, CAFile: c.CAFile}.clientConfig()
+}
+
+// 后端连接池大小，未设置的项使用默认值
+type PoolSizeConfig struct {
+	MaxIdleConns        int `json:"max_idle_conns"`          // 连接池的最大空闲连接数，默认100
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"` // 每个后端地址的最大空闲连接数，默认20
+	MaxConnsPerHost     int `json:"max_conns_per_host"`      // 每个后端地址的最大连接数（包括使用中的），默认100
+}
+
+// 与后端通信的超时设置，规则中未设置的项使用server中的设置
+type TimeoutConfig struct {
+	DialTimeout           Duration `json:"dial_timeout"`            // 建立连接的超时，默认30s
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"` // 发出请求后等待响应头的超时，默认0不限制
+	IdleConnTimeout       Duration `json:"idle_conn_timeout"`       // 空闲连接的保持时间，默认5m
+	RequestTimeout        Duration `json:"request_timeout"`         // 整个请求（包括读取响应体）的超时，默认600s
+}
+
+// 未设置的项使用defaults中的值
+func (t *TimeoutConfig) merge(defaults TimeoutConfig) {
+	if t.DialTimeout <= 0 {
+		t.DialTimeout = defaults.DialTimeout
+	}
+	if t.ResponseHeaderTimeout <= 0 {
+		t.ResponseHeaderTimeout = defaults.ResponseHeaderTimeout
+	}
+	if t.IdleConnTimeout <= 0 {
+		t.IdleConnTimeout = defaults.IdleConnTimeout
+	}
+	if t.RequestTimeout <= 0 {
+		t.RequestTimeout = defaults.RequestTimeout
+	}
+}
+
 type ServerConfig struct {
-	Port   int  `json:"port"`   // 监听端口
-	Public bool `json:"public"` // 是否公开访问
+	Port        int           `json:"port"`         // 监听端口
+	Public      bool          `json:"public"`       // 是否公开访问
+	EarlyData   bool          `json:"early_data"`   // 处理前端TLS终止代理转发的0-RTT早期数据请求，非安全方法返回425
+	DefaultHost string        `json:"default_host"` // 未携带Host的HTTP/1.0请求使用的转发规则
+	Timeouts    TimeoutConfig `json:"timeouts"`     // 转发规则默认的后端超时设置
+
+	TLS  *ServerTLSConfig `json:"tls"`  // 由代理终结TLS，为空则监听HTTP
+	ACME *ACMEConfig      `json:"acme"` // 通过ACME自动申请证书，不能与tls同时配置
+
+	TrustedProxies []string `json:"trusted_proxies"` // 受信任的前置代理（IP或CIDR），来自这些地址的请求从X-Forwarded-For中取客户端IP
+
+	trustedProxies []*net.IPNet
+}
+
+type ACMEConfig struct {
+	CacheDir      string   `json:"cache_dir"`      // 证书和账号密钥的缓存目录，默认autocert-cache
+	Email         string   `json:"email"`          // ACME账号邮箱，用于接收证书到期等通知
+	HTTPChallenge bool     `json:"http_challenge"` // 在80端口处理HTTP-01验证，并将其他请求重定向到https
+	Hosts         []string `json:"hosts"`          // 除transit_map中精确配置的域名外，允许申请证书的域名，如通配符规则下的具体子域名
+}
+
+type ServerTLSConfig struct {
+	CertFile string `json:"cert_file"` // 证书文件（PEM），可包含中间证书
+	KeyFile  string `json:"key_file"`  // 私钥文件（PEM）
+}
+
+type AdminConfig struct {
+	Port   int    `json:"port"`   // 管理接口监听端口
+	Public bool   `json:"public"` // 是否公开访问，默认只监听127.0.0.1
+	Token  string `json:"token"`  // 请求需携带Authorization: Bearer <token>，public时必须配置，为空则不认证
 }
 
 type LogConfig struct {
@@ -16,61 +219,1410 @@ type LogConfig struct {
 	File  string `json:"file"`
 }
 
+type RequiredHeader struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"` // Header值需匹配的正则表达式，为空则只要求存在
+
+	pattern *regexp.Regexp `json:"-"`
+}
+
 type HeadersConfig struct {
 	Set           map[string]string `json:"set"`
 	Extra         map[string]string `json:"extra"`
 	Remove        []string          `json:"remove"`
 	ForwardClient bool              `json:"forward_client"`
 
+	MaxHeaderSize  int    `json:"max_header_size"`  // 单个Header值的最大长度，0表示不限制
+	OversizeAction string `json:"oversize_action"`  // 超长Header的处理方式: drop(默认) 或 truncate
+	MaxHeaderCount int    `json:"max_header_count"` // 转发Header的最大数量，0表示不限制
+
+	MaxResponseHeaderCount int `json:"max_response_header_count"` // 后端响应Header的最大数量，超出时返回502，默认1000
+
+	ClientCert *ClientCertConfig `json:"client_cert"`      // 将已校验的客户端证书信息转发给后端，为空则不转发
+	Required   []RequiredHeader  `json:"required_headers"` // 转发前要求客户端必须携带的Header，不满足时返回400
+	GeoIP      *GeoIPConfig      `json:"geoip"`            // 按客户端IP注入X-Geo-*地理信息，为空则不注入
+
+	Forwarded bool `json:"forwarded"` // 追加X-Forwarded-For并设置X-Forwarded-Proto、X-Forwarded-Host和X-Real-IP
+
+	PreserveHost bool   `json:"preserve_host"` // 转发时使用客户端请求的Host
+	Host         string `json:"host"`          // 转发时使用的Host，为空则使用后端地址中的域名
+
 	removes map[string]struct{} `json:"-"`
 }
 
+type CacheConfig struct {
+	TTL      Duration `json:"ttl"`       // 后端未通过Cache-Control给出max-age时的默认缓存时间
+	MaxStale Duration `json:"max_stale"` // 后端失败时允许返回的过期缓存的最大过期时长
+
+	TTLHeader         string `json:"ttl_header"`          // 后端指定缓存时间的自定义Header，值为秒数或"30s"形式的时长
+	TTLHeaderFallback bool   `json:"ttl_header_fallback"` // 为true时仅在Cache-Control未给出max-age时使用ttl_header，否则ttl_header优先
+
+	LockTimeout       Duration `json:"lock_timeout"`        // 缓存过期时只由一个请求刷新，其他请求等待刷新的最长时间，0表示不合并
+	StaleWhileRefresh Duration `json:"stale_while_refresh"` // 刷新期间过期不超过该时长的缓存直接返回，不等待刷新
+}
+
+type CircuitBreakerConfig struct {
+	LatencyThreshold Duration `json:"latency_threshold"` // 窗口内p95耗时超过该值时熔断
+	Window           int      `json:"window"`            // 统计耗时的最近请求数，默认100
+	MinRequests      int      `json:"min_requests"`      // 窗口内请求数达到该值才进行判断，默认20
+	Cooldown         Duration `json:"cooldown"`          // 熔断持续时间，默认30s
+}
+
+type ClientCertConfig struct {
+	IncludeCert bool `json:"include_cert"` // 是否在X-Client-Cert中附带base64编码的完整证书
+}
+
+type GeoIPConfig struct {
+	Database    string   `json:"database"`     // MaxMind City或Country数据库路径，用于country和city
+	ASNDatabase string   `json:"asn_database"` // MaxMind ASN数据库路径，用于asn
+	Fields      []string `json:"fields"`       // 注入的字段: country、city、asn，默认注入已配置数据库支持的全部字段
+}
+
+type IdempotencyConfig struct {
+	Header  string   `json:"header"`  // 携带幂等令牌的Header，默认Idempotency-Key
+	Methods []string `json:"methods"` // 需要生成令牌的请求方法，默认POST、PATCH
+}
+
+type BandwidthConfig struct {
+	Rate   ByteSize `json:"rate"`   // 每秒允许写出的响应字节数
+	Shared bool     `json:"shared"` // 同一规则的所有请求共享带宽，否则每个请求单独限速
+}
+
+type RuleAuditConfig struct {
+	Fields      []string `json:"fields"`       // 记录的字段，默认不包含请求体和响应体
+	DedupBodies int      `json:"dedup_bodies"` // 记住最近出现过的请求体/响应体哈希数量，重复的内容只记录哈希，0表示不去重
+}
+
+type MultipartConfig struct {
+	RemoveFields []string          `json:"remove_fields"` // 删除的表单字段（包括文件字段）
+	AddFields    map[string]string `json:"add_fields"`    // 追加的表单字段，已存在的同名字段会被替换
+	MaxPartSize  ByteSize          `json:"max_part_size"` // 单个字段的最大字节数，超出返回413，0表示不限制
+}
+
+type RetryConfig struct {
+	Fallback    map[int]string `json:"fallback"`     // 后端返回指定状态码时，改由对应的备用后端重新处理请求
+	PreSend     int            `json:"pre_send"`     // 连接后端失败、请求尚未发出时的重试次数，不区分请求方法
+	MaxAttempts int            `json:"max_attempts"` // 幂等请求的最大尝试次数（包括第一次），默认1不重试
+	Backoff     Duration       `json:"backoff"`      // 第一次重试前的等待时间，之后每次翻倍，默认100ms
+	MaxBackoff  Duration       `json:"max_backoff"`  // 重试等待时间的上限，默认2s
+	RetryOn     []string       `json:"retry_on"`     // 触发重试的结果: error（转发失败）或状态码，默认error、502、503、504
+}
+
+type RangeCacheConfig struct {
+	TTL           Duration `json:"ttl"`             // 缓存时间
+	MaxObjectSize ByteSize `json:"max_object_size"` // 超过该大小的对象不缓存
+}
+
+type MinBodyRateConfig struct {
+	Rate  ByteSize `json:"rate"`  // 请求体最低平均上传速度，每秒字节数
+	Grace Duration `json:"grace"` // 开始计算速度前的宽限时间
+}
+
+type PayloadTimeoutConfig struct {
+	Base  Duration `json:"base"`   // 基础超时时间
+	PerMB Duration `json:"per_mb"` // 请求体每MB额外增加的超时时间
+	Max   Duration `json:"max"`    // 超时时间上限，请求体大小未知时使用该值，未设置则使用base
+}
+
+type BlueGreenConfig struct {
+	Blue    string   `json:"blue"`    // 蓝色后端地址
+	Green   string   `json:"green"`   // 绿色后端地址
+	Active  string   `json:"active"`  // 启动时使用的颜色，默认blue，运行时通过管理接口切换
+	Overlap Duration `json:"overlap"` // 切换后的过渡时长，期间旧颜色的流量占比线性递减
+}
+
+type SizeRoutingConfig struct {
+	Threshold   ByteSize `json:"threshold"`    // 请求体大小达到该值时使用large后端
+	Small       string   `json:"small"`        // 小请求的后端地址
+	Large       string   `json:"large"`        // 大请求的后端地址
+	UnknownSize string   `json:"unknown_size"` // 请求体大小未知时使用的后端: large(默认) 或 small
+}
+
+type LoadBalanceConfig struct {
+	Backends []string `json:"backends"` // 后端地址列表
+	Weights  []int    `json:"weights"`  // 与backends对应的权重，默认都为1，0表示不分配流量
+	Strategy string   `json:"strategy"` // 选择策略: round_robin(默认)、least_conn 或 random
+}
+
+type RateLimitConfig struct {
+	Rate      float64 `json:"rate"`       // 每秒允许的请求数
+	Burst     int     `json:"burst"`      // 允许的突发请求数，默认为rate向上取整
+	PerClient bool    `json:"per_client"` // 按客户端IP分别限流
+
+	Redis *RedisConfig `json:"redis"` // 令牌桶保存在Redis中，由所有实例共享，为空则每个实例单独限流
+
+	TierHeader    string                     `json:"tier_header"`    // 前置认证服务写入用户等级的Header，只信任来自server.trusted_proxies的请求
+	Tiers         map[string]*RateTierConfig `json:"tiers"`          // 按用户等级设置的限额和优先级，未列出的等级使用顶层的限额
+	MaxConcurrent int                        `json:"max_concurrent"` // 同时转发的请求上限，超出时按等级的priority排队，0表示不限制
+	QueueTimeout  Duration                   `json:"queue_timeout"`  // 排队的最长时间，超时返回503，默认5s
+}
+
+type RateTierConfig struct {
+	Rate     float64 `json:"rate"`     // 该等级每秒允许的请求数，默认为rate_limit.rate
+	Burst    int     `json:"burst"`    // 该等级允许的突发请求数，默认为rate向上取整
+	Priority int     `json:"priority"` // 达到max_concurrent时的排队优先级，数值大的先转发，默认0
+}
+
+type RedisConfig struct {
+	Addr      string   `json:"addr"`       // Redis地址，如 127.0.0.1:6379
+	Password  string   `json:"password"`   // 密码，为空则不认证
+	DB        int      `json:"db"`         // 数据库编号，默认0
+	KeyPrefix string   `json:"key_prefix"` // 键前缀，默认http-transit:ratelimit:
+	Timeout   Duration `json:"timeout"`    // 连接和单次请求的超时时间，默认100ms，超时时改用本地限流
+}
+
+type HealthCheckConfig struct {
+	Path               string   `json:"path"`                // 探测路径，默认/，返回2xx/3xx视为健康
+	Interval           Duration `json:"interval"`            // 探测间隔，默认10s
+	Timeout            Duration `json:"timeout"`             // 单次探测超时，默认2s
+	UnhealthyThreshold int      `json:"unhealthy_threshold"` // 连续失败多少次后停止转发，默认3
+	HealthyThreshold   int      `json:"healthy_threshold"`   // 连续成功多少次后恢复转发，默认2
+	Backup             string   `json:"backup"`              // 所有后端都不健康时使用的备用后端，为空则返回fallback_response，也未配置时仍转发给原后端
+	Drain              bool     `json:"drain"`               // 后端不健康时关闭连接池中到该后端的空闲连接
+}
+
+type PathRoute struct {
+	Prefix        string `json:"prefix"`         // 路径前缀，按路径段匹配，/api匹配/api和/api/x，不匹配/apix
+	BackendBase   string `json:"backend_base"`   // 匹配时使用的后端地址
+	BackendPrefix string `json:"backend_prefix"` // 匹配时转发添加的URL前缀，替代规则的backend_prefix
+	StripPrefix   bool   `json:"strip_prefix"`   // 转发时去掉匹配的前缀
+}
+
+type HeaderRoute struct {
+	Header      string `json:"header"`       // 匹配的请求头名称，与cookie二选一
+	Cookie      string `json:"cookie"`       // 匹配的Cookie名称
+	Value       string `json:"value"`        // 请求头或Cookie的值需与之相等，为空则只要求存在
+	BackendBase string `json:"backend_base"` // 匹配时使用的后端地址
+}
+
+type StaticDir struct {
+	Prefix string `json:"prefix"` // 路径前缀，按路径段匹配
+	Dir    string `json:"dir"`    // 本地目录，前缀之后的路径对应目录中的文件
+	Browse bool   `json:"browse"` // 目录中没有index.html时列出目录内容，默认返回404
+
+	handler http.Handler `json:"-"`
+}
+
+type QueryConfig struct {
+	Set    map[string]string `json:"set"`    // 覆盖的查询参数，删除请求中的同名参数后添加
+	Extra  map[string]string `json:"extra"`  // 请求中没有时添加的查询参数
+	Remove []string          `json:"remove"` // 删除的查询参数，以*结尾时按前缀匹配，如utm_*
+}
+
+type PathRewrite struct {
+	Match   string `json:"match"`   // 匹配请求路径的正则表达式，如 ^/v1/(.*)$
+	Replace string `json:"replace"` // 替换后的路径，可以用$1、${name}引用分组，如 /api/$1
+
+	pattern *regexp.Regexp `json:"-"`
+}
+
+type TraceSamplingConfig struct {
+	Exclude []string `json:"exclude"` // 不记录trace的路径正则，优先于include
+	Include []string `json:"include"` // 始终记录trace的路径正则
+	Rate    float64  `json:"rate"`    // 其余路径的采样率，0~1
+
+	exclude []*regexp.Regexp `json:"-"`
+	include []*regexp.Regexp `json:"-"`
+}
+
+type AccessLogConfig struct {
+	Format string `json:"format"` // common(默认) 或 combined
+	File   string `json:"file"`   // 访问日志文件，为空则写标准输出
+}
+
+type HTTP2Config struct {
+	MaxReadFrameSize           uint32   `json:"max_read_frame_size"`           // 允许后端发送的最大帧大小，16KB~16MB
+	MaxDecoderHeaderTableSize  uint32   `json:"max_decoder_header_table_size"` // 解码响应头的HPACK动态表大小上限
+	MaxEncoderHeaderTableSize  uint32   `json:"max_encoder_header_table_size"` // 编码请求头的HPACK动态表大小上限
+	MaxHeaderListSize          uint32   `json:"max_header_list_size"`          // 允许后端返回的响应头总大小
+	StrictMaxConcurrentStreams bool     `json:"strict_max_concurrent_streams"` // 达到后端的并发流上限时排队等待，而不是新建连接
+	ReadIdleTimeout            Duration `json:"read_idle_timeout"`             // 连接空闲多久后发送PING检查健康
+	PingTimeout                Duration `json:"ping_timeout"`                  // PING无响应时关闭连接的超时时间
+}
+
+type ScriptConfig struct {
+	File     string   `json:"file"`      // Starlark脚本文件路径
+	Timeout  Duration `json:"timeout"`   // 单次调用的最长执行时间，默认100ms
+	MaxSteps uint64   `json:"max_steps"` // 单次调用的最大执行步数，默认1000000
+
+	onRequest  starlark.Callable `json:"-"`
+	onResponse starlark.Callable `json:"-"`
+}
+
+type DNSBackoffConfig struct {
+	Failures int      `json:"failures"` // 连续解析失败多少次后暂停转发，默认3
+	Cooldown Duration `json:"cooldown"` // 暂停转发的时长，默认30s
+}
+
+type RequestIDBodyConfig struct {
+	Field  string `json:"field"`  // 写入请求ID的JSON字段，以"."分隔表示嵌套对象，如meta.request_id
+	Header string `json:"header"` // 携带请求ID的Header，客户端未携带时生成并转发给后端，默认X-Request-ID
+}
+
+type TranscodeConfig struct {
+	Backend string `json:"backend"` // 后端使用的格式: json 或 msgpack
+}
+
+type SamplingHeaderConfig struct {
+	Header string  `json:"header"` // 携带采样决定的Header，默认X-Sampled
+	Rate   float64 `json:"rate"`   // 采样率，0~1
+}
+
+type CDNHeadersConfig struct {
+	ETag         bool     `json:"etag"`          // 后端未返回ETag时按响应体哈希生成弱ETag
+	CacheControl string   `json:"cache_control"` // 后端未返回Cache-Control时使用的默认值
+	Vary         []string `json:"vary"`          // 追加到Vary中的Header
+}
+
+type SchemaDriftConfig struct {
+	Schema string  `json:"schema"` // JSON Schema文件路径
+	Rate   float64 `json:"rate"`   // 校验的响应比例，0~1
+
+	schema *jsonschema.Schema `json:"-"`
+	drifts atomic.Int64       `json:"-"` // 累计发现的不符合schema的响应数
+}
+
+type ConnReuseConfig struct {
+	MinRatio float64 `json:"min_ratio"` // 连接复用率下限，0~1
+	Window   int     `json:"window"`    // 每多少个请求计算一次复用率，默认100
+}
+
+type FingerprintConfig struct {
+	TLSCert      bool `json:"tls_cert"`      // 跟踪后端TLS叶子证书的SHA-256
+	ServerHeader bool `json:"server_header"` // 跟踪Server响应头
+	Threshold    int  `json:"threshold"`     // 新指纹连续出现多少次后认定变化并告警，默认1
+}
+
+type FallbackResponseConfig struct {
+	Status      int    `json:"status"`       // 状态码，默认503
+	ContentType string `json:"content_type"` // 默认按file扩展名推断，否则为text/plain
+	Body        string `json:"body"`         // 响应体
+	File        string `json:"file"`         // 从文件读取响应体，优先于body
+	On5xx       bool   `json:"on_5xx"`       // 后端返回5xx时同样返回静态响应
+
+	body []byte `json:"-"`
+}
+
+type RespondConfig struct {
+	Status      int               `json:"status"`       // 状态码，默认200
+	Headers     map[string]string `json:"headers"`      // 响应头
+	ContentType string            `json:"content_type"` // 默认按file扩展名推断，否则为text/plain
+	Body        string            `json:"body"`         // 响应体
+	File        string            `json:"file"`         // 从文件读取响应体，优先于body
+
+	body []byte `json:"-"`
+}
+
+type MirrorConfig struct {
+	BackendBase string   `json:"backend_base"` // 接收请求副本的后端地址
+	Rate        float64  `json:"rate"`         // 复制的请求比例，0~1，默认1
+	Timeout     Duration `json:"timeout"`      // 副本请求的超时时间，默认5s
+	MaxInflight int      `json:"max_inflight"` // 同时进行的副本请求上限，超出时丢弃，默认100
+	MaxRate     float64  `json:"max_rate"`     // 每秒最多复制的请求数，超出时丢弃，0则不限制
+
+	slots   chan struct{} `json:"-"`
+	mu      sync.Mutex    `json:"-"`
+	bucket  tokenBucket   `json:"-"` // max_rate的令牌桶，容量为1秒的令牌数
+	dropped atomic.Int64  `json:"-"` // 因max_rate或max_inflight丢弃的副本数
+}
+
+type WebSocketConfig struct {
+	Subprotocols []string `json:"subprotocols"` // 客户端须请求其中至少一个子协议，否则返回400，为空则不要求；Sec-WebSocket-Protocol总是原样转发
+}
+
+type DiffConfig struct {
+	BackendBase   string   `json:"backend_base"`   // 对比的后端地址，其响应只用于对比，不返回给客户端
+	Methods       []string `json:"methods"`        // 需要对比的请求方法，默认GET、HEAD
+	IgnoreHeaders []string `json:"ignore_headers"` // 不对比的响应头，Date、Content-Length和逐跳Header始终忽略
+	IgnoreFields  []string `json:"ignore_fields"`  // 不对比的JSON字段路径，如data.updated_at，数组元素用[]表示
+	MaxDiffs      int      `json:"max_diffs"`      // 最多记录的差异条数，默认20
+	Timeout       Duration `json:"timeout"`        // 对比请求的超时时间，默认5s
+}
+
+type MaintenanceConfig struct {
+	Enabled     bool   `json:"enabled"`      // 是否处于维护模式，可通过管理接口切换
+	Status      int    `json:"status"`       // 状态码，默认503
+	RetryAfter  int    `json:"retry_after"`  // Retry-After响应头的秒数，0则不设置
+	ContentType string `json:"content_type"` // 默认按file扩展名推断，否则为text/plain
+	Body        string `json:"body"`         // 响应体，默认为"服务维护中"
+	File        string `json:"file"`         // 从文件读取响应体，优先于body
+
+	body []byte `json:"-"`
+}
+
+type RedirectToConfig struct {
+	URL    string `json:"url"`    // 重定向地址模板，可使用{scheme}、{host}、{path}、{query}、{request_uri}
+	Status int    `json:"status"` // 301、302、303、307或308，默认302
+}
+
+type BackendTLSConfig struct {
+	CAFile             string `json:"ca_file"`              // 校验后端证书使用的根证书文件（PEM），为空则使用系统根证书
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // 不校验后端证书，仅用于测试
+	MinVersion         string `json:"min_version"`          // 最低TLS版本: 1.0、1.1、1.2 或 1.3
+	ServerName         string `json:"server_name"`          // SNI和证书校验使用的域名，为空则使用后端地址中的域名
+	CertFile           string `json:"cert_file"`            // 双向TLS的客户端证书文件（PEM）
+	KeyFile            string `json:"key_file"`             // 双向TLS的客户端私钥文件（PEM）
+}
+
+type RedirectConfig struct {
+	BlockDowngrade bool `json:"block_downgrade"` // 拒绝从https重定向到http，返回502
+}
+
 type TransitRule struct {
-	BackendBase   string        `json:"backend_base"`
-	BackendPrefix string        `json:"backend_prefix"`
-	Headers       HeadersConfig `json:"headers"`
+	BackendBase    string            `json:"backend_base"`
+	BackendPrefix  string            `json:"backend_prefix"`
+	Routes         []PathRoute       `json:"routes"`          // 按路径前缀选择后端，最长前缀优先，未匹配时使用backend_base
+	Rewrites       []PathRewrite     `json:"rewrites"`        // 按正则改写转发的路径，使用第一个匹配的规则，改写后再添加backend_prefix
+	StripPrefix    string            `json:"strip_prefix"`    // 转发前去掉的路径前缀，如/svc-a，按路径段匹配，不匹配的路径原样转发
+	AllowedMethods []string          `json:"allowed_methods"` // 允许的请求方法，其他方法返回405，为空则不限制
+	MethodRoutes   map[string]string `json:"method_routes"`   // 按请求方法选择后端，如{"GET": "http://replica:8080"}，未列出的方法使用backend_base
+	HeaderRoutes   []HeaderRoute     `json:"header_routes"`   // 按请求头或Cookie选择后端，按顺序使用第一个匹配的，优先于routes和method_routes
+	RedirectTo     *RedirectToConfig `json:"redirect_to"`     // 直接返回重定向而不转发，设置后忽略后端配置
+	Respond        *RespondConfig    `json:"respond"`         // 直接返回静态响应而不转发，设置后忽略后端配置
+	Static         []StaticDir       `json:"static"`          // 按路径前缀直接返回本地目录中的文件，优先于转发
+	QueryDedup     string            `json:"query_dedup"`     // 重复查询参数的处理方式: all(默认，全部保留)、first 或 last
+	Query          *QueryConfig      `json:"query"`           // 添加、覆盖或删除转发的查询参数，为空则不修改
+	Headers        HeadersConfig     `json:"headers"`
+	LogTLS         bool              `json:"log_tls"` // debug日志中记录与后端的TLS版本、加密套件和会话复用情况
+	Cache          *CacheConfig      `json:"cache"`   // GET响应缓存，为空则不缓存
+
+	ForwardTrailers  bool                    `json:"forward_trailers"`   // 将后端响应的Trailer（如响应体校验和）转发给客户端
+	Stream           bool                    `json:"stream"`             // 流式转发请求体和响应体，不在内存中缓冲，依赖完整body的功能不可用
+	StreamOnSSE      bool                    `json:"stream_on_sse"`      // 只对携带Accept: text/event-stream的请求流式转发，限制与stream相同
+	WebSocket        *WebSocketConfig        `json:"websocket"`          // 转发WebSocket升级请求并双向转发数据，为空则按普通请求转发
+	DecompressedSize bool                    `json:"decompressed_size"`  // 同时记录gzip响应的传输大小和解压后大小
+	CircuitBreaker   *CircuitBreakerConfig   `json:"circuit_breaker"`    // 基于耗时的熔断，为空则不熔断
+	RateLimit        *RateLimitConfig        `json:"rate_limit"`         // 请求频率限制，超出时返回429，为空则不限制
+	FallbackResponse *FallbackResponseConfig `json:"fallback_response"`  // 后端无法处理请求时返回的静态响应，为空则返回错误
+	Maintenance      *MaintenanceConfig      `json:"maintenance"`        // 维护模式，开启时返回静态页面而不转发
+	Mirror           *MirrorConfig           `json:"mirror"`             // 将请求异步复制到另一个后端，丢弃其响应，为空则不复制
+	Diff             *DiffConfig             `json:"diff"`               // 同时请求对比后端，返回主后端的响应，在trace中记录两者的差异
+	Idempotency      *IdempotencyConfig      `json:"idempotency"`        // 为写请求生成稳定的幂等令牌，需后端配合去重
+	BandwidthLimit   *BandwidthConfig        `json:"bandwidth_limit"`    // 响应带宽限制，为空则不限速
+	Audit            *RuleAuditConfig        `json:"audit"`              // 将请求审计记录写入全局audit目标，为空则不记录
+	Transcode        *TranscodeConfig        `json:"transcode"`          // 在JSON和MessagePack之间转换请求体和响应体，为空则不转换
+	Multipart        *MultipartConfig        `json:"multipart"`          // multipart/form-data请求体转换，为空则原样转发
+	BodyDefaults     map[string]interface{}  `json:"body_defaults"`      // JSON请求体缺失字段时补充的默认值，嵌套对象逐层合并
+	SniffContentType bool                    `json:"sniff_content_type"` // 检查请求体内容与声明的Content-Type是否相符，明显不符时返回415
+	MaxJSONDepth     int                     `json:"max_json_depth"`     // JSON请求体的最大嵌套深度，超过时返回400，0表示不限制
+	Retry            *RetryConfig            `json:"retry"`              // 重试策略，为空则不重试
+	PayloadTimeout   *PayloadTimeoutConfig   `json:"payload_timeout"`    // 按请求体大小计算的超时时间，为空则只使用客户端超时
+	MinBodyRate      *MinBodyRateConfig      `json:"min_body_rate"`      // 请求体上传速度过慢时中止并返回408，为空则不限制
+	BlueGreen        *BlueGreenConfig        `json:"blue_green"`         // 蓝绿发布，设置后忽略backend_base
+	SizeRouting      *SizeRoutingConfig      `json:"size_routing"`       // 按请求体大小选择后端，设置后忽略backend_base
+	LoadBalance      *LoadBalanceConfig      `json:"load_balance"`       // 在多个后端之间负载均衡，设置后忽略backend_base
+	HealthCheck      *HealthCheckConfig      `json:"health_check"`       // 定期探测backend_base或load_balance中的后端，不健康时停止转发，为空则不探测
+	ServeRanges      bool                    `json:"serve_ranges"`       // 向后端请求完整响应体，由代理按客户端Range返回206
+	RangeCache       *RangeCacheConfig       `json:"range_cache"`        // 按字节范围缓存后端响应，只向后端请求缺失的部分，为空则不缓存
+	AcceptRanges     []string                `json:"accept_ranges"`      // 后端未声明Accept-Ranges时，为这些类型的响应补充Accept-Ranges: bytes
+	DNSBackoff       *DNSBackoffConfig       `json:"dns_backoff"`        // 后端域名连续解析失败时直接返回502，为空则每次都解析
+	Redirect         *RedirectConfig         `json:"redirect"`           // 后端重定向策略，为空则跟随所有重定向
+	LogBodyOnError   bool                    `json:"log_body_on_error"`  // 后端返回4xx/5xx或转发失败时在warn日志中记录请求体
+	SamplingHeader   *SamplingHeaderConfig   `json:"sampling_header"`    // 做出采样决定并通过Header告知后端，为空则不设置
+	TraceSampling    *TraceSamplingConfig    `json:"trace_sampling"`     // 按路径决定是否在debug日志中记录trace，为空则全部记录
+	AccessLog        *AccessLogConfig        `json:"access_log"`         // 以Apache Common/Combined格式记录访问日志，为空则不记录
+	Script           *ScriptConfig           `json:"script"`             // 用Starlark脚本修改请求和响应，为空则不执行
+	TLS              *BackendTLSConfig       `json:"tls"`                // 连接https后端的TLS设置，同一后端域名的规则共享连接池
+	HTTP2            *HTTP2Config            `json:"http2"`              // https后端的HTTP/2传输参数，同一后端域名的规则共享连接池
+	MaxConnsPerIP    int                     `json:"max_conns_per_ip"`   // 后端域名解析出的每个IP的最大连接数，同一后端域名的规则共享连接池，0表示不限制
+	Timeouts         *TimeoutConfig          `json:"timeouts"`           // 后端超时设置，同一后端域名的规则共享连接池，未设置的项使用server.timeouts
+	Pool             *PoolSizeConfig         `json:"pool"`               // 后端连接池大小，同一后端域名的规则共享连接池，为空则使用默认值
+	Resolve          *ResolveConfig          `json:"resolve"`            // 使用指定的DNS服务器解析后端域名并按TTL缓存，同一后端域名的规则共享连接池，为空则使用系统解析
+	ConnReuse        *ConnReuseConfig        `json:"conn_reuse"`         // 统计后端连接复用率，低于下限时记录warn日志，为空则不统计
+	Fingerprint      *FingerprintConfig      `json:"fingerprint"`        // 跟踪后端证书和Server头组成的指纹，变化时记录warn日志，为空则不跟踪
+	ReloadWarmup     int                     `json:"reload_warmup"`      // 配置重新加载后为新增或变更的后端预先建立的连接数，0表示不预热
+	CDNHeaders       *CDNHeadersConfig       `json:"cdn_headers"`        // 为GET响应补充ETag、Cache-Control和Vary，为空则不补充
+	RequestIDBody    *RequestIDBodyConfig    `json:"request_id_body"`    // 将请求ID写入JSON响应体，为空则不写入
+	RewriteLocation  bool                    `json:"rewrite_location"`   // 将后端响应Location中的后端地址改写为客户端访问的地址
+	RewriteCookies   bool                    `json:"rewrite_cookies"`    // 将后端Set-Cookie的Domain改为客户端访问的域名，Path按backend_prefix还原
+
+	SchemaDrift               *SchemaDriftConfig `json:"schema_drift"`                 // 抽样按JSON Schema校验后端响应，不符合时记录日志但不拦截，为空则不校验
+	ExpectedContentType       string             `json:"expected_content_type"`        // 后端响应应有的媒体类型，如application/json或text/*，为空则不校验
+	ContentTypeMismatchStatus int                `json:"content_type_mismatch_status"` // 响应类型不符合预期时返回的状态码，默认502
+
+	stripPrefix string                  // 本次请求转发前去掉的路径前缀，来自规则或匹配的路由的strip_prefix
+	hosts       map[string][]net.IPAddr // 合并全局hosts和resolve.hosts后的静态解析
+}
+
+// 按请求方法选择后端，在matchRoute之前执行，匹配的路由优先于method_routes
+func (r TransitRule) matchMethod(method string) TransitRule {
+	if backend, ok := r.MethodRoutes[method]; ok {
+		r.BackendBase = backend
+		r.LoadBalance = nil
+	}
+	return r
+}
+
+// 是否允许该请求方法
+func (r TransitRule) methodAllowed(method string) bool {
+	if len(r.AllowedMethods) == 0 {
+		return true
+	}
+	for _, allowed := range r.AllowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// 按请求头或Cookie选择后端，在matchRoute之后执行，只替换后端地址，backend_prefix和strip_prefix沿用路由的设置
+func (r TransitRule) matchHeaders(req *http.Request) TransitRule {
+	for _, route := range r.HeaderRoutes {
+		var value string
+		var ok bool
+		if route.Header != "" {
+			values := req.Header.Values(route.Header)
+			if ok = len(values) > 0; ok {
+				value = values[0]
+			}
+		} else if cookie, err := req.Cookie(route.Cookie); err == nil {
+			value, ok = cookie.Value, true
+		}
+		if ok && (route.Value == "" || route.Value == value) {
+			r.BackendBase = route.BackendBase
+			r.LoadBalance = nil
+			break
+		}
+	}
+	return r
+}
+
+// 按最长前缀匹配路径，匹配时返回使用该路由后端的规则；路由和规则的前缀都按客户端请求的原始路径匹配
+func (r TransitRule) matchRoute(path string) TransitRule {
+	if r.StripPrefix != "" && pathHasPrefix(path, r.StripPrefix) {
+		r.stripPrefix = r.StripPrefix
+	}
+	var matched *PathRoute
+	for i, route := range r.Routes {
+		if pathHasPrefix(path, route.Prefix) && (matched == nil || len(route.Prefix) > len(matched.Prefix)) {
+			matched = &r.Routes[i]
+		}
+	}
+	if matched != nil {
+		r.BackendBase, r.BackendPrefix = matched.BackendBase, matched.BackendPrefix
+		r.LoadBalance = nil
+		if matched.StripPrefix {
+			r.stripPrefix = matched.Prefix
+		}
+	}
+	return r
+}
+
+func pathHasPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// 规则涉及的所有后端地址，用于初始化连接池
+func (r TransitRule) Backends() []string {
+	backends := []string{r.BackendBase}
+	if r.BlueGreen != nil {
+		backends = []string{r.BlueGreen.Blue, r.BlueGreen.Green}
+	}
+	if r.SizeRouting != nil {
+		backends = []string{r.SizeRouting.Small, r.SizeRouting.Large}
+	}
+	if r.LoadBalance != nil {
+		backends = append([]string{}, r.LoadBalance.Backends...)
+	}
+	for _, route := range r.Routes {
+		backends = append(backends, route.BackendBase)
+	}
+	for _, route := range r.HeaderRoutes {
+		backends = append(backends, route.BackendBase)
+	}
+	methods := make([]string, 0, len(r.MethodRoutes))
+	for method := range r.MethodRoutes {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		backends = append(backends, r.MethodRoutes[method])
+	}
+	if r.HealthCheck != nil && r.HealthCheck.Backup != "" {
+		backends = append(backends, r.HealthCheck.Backup)
+	}
+	if r.Mirror != nil {
+		backends = append(backends, r.Mirror.BackendBase)
+	}
+	if r.Diff != nil {
+		backends = append(backends, r.Diff.BackendBase)
+	}
+	if r.Retry != nil {
+		for _, fallback := range r.Retry.Fallback {
+			backends = append(backends, fallback)
+		}
+	}
+	return backends
+}
+
+type KafkaAuditConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+}
+
+type AuditConfig struct {
+	Kafka      *KafkaAuditConfig `json:"kafka"`       // 写入Kafka
+	BufferSize int               `json:"buffer_size"` // 异步写入的缓冲记录数，默认1000，缓冲区满时丢弃
+}
+
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`     // OTLP/HTTP接口地址，如 http://localhost:4318/v1/traces
+	ServiceName string            `json:"service_name"` // 上报的service.name，默认http-transit
+	Headers     map[string]string `json:"headers"`      // 导出请求附加的Header，如认证信息
+	Rate        float64           `json:"rate"`         // 上游未做出采样决定时的采样率，0~1
+	BufferSize  int               `json:"buffer_size"`  // 异步导出的缓冲span数，默认1000，缓冲区满时丢弃
+	Timeout     Duration          `json:"timeout"`      // 单次导出的超时时间，默认10s
 }
 
 type Config struct {
 	Server     ServerConfig           `json:"server"`
+	Admin      *AdminConfig           `json:"admin"` // 管理接口，为空则不开启
 	Log        LogConfig              `json:"log"`
+	Audit      *AuditConfig           `json:"audit"`
+	Tracing    *TracingConfig         `json:"tracing"`       // 导出OpenTelemetry trace，为空则不导出
+	Remote     *RemoteConfig          `json:"remote_config"` // 从http(s)地址加载配置时的拉取设置
+	Hosts      map[string]StringList  `json:"hosts"`         // 全局静态解析，域名到IP列表，所有规则的后端域名优先使用
 	TransitMap map[string]TransitRule `json:"transit_map"`
+
+	wildcards []hostPattern // transit_map中*.开头的规则
+	regexes   []hostPattern // transit_map中~开头的规则
+	raw       []byte        // 解析前的原始内容，管理接口在此基础上修改转发规则
+}
+
+type RemoteConfig struct {
+	PollInterval Duration `json:"poll_interval"` // 定期拉取远程配置的间隔，0表示不拉取
+	Timeout      Duration `json:"timeout"`       // 拉取远程配置的超时时间，默认10s
 }
 
 func LoadConfig(filename string) (*Config, error) {
+	if isRemoteConfig(filename) {
+		return NewRemoteConfigWatcher(filename).Load()
+	}
+
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	return ParseConfig(data)
+}
 
+// 解析并校验配置内容
+func ParseConfig(data []byte) (*Config, error) {
 	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
+	err := json.Unmarshal(data, &config)
+	if err != nil {
 		return nil, err
 	}
+	config.raw = data
 
 	if config.Server.Port == 0 {
 		config.Server.Port = 8080
 	}
 
-	// 应用日志配置
-	if config.Log.Level != "" || config.Log.File != "" {
-		level, file := SetLogger(config.Log.Level, config.Log.File)
-		if file == "" {
-			log.Infof("日志级别设置为: %s", level)
-		} else {
-			log.Infof("日志级别设置为: %s, 日志文件设置为: %s", level, file)
+	config.Server.Timeouts.merge(TimeoutConfig{
+		DialTimeout:     Duration(30 * time.Second),
+		IdleConnTimeout: Duration(5 * time.Minute),
+		RequestTimeout:  Duration(600 * time.Second),
+	})
+
+	if t := config.Server.TLS; t != nil && (t.CertFile == "" || t.KeyFile == "") {
+		return nil, fmt.Errorf("server.tls需配置cert_file和key_file")
+	}
+
+	if acme := config.Server.ACME; acme != nil {
+		if config.Server.TLS != nil {
+			return nil, fmt.Errorf("server.tls和server.acme不能同时配置")
+		}
+		if acme.CacheDir == "" {
+			acme.CacheDir = "autocert-cache"
+		}
+		for i, host := range acme.Hosts {
+			if host == "" || isHostPattern(host) {
+				return nil, fmt.Errorf("server.acme.hosts只能配置具体的域名: %q", host)
+			}
+			acme.Hosts[i] = strings.ToLower(strings.TrimSuffix(host, "."))
+		}
+	}
+
+	if admin := config.Admin; admin != nil && admin.Public && admin.Token == "" {
+		return nil, fmt.Errorf("admin.public需配置admin.token，公开的管理接口不能没有认证")
+	}
+
+	if config.Server.trustedProxies, err = parseTrustedProxies(config.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("server.trusted_proxies: %v", err)
+	}
+
+	if host := config.Server.DefaultHost; host != "" {
+		if _, ok := config.TransitMap[host]; !ok {
+			return nil, fmt.Errorf("server.default_host %s 未配置转发规则", host)
 		}
 	}
 
+	if remote := config.Remote; remote != nil && remote.Timeout <= 0 {
+		remote.Timeout = Duration(10 * time.Second)
+	}
+
+	if audit := config.Audit; audit != nil {
+		if audit.Kafka == nil {
+			return nil, fmt.Errorf("audit未配置写入目标")
+		}
+		if len(audit.Kafka.Brokers) == 0 || audit.Kafka.Topic == "" {
+			return nil, fmt.Errorf("audit.kafka需配置brokers和topic")
+		}
+		if audit.BufferSize <= 0 {
+			audit.BufferSize = 1000
+		}
+	}
+
+	if tracing := config.Tracing; tracing != nil {
+		if tracing.Endpoint == "" {
+			return nil, fmt.Errorf("tracing未配置endpoint")
+		}
+		if tracing.Rate <= 0 || tracing.Rate > 1 {
+			return nil, fmt.Errorf("tracing.rate必须在0~1之间")
+		}
+		if tracing.ServiceName == "" {
+			tracing.ServiceName = "http-transit"
+		}
+		if tracing.BufferSize <= 0 {
+			tracing.BufferSize = 1000
+		}
+		if tracing.Timeout <= 0 {
+			tracing.Timeout = Duration(10 * time.Second)
+		}
+	}
+
+	var globalHosts map[string][]net.IPAddr
+	if globalHosts, err = parseStaticHosts(config.Hosts); err != nil {
+		return nil, fmt.Errorf("hosts: %v", err)
+	}
+
+	for host, rule := range config.TransitMap {
+		if rule.Timeouts == nil {
+			rule.Timeouts = &TimeoutConfig{}
+		}
+		rule.Timeouts.merge(config.Server.Timeouts)
+
+		if rule.Headers.PreserveHost && rule.Headers.Host != "" {
+			return nil, fmt.Errorf("转发规则 %s: headers.preserve_host和headers.host不能同时配置", host)
+		}
+
+		if rule.Headers.MaxResponseHeaderCount <= 0 {
+			rule.Headers.MaxResponseHeaderCount = 1000
+		}
+
+		switch rule.Headers.OversizeAction {
+		case "", "drop", "truncate":
+		default:
+			return nil, fmt.Errorf("转发规则 %s: 无效的oversize_action: %s", host, rule.Headers.OversizeAction)
+		}
+
+		if al := rule.AccessLog; al != nil {
+			switch al.Format {
+			case "":
+				al.Format = "common"
+			case "common", "combined":
+			default:
+				return nil, fmt.Errorf("转发规则 %s: 无效的access_log.format: %s", host, al.Format)
+			}
+		}
+
+		switch rule.QueryDedup {
+		case "", "all", "first", "last":
+		default:
+			return nil, fmt.Errorf("转发规则 %s: 无效的query_dedup: %s", host, rule.QueryDedup)
+		}
+
+		for i, required := range rule.Headers.Required {
+			if required.Name == "" {
+				return nil, fmt.Errorf("转发规则 %s: required_headers缺少name", host)
+			}
+			if required.Pattern != "" {
+				pattern, err := regexp.Compile(required.Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("转发规则 %s: required_headers %s 的正则表达式无效: %v", host, required.Name, err)
+				}
+				rule.Headers.Required[i].pattern = pattern
+			}
+		}
+
+		if geo := rule.Headers.GeoIP; geo != nil {
+			if len(geo.Fields) == 0 {
+				if geo.Database != "" {
+					geo.Fields = append(geo.Fields, "country", "city")
+				}
+				if geo.ASNDatabase != "" {
+					geo.Fields = append(geo.Fields, "asn")
+				}
+			}
+			for _, field := range geo.Fields {
+				if _, ok := geoFields[field]; !ok {
+					return nil, fmt.Errorf("转发规则 %s: 无效的geoip字段: %s", host, field)
+				}
+			}
+		}
+
+		if cb := rule.CircuitBreaker; cb != nil {
+			if cb.LatencyThreshold <= 0 {
+				return nil, fmt.Errorf("转发规则 %s: circuit_breaker.latency_threshold必须大于0", host)
+			}
+			if cb.Window <= 0 {
+				cb.Window = 100
+			}
+			if cb.MinRequests <= 0 || cb.MinRequests > cb.Window {
+				cb.MinRequests = min(20, cb.Window)
+			}
+			if cb.Cooldown <= 0 {
+				cb.Cooldown = Duration(30 * time.Second)
+			}
+		}
+
+		if rl := rule.RateLimit; rl != nil {
+			if rl.Rate <= 0 {
+				return nil, fmt.Errorf("转发规则 %s: rate_limit.rate必须大于0", host)
+			}
+			if rl.Burst <= 0 {
+				rl.Burst = int(math.Ceil(rl.Rate))
+			}
+			if len(rl.Tiers) > 0 && rl.TierHeader == "" {
+				return nil, fmt.Errorf("转发规则 %s: rate_limit.tiers需配置tier_header", host)
+			}
+			if rl.TierHeader != "" && len(config.Server.trustedProxies) == 0 {
+				return nil, fmt.Errorf("转发规则 %s: rate_limit.tier_header需配置server.trusted_proxies", host)
+			}
+			for name, tier := range rl.Tiers {
+				if tier == nil {
+					tier = &RateTierConfig{}
+					rl.Tiers[name] = tier
+				}
+				if tier.Rate < 0 {
+					return nil, fmt.Errorf("转发规则 %s: rate_limit.tiers.%s.rate不能为负数", host, name)
+				}
+				if tier.Rate == 0 {
+					tier.Rate = rl.Rate
+				}
+				if tier.Burst <= 0 {
+					tier.Burst = int(math.Ceil(tier.Rate))
+				}
+			}
+			if rl.MaxConcurrent < 0 {
+				return nil, fmt.Errorf("转发规则 %s: rate_limit.max_concurrent不能为负数", host)
+			}
+			if rl.QueueTimeout <= 0 {
+				rl.QueueTimeout = Duration(5 * time.Second)
+			}
+			if redis := rl.Redis; redis != nil {
+				if redis.Addr == "" {
+					return nil, fmt.Errorf("转发规则 %s: rate_limit.redis需配置addr", host)
+				}
+				if redis.KeyPrefix == "" {
+					redis.KeyPrefix = "http-transit:ratelimit:"
+				}
+				if redis.Timeout <= 0 {
+					redis.Timeout = Duration(100 * time.Millisecond)
+				}
+			}
+		}
+
+		if bw := rule.BandwidthLimit; bw != nil && bw.Rate <= 0 {
+			return nil, fmt.Errorf("转发规则 %s: bandwidth_limit.rate必须大于0", host)
+		}
+
+		if audit := rule.Audit; audit != nil {
+			if config.Audit == nil {
+				return nil, fmt.Errorf("转发规则 %s: 开启了audit但未配置全局audit目标", host)
+			}
+			if len(audit.Fields) == 0 {
+				audit.Fields = defaultAuditFields
+			}
+			if audit.DedupBodies < 0 {
+				return nil, fmt.Errorf("转发规则 %s: audit.dedup_bodies不能小于0", host)
+			}
+			for _, field := range audit.Fields {
+				if _, ok := auditFields[field]; !ok {
+					return nil, fmt.Errorf("转发规则 %s: 无效的audit字段: %s", host, field)
+				}
+			}
+		}
+
+		if bg := rule.BlueGreen; bg != nil {
+			if bg.Blue == "" || bg.Green == "" {
+				return nil, fmt.Errorf("转发规则 %s: blue_green需配置blue和green", host)
+			}
+			if bg.Active == "" {
+				bg.Active = "blue"
+			}
+			if bg.Active != "blue" && bg.Active != "green" {
+				return nil, fmt.Errorf("转发规则 %s: 无效的blue_green.active: %s", host, bg.Active)
+			}
+		}
+
+		if sc := rule.Script; sc != nil {
+			if sc.Timeout <= 0 {
+				sc.Timeout = Duration(100 * time.Millisecond)
+			}
+			if sc.MaxSteps == 0 {
+				sc.MaxSteps = 1000000
+			}
+			if err := sc.load(); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: 加载脚本失败: %v", host, err)
+			}
+		}
+
+		if fr := rule.FallbackResponse; fr != nil {
+			if fr.Status != 0 && (fr.Status < 200 || fr.Status > 599) {
+				return nil, fmt.Errorf("转发规则 %s: 无效的fallback_response.status: %d", host, fr.Status)
+			}
+			if err := fr.load(); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: 读取fallback_response.file失败: %v", host, err)
+			}
+		}
+
+		if m := rule.Mirror; m != nil {
+			if m.BackendBase == "" {
+				return nil, fmt.Errorf("转发规则 %s: mirror需配置backend_base", host)
+			}
+			if m.Rate < 0 || m.Rate > 1 {
+				return nil, fmt.Errorf("转发规则 %s: mirror.rate需在0~1之间", host)
+			}
+			if m.Rate == 0 {
+				m.Rate = 1
+			}
+			if m.Timeout <= 0 {
+				m.Timeout = Duration(5 * time.Second)
+			}
+			if m.MaxRate < 0 {
+				return nil, fmt.Errorf("转发规则 %s: mirror.max_rate不能为负数", host)
+			}
+			if m.MaxInflight <= 0 {
+				m.MaxInflight = 100
+			}
+			m.slots = make(chan struct{}, m.MaxInflight)
+		}
+
+		if ws := rule.WebSocket; ws != nil {
+			for _, protocol := range ws.Subprotocols {
+				if protocol == "" || strings.ContainsAny(protocol, ", ") {
+					return nil, fmt.Errorf("转发规则 %s: websocket.subprotocols包含无效的子协议: %q", host, protocol)
+				}
+			}
+		}
+
+		if d := rule.Diff; d != nil {
+			if d.BackendBase == "" {
+				return nil, fmt.Errorf("转发规则 %s: diff需配置backend_base", host)
+			}
+			if len(d.Methods) == 0 {
+				d.Methods = []string{http.MethodGet, http.MethodHead}
+			}
+			for i, method := range d.Methods {
+				d.Methods[i] = strings.ToUpper(method)
+			}
+			if d.MaxDiffs <= 0 {
+				d.MaxDiffs = 20
+			}
+			if d.Timeout <= 0 {
+				d.Timeout = Duration(5 * time.Second)
+			}
+		}
+
+		if m := rule.Maintenance; m != nil {
+			if m.Status != 0 && (m.Status < 200 || m.Status > 599) {
+				return nil, fmt.Errorf("转发规则 %s: 无效的maintenance.status: %d", host, m.Status)
+			}
+			if m.RetryAfter < 0 {
+				return nil, fmt.Errorf("转发规则 %s: maintenance.retry_after不能为负数", host)
+			}
+			if err := m.load(); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: 读取maintenance.file失败: %v", host, err)
+			}
+		}
+
+		if sd := rule.SchemaDrift; sd != nil {
+			if sd.Rate <= 0 || sd.Rate > 1 {
+				return nil, fmt.Errorf("转发规则 %s: schema_drift.rate必须在0~1之间", host)
+			}
+			if err := sd.load(); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: 加载schema失败: %v", host, err)
+			}
+		}
+
+		if db := rule.DNSBackoff; db != nil {
+			if db.Failures <= 0 {
+				db.Failures = 3
+			}
+			if db.Cooldown <= 0 {
+				db.Cooldown = Duration(30 * time.Second)
+			}
+		}
+
+		if t := rule.TLS; t != nil {
+			if _, err := t.clientConfig(); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: tls.%v", host, err)
+			}
+		}
+
+		if h2 := rule.HTTP2; h2 != nil {
+			if err := h2.validate(); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: http2.%v", host, err)
+			}
+		}
+
+		// 流式转发不缓冲请求体和响应体，依赖完整body或只在缓冲转发中实现的功能不能同时开启
+		if rule.Stream || rule.StreamOnSSE {
+			mode := "stream"
+			if !rule.Stream {
+				mode = "stream_on_sse"
+			}
+			unsupported := []struct {
+				name string
+				set  bool
+			}{
+				{"cache", rule.Cache != nil}, {"range_cache", rule.RangeCache != nil}, {"serve_ranges", rule.ServeRanges},
+				{"accept_ranges", len(rule.AcceptRanges) > 0}, {"decompressed_size", rule.DecompressedSize},
+				{"idempotency", rule.Idempotency != nil}, {"transcode", rule.Transcode != nil}, {"multipart", rule.Multipart != nil},
+				{"body_defaults", len(rule.BodyDefaults) > 0}, {"sniff_content_type", rule.SniffContentType},
+				{"max_json_depth", rule.MaxJSONDepth > 0}, {"retry", rule.Retry != nil}, {"script", rule.Script != nil},
+				{"cdn_headers", rule.CDNHeaders != nil}, {"request_id_body", rule.RequestIDBody != nil},
+				{"schema_drift", rule.SchemaDrift != nil}, {"expected_content_type", rule.ExpectedContentType != ""},
+				{"dns_backoff", rule.DNSBackoff != nil}, {"conn_reuse", rule.ConnReuse != nil}, {"fingerprint", rule.Fingerprint != nil},
+				{"mirror", rule.Mirror != nil}, {"diff", rule.Diff != nil},
+			}
+			for _, option := range unsupported {
+				if option.set {
+					return nil, fmt.Errorf("转发规则 %s: %s模式不支持%s", host, mode, option.name)
+				}
+			}
+		}
+
+		if rc := rule.RangeCache; rc != nil {
+			if rule.ServeRanges {
+				return nil, fmt.Errorf("转发规则 %s: range_cache和serve_ranges不能同时开启", host)
+			}
+			if rc.TTL <= 0 {
+				rc.TTL = Duration(10 * time.Minute)
+			}
+			if rc.MaxObjectSize <= 0 {
+				rc.MaxObjectSize = 100 << 20
+			}
+		}
+
+		// 声明支持Range后客户端的Range请求需要由代理或后端处理
+		if len(rule.AcceptRanges) > 0 && !rule.ServeRanges && rule.RangeCache == nil && !rule.Headers.ForwardClient {
+			return nil, fmt.Errorf("转发规则 %s: accept_ranges需开启serve_ranges、range_cache或headers.forward_client", host)
+		}
+
+		if mr := rule.MinBodyRate; mr != nil {
+			if mr.Rate <= 0 {
+				return nil, fmt.Errorf("转发规则 %s: min_body_rate.rate必须大于0", host)
+			}
+			if mr.Grace == 0 {
+				mr.Grace = Duration(5 * time.Second)
+			}
+		}
+
+		if rule.MaxJSONDepth < 0 {
+			return nil, fmt.Errorf("转发规则 %s: max_json_depth不能小于0", host)
+		}
+
+		if cr := rule.ConnReuse; cr != nil {
+			if cr.MinRatio < 0 || cr.MinRatio > 1 {
+				return nil, fmt.Errorf("转发规则 %s: conn_reuse.min_ratio必须在0~1之间", host)
+			}
+			if cr.Window <= 0 {
+				cr.Window = 100
+			}
+		}
+
+		if fp := rule.Fingerprint; fp != nil {
+			if !fp.TLSCert && !fp.ServerHeader {
+				return nil, fmt.Errorf("转发规则 %s: fingerprint需开启tls_cert或server_header", host)
+			}
+			if fp.Threshold <= 0 {
+				fp.Threshold = 1
+			}
+		}
+
+		rule.hosts = globalHosts
+		if rc := rule.Resolve; rc != nil {
+			if len(rc.DNS) == 0 && len(rc.Hosts) == 0 {
+				return nil, fmt.Errorf("转发规则 %s: resolve需配置dns或hosts", host)
+			}
+			hosts, err := parseStaticHosts(rc.Hosts)
+			if err != nil {
+				return nil, fmt.Errorf("转发规则 %s: resolve.hosts: %v", host, err)
+			}
+			if len(hosts) > 0 {
+				rule.hosts = make(map[string][]net.IPAddr, len(globalHosts)+len(hosts))
+				for name, addrs := range globalHosts {
+					rule.hosts[name] = addrs
+				}
+				for name, addrs := range hosts {
+					rule.hosts[name] = addrs
+				}
+			}
+			for i, server := range rc.DNS {
+				if server == "" {
+					return nil, fmt.Errorf("转发规则 %s: resolve.dns不能为空", host)
+				}
+				if _, _, err := net.SplitHostPort(server); err != nil {
+					port := "53"
+					if rc.TLS {
+						port = "853"
+					}
+					rc.DNS[i] = net.JoinHostPort(server, port)
+				}
+			}
+			if rc.TLS {
+				if _, err := rc.tlsConfig(); err != nil {
+					return nil, fmt.Errorf("转发规则 %s: resolve: %v", host, err)
+				}
+			}
+			switch rc.Family {
+			case "":
+				rc.Family = "ipv4"
+			case "ipv4", "ipv6", "auto":
+			default:
+				return nil, fmt.Errorf("转发规则 %s: 无效的resolve.family: %s", host, rc.Family)
+			}
+			if rc.MinTTL <= 0 {
+				rc.MinTTL = Duration(5 * time.Second)
+			}
+			if rc.MaxTTL <= 0 {
+				rc.MaxTTL = Duration(time.Hour)
+			}
+			if rc.MinTTL > rc.MaxTTL {
+				return nil, fmt.Errorf("转发规则 %s: resolve.min_ttl不能大于max_ttl", host)
+			}
+		}
+
+		if rule.Pool == nil {
+			rule.Pool = &PoolSizeConfig{}
+		}
+		if rule.Pool.MaxIdleConns < 0 || rule.Pool.MaxIdleConnsPerHost < 0 || rule.Pool.MaxConnsPerHost < 0 {
+			return nil, fmt.Errorf("转发规则 %s: pool中的连接数不能小于0", host)
+		}
+		if rule.Pool.MaxIdleConns == 0 {
+			rule.Pool.MaxIdleConns = 100
+		}
+		if rule.Pool.MaxIdleConnsPerHost == 0 {
+			rule.Pool.MaxIdleConnsPerHost = 20
+		}
+		if rule.Pool.MaxConnsPerHost == 0 {
+			rule.Pool.MaxConnsPerHost = 100
+		}
+
+		if rule.MaxConnsPerIP < 0 {
+			return nil, fmt.Errorf("转发规则 %s: max_conns_per_ip不能小于0", host)
+		}
+
+		for _, backend := range rule.Backends() {
+			if !isSRVBackend(backend) {
+				continue
+			}
+			if rule.Resolve == nil || len(rule.Resolve.DNS) == 0 {
+				return nil, fmt.Errorf("转发规则 %s: 后端 %s 使用SRV记录发现，需配置resolve.dns", host, backend)
+			}
+			if rule.MaxConnsPerIP > 0 {
+				return nil, fmt.Errorf("转发规则 %s: 后端 %s 使用SRV记录发现，不支持max_conns_per_ip", host, backend)
+			}
+		}
+
+		if rt := rule.Retry; rt != nil {
+			if rt.PreSend < 0 {
+				return nil, fmt.Errorf("转发规则 %s: retry.pre_send不能小于0", host)
+			}
+			if rt.MaxAttempts <= 0 {
+				rt.MaxAttempts = 1
+			}
+			if rt.Backoff <= 0 {
+				rt.Backoff = Duration(100 * time.Millisecond)
+			}
+			if rt.MaxBackoff <= 0 {
+				rt.MaxBackoff = Duration(2 * time.Second)
+			}
+			if len(rt.RetryOn) == 0 {
+				rt.RetryOn = []string{"error", "502", "503", "504"}
+			}
+			for _, on := range rt.RetryOn {
+				if status, err := strconv.Atoi(on); on != "error" && (err != nil || status < 100 || status > 599) {
+					return nil, fmt.Errorf("转发规则 %s: 无效的retry.retry_on: %s", host, on)
+				}
+			}
+		}
+
+		if tc := rule.Transcode; tc != nil && tc.Backend != "json" && tc.Backend != "msgpack" {
+			return nil, fmt.Errorf("转发规则 %s: 无效的transcode.backend: %s", host, tc.Backend)
+		}
+
+		if sr := rule.SizeRouting; sr != nil {
+			if rule.BlueGreen != nil {
+				return nil, fmt.Errorf("转发规则 %s: size_routing不能与blue_green同时使用", host)
+			}
+			if sr.Small == "" || sr.Large == "" || sr.Threshold <= 0 {
+				return nil, fmt.Errorf("转发规则 %s: size_routing需配置threshold、small和large", host)
+			}
+			switch sr.UnknownSize {
+			case "":
+				sr.UnknownSize = "large"
+			case "small", "large":
+			default:
+				return nil, fmt.Errorf("转发规则 %s: 无效的size_routing.unknown_size: %s", host, sr.UnknownSize)
+			}
+		}
+
+		if lb := rule.LoadBalance; lb != nil {
+			if rule.BlueGreen != nil || rule.SizeRouting != nil {
+				return nil, fmt.Errorf("转发规则 %s: load_balance不能与blue_green、size_routing同时使用", host)
+			}
+			if len(lb.Backends) == 0 {
+				return nil, fmt.Errorf("转发规则 %s: load_balance需配置backends", host)
+			}
+			if len(lb.Weights) == 0 {
+				lb.Weights = make([]int, len(lb.Backends))
+				for i := range lb.Weights {
+					lb.Weights[i] = 1
+				}
+			}
+			if len(lb.Weights) != len(lb.Backends) {
+				return nil, fmt.Errorf("转发规则 %s: load_balance.weights需与backends一一对应", host)
+			}
+			total := 0
+			for _, weight := range lb.Weights {
+				if weight < 0 {
+					return nil, fmt.Errorf("转发规则 %s: load_balance.weights不能小于0", host)
+				}
+				total += weight
+			}
+			if total == 0 {
+				return nil, fmt.Errorf("转发规则 %s: load_balance.weights不能全部为0", host)
+			}
+			switch lb.Strategy {
+			case "":
+				lb.Strategy = "round_robin"
+			case "round_robin", "least_conn", "random":
+			default:
+				return nil, fmt.Errorf("转发规则 %s: 无效的load_balance.strategy: %s", host, lb.Strategy)
+			}
+		}
+
+		if hc := rule.HealthCheck; hc != nil {
+			if rule.BlueGreen != nil || rule.SizeRouting != nil {
+				return nil, fmt.Errorf("转发规则 %s: health_check不能与blue_green、size_routing同时使用", host)
+			}
+			if hc.Path == "" {
+				hc.Path = "/"
+			}
+			if !strings.HasPrefix(hc.Path, "/") {
+				return nil, fmt.Errorf("转发规则 %s: health_check.path需以/开头", host)
+			}
+			if hc.Interval <= 0 {
+				hc.Interval = Duration(10 * time.Second)
+			}
+			if hc.Timeout <= 0 {
+				hc.Timeout = Duration(2 * time.Second)
+			}
+			if hc.UnhealthyThreshold <= 0 {
+				hc.UnhealthyThreshold = 3
+			}
+			if hc.HealthyThreshold <= 0 {
+				hc.HealthyThreshold = 2
+			}
+		}
+
+		for i, method := range rule.AllowedMethods {
+			rule.AllowedMethods[i] = strings.ToUpper(method)
+		}
+		if len(rule.MethodRoutes) > 0 {
+			routes := make(map[string]string, len(rule.MethodRoutes))
+			for method, backend := range rule.MethodRoutes {
+				if backend == "" {
+					return nil, fmt.Errorf("转发规则 %s: method_routes中 %s 的后端为空", host, method)
+				}
+				routes[strings.ToUpper(method)] = backend
+			}
+			rule.MethodRoutes = routes
+		}
+
+		if rp := rule.Respond; rp != nil {
+			if rule.RedirectTo != nil {
+				return nil, fmt.Errorf("转发规则 %s: respond和redirect_to不能同时配置", host)
+			}
+			if rp.Status != 0 && (rp.Status < 100 || rp.Status > 599) {
+				return nil, fmt.Errorf("转发规则 %s: 无效的respond.status: %d", host, rp.Status)
+			}
+			if err := rp.load(); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: 读取respond.file失败: %v", host, err)
+			}
+		}
+
+		if rt := rule.RedirectTo; rt != nil {
+			if rt.URL == "" {
+				return nil, fmt.Errorf("转发规则 %s: redirect_to需配置url", host)
+			}
+			switch rt.Status {
+			case 0:
+				rt.Status = http.StatusFound
+			case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			default:
+				return nil, fmt.Errorf("转发规则 %s: 无效的redirect_to.status: %d", host, rt.Status)
+			}
+		}
+
+		staticPrefixes := make(map[string]struct{}, len(rule.Static))
+		for i := range rule.Static {
+			static := &rule.Static[i]
+			static.Prefix = strings.TrimSuffix(static.Prefix, "/")
+			if !strings.HasPrefix(static.Prefix, "/") || static.Dir == "" {
+				return nil, fmt.Errorf("转发规则 %s: static需配置以/开头且不为/的prefix和dir", host)
+			}
+			if _, ok := staticPrefixes[static.Prefix]; ok {
+				return nil, fmt.Errorf("转发规则 %s: static中重复的prefix: %s", host, static.Prefix)
+			}
+			staticPrefixes[static.Prefix] = struct{}{}
+			if info, err := os.Stat(static.Dir); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("转发规则 %s: static的dir %s 不是可访问的目录", host, static.Dir)
+			}
+			static.handler = static.newHandler()
+		}
+
+		for _, route := range rule.HeaderRoutes {
+			if (route.Header == "") == (route.Cookie == "") || route.BackendBase == "" {
+				return nil, fmt.Errorf("转发规则 %s: header_routes需配置header或cookie之一，以及backend_base", host)
+			}
+		}
+
+		if rule.StripPrefix != "" {
+			rule.StripPrefix = strings.TrimSuffix(rule.StripPrefix, "/")
+			if !strings.HasPrefix(rule.StripPrefix, "/") {
+				return nil, fmt.Errorf("转发规则 %s: strip_prefix需以/开头且不能为/", host)
+			}
+		}
+
+		prefixes := make(map[string]struct{}, len(rule.Routes))
+		for _, route := range rule.Routes {
+			if rule.BlueGreen != nil || rule.SizeRouting != nil {
+				return nil, fmt.Errorf("转发规则 %s: routes不能与blue_green、size_routing同时使用", host)
+			}
+			if !strings.HasPrefix(route.Prefix, "/") || route.BackendBase == "" {
+				return nil, fmt.Errorf("转发规则 %s: routes需配置以/开头的prefix和backend_base", host)
+			}
+			if _, ok := prefixes[route.Prefix]; ok {
+				return nil, fmt.Errorf("转发规则 %s: routes中重复的prefix: %s", host, route.Prefix)
+			}
+			prefixes[route.Prefix] = struct{}{}
+		}
+
+		for i, rewrite := range rule.Rewrites {
+			pattern, err := regexp.Compile(rewrite.Match)
+			if err != nil {
+				return nil, fmt.Errorf("转发规则 %s: rewrites的正则表达式 %s 无效: %v", host, rewrite.Match, err)
+			}
+			rule.Rewrites[i].pattern = pattern
+		}
+
+		if pt := rule.PayloadTimeout; pt != nil && pt.Base <= 0 {
+			return nil, fmt.Errorf("转发规则 %s: payload_timeout.base必须大于0", host)
+		}
+
+		if sh := rule.SamplingHeader; sh != nil {
+			if sh.Rate < 0 || sh.Rate > 1 {
+				return nil, fmt.Errorf("转发规则 %s: sampling_header.rate必须在0到1之间", host)
+			}
+			if sh.Header == "" {
+				sh.Header = "X-Sampled"
+			}
+		}
+
+		if ts := rule.TraceSampling; ts != nil {
+			if ts.Rate < 0 || ts.Rate > 1 {
+				return nil, fmt.Errorf("转发规则 %s: trace_sampling.rate必须在0到1之间", host)
+			}
+			var err error
+			if ts.exclude, err = compilePatterns(ts.Exclude); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: trace_sampling.exclude的正则表达式无效: %v", host, err)
+			}
+			if ts.include, err = compilePatterns(ts.Include); err != nil {
+				return nil, fmt.Errorf("转发规则 %s: trace_sampling.include的正则表达式无效: %v", host, err)
+			}
+		}
+
+		if rid := rule.RequestIDBody; rid != nil {
+			if rid.Field == "" {
+				return nil, fmt.Errorf("转发规则 %s: request_id_body缺少field", host)
+			}
+			if rid.Header == "" {
+				rid.Header = "X-Request-ID"
+			}
+		}
+
+		if rule.ExpectedContentType != "" {
+			rule.ExpectedContentType = strings.ToLower(strings.TrimSpace(rule.ExpectedContentType))
+			if rule.ContentTypeMismatchStatus == 0 {
+				rule.ContentTypeMismatchStatus = http.StatusBadGateway
+			}
+			if rule.ContentTypeMismatchStatus < 400 || rule.ContentTypeMismatchStatus > 599 {
+				return nil, fmt.Errorf("转发规则 %s: 无效的content_type_mismatch_status: %d", host, rule.ContentTypeMismatchStatus)
+			}
+		}
+
+		if idem := rule.Idempotency; idem != nil {
+			if idem.Header == "" {
+				idem.Header = "Idempotency-Key"
+			}
+			if len(idem.Methods) == 0 {
+				idem.Methods = []string{http.MethodPost, http.MethodPatch}
+			}
+		}
+
+		config.TransitMap[host] = rule
+	}
+
+	if config.wildcards, config.regexes, err = compileHostPatterns(config.TransitMap); err != nil {
+		return nil, err
+	}
+
 	for host, rule := range config.TransitMap {
-		log.Infof("转发路由: %s -> %s%s", host, rule.BackendBase, rule.BackendPrefix)
+		if rule.Maintenance != nil && rule.Maintenance.Enabled {
+			log.Warnf("维护模式: %s", host)
+		}
+		if rule.RedirectTo != nil {
+			log.Infof("重定向: %s -> %d %s", host, rule.RedirectTo.Status, rule.RedirectTo.URL)
+		} else if rule.Respond != nil {
+			log.Infof("静态响应: %s -> %d", host, rule.Respond.Status)
+		} else {
+			log.Infof("转发路由: %s -> %s%s", host, rule.BackendBase, rule.BackendPrefix)
+		}
+		for _, route := range rule.Routes {
+			log.Infof("转发路由: %s%s -> %s%s", host, route.Prefix, route.BackendBase, route.BackendPrefix)
+		}
+		for _, static := range rule.Static {
+			log.Infof("静态文件: %s%s -> %s", host, static.Prefix, static.Dir)
+		}
 		if len(rule.Headers.Remove) > 0 {
 			rule.Headers.removes = make(map[string]struct{})
 			for _, remove := range rule.Headers.Remove {
 				rule.Headers.removes[strings.ToLower(remove)] = struct{}{}
 			}
 		}
+		config.TransitMap[host] = rule
 	}
 
 	return &config, nil
 }
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
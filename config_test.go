@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestByteSizeRoundTrip(t *testing.T) {
+	for _, size := range []ByteSize{0, 1, 1023, 1024, 1500000, 1 << 20, 5<<30 + 1} {
+		data, err := json.Marshal(size)
+		if err != nil {
+			t.Fatalf("序列化 %d 失败: %v", size, err)
+		}
+		var parsed ByteSize
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			t.Fatalf("解析 %s 失败: %v", data, err)
+		}
+		if parsed != size {
+			t.Errorf("%d 序列化为 %s 后解析为 %d", size, data, parsed)
+		}
+	}
+}
+
+func TestDurationRoundTrip(t *testing.T) {
+	for _, text := range []string{`"1.5s"`, `"250ms"`, `"1h2m3s"`, `30`} {
+		var d Duration
+		if err := json.Unmarshal([]byte(text), &d); err != nil {
+			t.Fatalf("解析 %s 失败: %v", text, err)
+		}
+		data, err := json.Marshal(d)
+		if err != nil {
+			t.Fatalf("序列化 %s 失败: %v", text, err)
+		}
+		var parsed Duration
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			t.Fatalf("解析 %s 失败: %v", data, err)
+		}
+		if parsed != d {
+			t.Errorf("%s 序列化为 %s 后解析为 %v", text, data, parsed)
+		}
+	}
+}
+
+const roundTripConfig = `{
+	"transit_map": {
+		"a.test": {
+			"backend_base": "http://127.0.0.1:9001",
+			"bandwidth_limit": {"rate": 1500000},
+			"min_body_rate": {"rate": "1.5KB"},
+			"range_cache": {"max_object_size": 3333333}
+		},
+		"b.test": {
+			"size_routing": {"threshold": 1000001, "small": "http://127.0.0.1:9002", "large": "http://127.0.0.1:9003"},
+			"multipart": {"max_part_size": 777777}
+		}
+	}
+}`
+
+// 序列化后重新解析，配置的值不变
+func TestParseConfigRoundTrip(t *testing.T) {
+	config, err := ParseConfig([]byte(roundTripConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reparsed, err := ParseConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := json.Marshal(reparsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Errorf("重新解析后配置变化:\n%s\n%s", data, again)
+	}
+
+	a, b := reparsed.TransitMap["a.test"], reparsed.TransitMap["b.test"]
+	if a.BandwidthLimit.Rate != 1500000 || a.MinBodyRate.Rate != 1500 || a.RangeCache.MaxObjectSize != 3333333 {
+		t.Errorf("a.test的字节数变化: %+v %+v %+v", a.BandwidthLimit, a.MinBodyRate, a.RangeCache)
+	}
+	if b.SizeRouting.Threshold != 1000001 || b.Multipart.MaxPartSize != 777777 {
+		t.Errorf("b.test的字节数变化: %+v %+v", b.SizeRouting, b.Multipart)
+	}
+}
+
+// 通过管理接口修改一个规则时，其他规则保持原样
+func TestUpdateRulesKeepsOtherRules(t *testing.T) {
+	config, err := ParseConfig([]byte(roundTripConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewProxyHandler(config)
+	defer handler.Close()
+
+	err = handler.updateRules(func(rules map[string]json.RawMessage) error {
+		rules["c.test"] = json.RawMessage(`{"backend_base": "http://127.0.0.1:9004"}`)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated := handler.state.Load().config
+	if _, ok := updated.TransitMap["c.test"]; !ok {
+		t.Fatal("未添加c.test")
+	}
+	if rate := updated.TransitMap["a.test"].BandwidthLimit.Rate; rate != 1500000 {
+		t.Errorf("a.test的bandwidth_limit.rate变为 %d", rate)
+	}
+	if threshold := updated.TransitMap["b.test"].SizeRouting.Threshold; threshold != 1000001 {
+		t.Errorf("b.test的size_routing.threshold变为 %d", threshold)
+	}
+}
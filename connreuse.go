@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// 按后端域名统计新建和复用的连接数，保存在ProxyHandler上，配置重新加载后保持不变
+type connReuseCounter struct {
+	newConns    int64
+	reusedConns int64
+
+	windowNew    int // 当前统计窗口内的计数
+	windowReused int
+}
+
+type ConnReuseStats struct {
+	mu       sync.Mutex
+	counters map[string]*connReuseCounter
+}
+
+func NewConnReuseStats() *ConnReuseStats {
+	return &ConnReuseStats{counters: make(map[string]*connReuseCounter)}
+}
+
+// 记录一次请求使用的连接，统计窗口结束且复用率低于下限时返回窗口内的复用率
+func (s *ConnReuseStats) Record(domain string, reused bool, config *ConnReuseConfig) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counters[domain]
+	if !ok {
+		c = &connReuseCounter{}
+		s.counters[domain] = c
+	}
+	if reused {
+		c.reusedConns++
+		c.windowReused++
+	} else {
+		c.newConns++
+		c.windowNew++
+	}
+
+	total := c.windowNew + c.windowReused
+	if total < config.Window {
+		return 0, false
+	}
+	ratio := float64(c.windowReused) / float64(total)
+	c.windowNew, c.windowReused = 0, 0
+	return ratio, ratio < config.MinRatio
+}
+
+type connReuseSnapshot struct {
+	Domain      string  `json:"domain"`
+	NewConns    int64   `json:"new_conns"`
+	ReusedConns int64   `json:"reused_conns"`
+	ReuseRatio  float64 `json:"reuse_ratio"`
+}
+
+func (s *ConnReuseStats) Snapshot() []connReuseSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots := make([]connReuseSnapshot, 0, len(s.counters))
+	for domain, c := range s.counters {
+		snapshot := connReuseSnapshot{Domain: domain, NewConns: c.newConns, ReusedConns: c.reusedConns}
+		if total := c.newConns + c.reusedConns; total > 0 {
+			snapshot.ReuseRatio = float64(c.reusedConns) / float64(total)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Domain < snapshots[j].Domain })
+	return snapshots
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// 统计与后端的连接复用率，统计窗口内的复用率低于conn_reuse.min_ratio时记录warn日志
+func TestConnReuse(t *testing.T) {
+	cases := []struct {
+		name       string
+		closeConns bool // 后端是否在每个响应后关闭连接
+		wantNew    int64
+		wantReused int64
+		warn       bool
+	}{
+		{"后端保持连接", false, 1, 3, false},
+		{"后端关闭连接", true, 4, 0, true},
+	}
+	for _, c := range cases {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.closeConns {
+				w.Header().Set("Connection", "close")
+			}
+		}))
+		defer backend.Close()
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "conn_reuse": {"min_ratio": 0.5, "window": 4}}}}`)
+		logs := captureLog(t)
+
+		for i := 0; i < 4; i++ {
+			if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil)); rec.Code != http.StatusOK {
+				t.Fatalf("%s: 状态 %d", c.name, rec.Code)
+			}
+		}
+		snapshots := handler.connReuse.Snapshot()
+		if len(snapshots) != 1 || snapshots[0].NewConns != c.wantNew || snapshots[0].ReusedConns != c.wantReused {
+			t.Errorf("%s: 统计 %+v, 期望新建 %d 复用 %d", c.name, snapshots, c.wantNew, c.wantReused)
+		}
+		if got := logs.FilterLevelExact(zap.WarnLevel).FilterMessageSnippet("连接复用率过低").Len(); got != 0 != c.warn {
+			t.Errorf("%s: 复用率日志 %d 条", c.name, got)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 开启diff时对比后端的请求结果及与主后端响应的差异，对比后端完成后记录到日志
+type DiffTrace struct {
+	BackendURL  string
+	StatusCode  int
+	Duration    time.Duration
+	Error       error
+	Differences []string // 状态码、响应头和响应体的差异，超过max_diffs的部分省略
+	Truncated   bool     // 是否有差异被省略
+}
+
+func (d *DiffTrace) String() string {
+	if d.Error != nil {
+		return fmt.Sprintf("对比: %s 耗时: %v 失败: %v", d.BackendURL, d.Duration, d.Error)
+	}
+	if len(d.Differences) == 0 {
+		return fmt.Sprintf("对比: %s 耗时: %v 无差异", d.BackendURL, d.Duration)
+	}
+	differences := strings.Join(d.Differences, "; ")
+	if d.Truncated {
+		differences += "; ..."
+	}
+	return fmt.Sprintf("对比: %s 耗时: %v 差异: %s", d.BackendURL, d.Duration, differences)
+}
+
+func (c *DiffConfig) applies(method string) bool {
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// 与主后端的请求同时向对比后端发送相同的请求，结果在完成后写入返回的channel；
+// 对比请求与客户端请求的生命周期分离，只受diff.timeout限制
+func (p *ProxyHandler) sendDiff(state *transitState, r *http.Request, method string, headers http.Header, body []byte, rule TransitRule) <-chan *ProxyTrace {
+	result := make(chan *ProxyTrace, 1)
+	trace := &ProxyTrace{StartTime: time.Now(), RequestURL: fmt.Sprintf("%s%s", r.Host, r.URL.Path), Method: method}
+	diffURL, err := p.buildTransitBackendURL(rule.Diff.BackendBase, rule, r)
+	if err != nil {
+		trace.Error = fmt.Errorf("构建对比后端URL失败: %v", err)
+		result <- trace
+		return result
+	}
+	trace.BackendURL = diffURL
+	headers = headers.Clone()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rule.Diff.Timeout))
+		defer cancel()
+		p.sendRequest(ctx, state, trace, method, diffURL, headers, body, rule)
+		trace.Duration = time.Since(trace.StartTime)
+		result <- trace
+	}()
+	return result
+}
+
+// 主后端的响应先返回给客户端，对比后端完成后在后台对比并记录：有差异或对比后端失败时记录info日志，否则记录debug日志
+func logDiff(primary *ProxyTrace, secondary <-chan *ProxyTrace, config *DiffConfig) {
+	// 之后的处理会改写主后端的响应，先保存原始响应
+	snapshot := &ProxyTrace{StatusCode: primary.StatusCode, Error: primary.Error, ResponseHeaders: primary.ResponseHeaders.Clone(), ResponseBody: primary.ResponseBody}
+	method, requestURL := primary.Method, primary.RequestURL
+	go func() {
+		d := diffResponses(snapshot, <-secondary, config)
+		if d.Error != nil || len(d.Differences) > 0 {
+			log.Infof("%s %s | %s", method, requestURL, d)
+			return
+		}
+		log.Debugf("%s %s | %s", method, requestURL, d)
+	}()
+}
+
+// 总是忽略的响应头，每次请求或每个后端都可能不同
+var diffIgnoredHeaders = []string{"Date", "Content-Length"}
+
+var arrayIndexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// 对比状态码、响应头和响应体，两边都是JSON时逐字段对比，否则只比较内容是否相同
+func diffResponses(primary, secondary *ProxyTrace, config *DiffConfig) *DiffTrace {
+	d := &DiffTrace{BackendURL: secondary.BackendURL, StatusCode: secondary.StatusCode, Duration: secondary.Duration, Error: secondary.Error}
+	if secondary.Error != nil {
+		return d
+	}
+	if primary.Error != nil {
+		d.add(config, fmt.Sprintf("主后端失败: %v", primary.Error))
+		return d
+	}
+
+	if primary.StatusCode != secondary.StatusCode {
+		d.add(config, fmt.Sprintf("状态: %d != %d", primary.StatusCode, secondary.StatusCode))
+	}
+
+	ignored := make(map[string]bool)
+	for _, key := range append(diffIgnoredHeaders, config.IgnoreHeaders...) {
+		ignored[http.CanonicalHeaderKey(key)] = true
+	}
+	keys := make(map[string]struct{})
+	for key := range primary.ResponseHeaders {
+		keys[key] = struct{}{}
+	}
+	for key := range secondary.ResponseHeaders {
+		keys[key] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		if !ignored[key] && !isHopHeader(key) {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		a, b := strings.Join(primary.ResponseHeaders.Values(key), ","), strings.Join(secondary.ResponseHeaders.Values(key), ",")
+		if a != b {
+			d.add(config, fmt.Sprintf("响应头 %s: %s != %s", key, diffValue(a), diffValue(b)))
+		}
+	}
+
+	a, b := decodedBody(primary), decodedBody(secondary)
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) == nil && json.Unmarshal(b, &bv) == nil {
+		fields := make(map[string]bool, len(config.IgnoreFields))
+		for _, field := range config.IgnoreFields {
+			fields[field] = true
+		}
+		d.diffJSON(config, fields, "", av, bv)
+	} else if !bytes.Equal(a, b) {
+		d.add(config, fmt.Sprintf("响应体: %d B != %d B", len(a), len(b)))
+	}
+	return d
+}
+
+func (d *DiffTrace) add(config *DiffConfig, difference string) {
+	if len(d.Differences) >= config.MaxDiffs {
+		d.Truncated = true
+		return
+	}
+	d.Differences = append(d.Differences, difference)
+}
+
+// 递归对比JSON值，path形如data.items[0].id，按ignore_fields跳过时数组下标写作[]
+func (d *DiffTrace) diffJSON(config *DiffConfig, ignored map[string]bool, path string, a, b interface{}) {
+	if path != "" && ignored[arrayIndexPattern.ReplaceAllString(path, "[]")] {
+		return
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(av)+len(bv))
+			for key := range av {
+				keys = append(keys, key)
+			}
+			for key := range bv {
+				if _, ok := av[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				child := key
+				if path != "" {
+					child = path + "." + key
+				}
+				d.diffJSON(config, ignored, child, av[key], bv[key])
+			}
+			return
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			for i := 0; i < max(len(av), len(bv)); i++ {
+				var ai, bi interface{}
+				if i < len(av) {
+					ai = av[i]
+				}
+				if i < len(bv) {
+					bi = bv[i]
+				}
+				d.diffJSON(config, ignored, fmt.Sprintf("%s[%d]", path, i), ai, bi)
+			}
+			return
+		}
+	}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	if !bytes.Equal(ja, jb) {
+		if path == "" {
+			path = "响应体"
+		}
+		d.add(config, fmt.Sprintf("%s: %s != %s", path, diffValue(string(ja)), diffValue(string(jb))))
+	}
+}
+
+// 缺失的值显示为(无)，过长的值截断
+func diffValue(value string) string {
+	switch {
+	case value == "" || value == "null":
+		return "(无)"
+	case len(value) > 100:
+		return value[:100] + "..."
+	}
+	return value
+}
+
+// gzip压缩的响应体解压后再对比
+func decodedBody(trace *ProxyTrace) []byte {
+	if strings.EqualFold(trace.ResponseHeaders.Get("Content-Encoding"), "gzip") {
+		if decoded, err := gunzip(trace.ResponseBody); err == nil {
+			return decoded
+		}
+	}
+	return trace.ResponseBody
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func diffTrace(status int, header http.Header, body string) *ProxyTrace {
+	return &ProxyTrace{StatusCode: status, ResponseHeaders: header, ResponseBody: []byte(body)}
+}
+
+func TestDiffResponsesJSON(t *testing.T) {
+	config := &DiffConfig{MaxDiffs: 20, IgnoreFields: []string{"ts", "items[].t"}, IgnoreHeaders: []string{"X-Request-Id"}}
+	primary := diffTrace(200, http.Header{"X-Version": {"a"}, "Date": {"1"}, "X-Request-Id": {"1"}},
+		`{"id": 1, "ver": "a", "ts": 1, "items": [{"a": 1, "t": 1}], "only_a": true}`)
+	secondary := diffTrace(404, http.Header{"X-Version": {"b"}, "Date": {"2"}, "X-Request-Id": {"2"}},
+		`{"id": 1, "ver": "b", "ts": 2, "items": [{"a": 1, "t": 2}, {"a": 3}]}`)
+
+	d := diffResponses(primary, secondary, config)
+	want := []string{
+		"状态: 200 != 404",
+		"响应头 X-Version: a != b",
+		`items[1]: (无) != {"a":3}`,
+		"only_a: true != (无)",
+		`ver: "a" != "b"`,
+	}
+	if !reflect.DeepEqual(d.Differences, want) {
+		t.Errorf("差异:\n%q\n期望:\n%q", d.Differences, want)
+	}
+}
+
+func TestDiffResponsesIdentical(t *testing.T) {
+	config := &DiffConfig{MaxDiffs: 20}
+	primary := diffTrace(200, http.Header{"Content-Type": {"application/json"}}, `{"a": [1, 2], "b": {"c": null}}`)
+	secondary := diffTrace(200, http.Header{"Content-Type": {"application/json"}}, `{"b": {"c": null}, "a": [1, 2]}`)
+	if d := diffResponses(primary, secondary, config); len(d.Differences) != 0 {
+		t.Errorf("相同的响应存在差异: %q", d.Differences)
+	}
+}
+
+func TestDiffResponsesNonJSONAndTruncation(t *testing.T) {
+	d := diffResponses(diffTrace(200, nil, "hello"), diffTrace(200, nil, "hello!"), &DiffConfig{MaxDiffs: 20})
+	if want := []string{"响应体: 5 B != 6 B"}; !reflect.DeepEqual(d.Differences, want) {
+		t.Errorf("差异: %q, 期望: %q", d.Differences, want)
+	}
+
+	d = diffResponses(diffTrace(200, nil, `{"a":1,"b":1,"c":1}`), diffTrace(500, nil, `{"a":2,"b":2,"c":2}`), &DiffConfig{MaxDiffs: 2})
+	if len(d.Differences) != 2 || !d.Truncated {
+		t.Errorf("max_diffs未生效: %q truncated=%t", d.Differences, d.Truncated)
+	}
+}
+
+func TestDiffResponsesSecondaryError(t *testing.T) {
+	secondary := &ProxyTrace{BackendURL: "http://b/x", Error: errors.New("connection refused")}
+	d := diffResponses(diffTrace(200, nil, "ok"), secondary, &DiffConfig{MaxDiffs: 20})
+	if d.Error == nil || len(d.Differences) != 0 {
+		t.Errorf("对比后端失败时应只记录错误: %+v", d)
+	}
+}
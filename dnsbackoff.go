@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// 后端域名连续解析失败后暂停转发，冷却结束后重新尝试解析
+type DNSBackoff struct {
+	config *DNSBackoffConfig
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	tripped   bool // 冷却结束后的首次解析仍失败时立即重新进入冷却
+}
+
+func NewDNSBackoff(config *DNSBackoffConfig) *DNSBackoff {
+	return &DNSBackoff{config: config}
+}
+
+func (b *DNSBackoff) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+// 记录请求结果，返回本次记录是否进入冷却
+func (b *DNSBackoff) Record(err error) bool {
+	var dnsErr *net.DNSError
+	failed := errors.As(err, &dnsErr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures, b.tripped = 0, false
+		return false
+	}
+	b.failures++
+	if b.tripped || b.failures >= b.config.Failures {
+		b.failures, b.tripped = 0, true
+		b.openUntil = time.Now().Add(time.Duration(b.config.Cooldown))
+		return true
+	}
+	return false
+}
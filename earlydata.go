@@ -0,0 +1,16 @@
+package main
+
+import "net/http"
+
+// 前端TLS终止代理接受TLS 1.3 0-RTT早期数据时，按RFC 8470以Early-Data: 1标记请求。
+// 早期数据可能被重放，只转发安全方法，其他方法返回425，由客户端在握手完成后重试
+func rejectEarlyData(r *http.Request) bool {
+	if r.Header.Get("Early-Data") != "1" {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
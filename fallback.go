@@ -0,0 +1,108 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// 加载配置时读取静态响应体，未指定content_type时按文件扩展名推断
+func (c *FallbackResponseConfig) load() error {
+	c.body = []byte(c.Body)
+	if c.File != "" {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return err
+		}
+		c.body = data
+		if c.ContentType == "" {
+			c.ContentType = mime.TypeByExtension(filepath.Ext(c.File))
+		}
+	}
+	if c.ContentType == "" {
+		c.ContentType = "text/plain; charset=utf-8"
+	}
+	if c.Status == 0 {
+		c.Status = http.StatusServiceUnavailable
+	}
+	return nil
+}
+
+// 后端无法处理请求时是否返回静态响应：熔断、连接失败、超时等没有拿到后端响应的情况，
+// 以及开启on_5xx时后端返回的5xx
+func (c *FallbackResponseConfig) Applies(trace *ProxyTrace) bool {
+	if trace.Error != nil {
+		return trace.StatusCode == 0 && errorStatus(trace.Error) >= 500
+	}
+	return c.On5xx && trace.StatusCode >= 500
+}
+
+func (c *FallbackResponseConfig) Serve(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", c.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(c.body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(c.Status)
+	_, err := w.Write(c.body)
+	return err
+}
+
+// 加载配置时读取respond的响应体，规则与fallback_response相同
+func (c *RespondConfig) load() error {
+	fallback := FallbackResponseConfig{Status: c.Status, ContentType: c.ContentType, Body: c.Body, File: c.File}
+	if fallback.Status == 0 {
+		fallback.Status = http.StatusOK
+	}
+	if err := fallback.load(); err != nil {
+		return err
+	}
+	c.Status, c.ContentType, c.body = fallback.Status, fallback.ContentType, fallback.body
+	return nil
+}
+
+// 返回respond配置的静态响应，HEAD请求只返回响应头
+func (c *RespondConfig) Serve(w http.ResponseWriter, r *http.Request) error {
+	for key, value := range c.Headers {
+		w.Header().Set(key, value)
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", c.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(c.body)))
+	w.WriteHeader(c.Status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := w.Write(c.body)
+	return err
+}
+
+// 加载配置时读取维护页面，规则与fallback_response相同
+func (c *MaintenanceConfig) load() error {
+	if c.Body == "" && c.File == "" {
+		c.Body = "服务维护中"
+	}
+	fallback := FallbackResponseConfig{Status: c.Status, ContentType: c.ContentType, Body: c.Body, File: c.File}
+	if err := fallback.load(); err != nil {
+		return err
+	}
+	c.Status, c.ContentType, c.body = fallback.Status, fallback.ContentType, fallback.body
+	return nil
+}
+
+// 返回维护页面，HEAD请求只返回响应头
+func (c *MaintenanceConfig) Serve(w http.ResponseWriter, r *http.Request) error {
+	if c.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(c.RetryAfter))
+	}
+	w.Header().Set("Content-Type", c.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(c.body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(c.Status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := w.Write(c.body)
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// 后端的身份指纹，由TLS叶子证书哈希和/或Server响应头组成
+func backendFingerprint(resp *http.Response, config *FingerprintConfig) string {
+	var parts []string
+	if config.TLSCert && resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+		parts = append(parts, "cert=sha256:"+hex.EncodeToString(sum[:]))
+	}
+	if config.ServerHeader {
+		parts = append(parts, "server="+resp.Header.Get("Server"))
+	}
+	return strings.Join(parts, " ")
+}
+
+type fingerprintState struct {
+	known     string
+	candidate string // 与known不同的新指纹
+	count     int    // 新指纹连续出现的次数
+}
+
+// 按后端域名跟踪指纹，保存在ProxyHandler上，配置重新加载后保持不变
+type FingerprintTracker struct {
+	mu     sync.Mutex
+	states map[string]*fingerprintState
+}
+
+func NewFingerprintTracker() *FingerprintTracker {
+	return &FingerprintTracker{states: make(map[string]*fingerprintState)}
+}
+
+// 记录本次响应的指纹，新指纹连续出现threshold次后认定后端身份变化，返回变化前的指纹
+func (t *FingerprintTracker) Observe(domain, fingerprint string, threshold int) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.states[domain]
+	if !ok {
+		t.states[domain] = &fingerprintState{known: fingerprint}
+		return "", false
+	}
+	if fingerprint == state.known {
+		state.candidate, state.count = "", 0
+		return "", false
+	}
+
+	if fingerprint == state.candidate {
+		state.count++
+	} else {
+		state.candidate, state.count = fingerprint, 1
+	}
+	if state.count < threshold {
+		return "", false
+	}
+	previous := state.known
+	state.known, state.candidate, state.count = fingerprint, "", 0
+	return previous, true
+}
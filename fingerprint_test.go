@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 生成自签名证书，用于模拟后端更换证书
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "replaced.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"127.0.0.1"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// 后端证书或Server响应头变化时记录warn日志，新指纹连续出现threshold次后才告警
+func TestFingerprint(t *testing.T) {
+	replaced := selfSignedCert(t)
+	var useReplaced atomic.Bool
+	var server atomic.Value
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", server.Load().(string))
+	}))
+	backend.StartTLS()
+	defer backend.Close()
+	original := backend.TLS.Certificates[0]
+	backend.TLS.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if useReplaced.Load() {
+			return &replaced, nil
+		}
+		return &original, nil
+	}
+	backend.TLS.Certificates = nil
+
+	type step struct {
+		replaced bool   // 后端是否使用新证书
+		server   string // 后端的Server响应头
+		warn     bool
+	}
+	cases := []struct {
+		name   string
+		config string
+		steps  []step
+	}{
+		{"证书变化", `{"tls_cert": true}`, []step{
+			{false, "nginx", false}, {false, "nginx", false}, {true, "nginx", true}, {true, "nginx", false},
+		}},
+		{"Server头变化", `{"server_header": true}`, []step{
+			{false, "nginx", false}, {true, "nginx", false}, {true, "envoy", true},
+		}},
+		{"新指纹未达到阈值", `{"tls_cert": true, "server_header": true, "threshold": 2}`, []step{
+			{false, "nginx", false}, {false, "envoy", false}, {false, "nginx", false}, {false, "envoy", false}, {false, "envoy", true},
+		}},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "fingerprint": `+c.config+`}}}`)
+		state := handler.state.Load()
+		state.clients[handler.extractDomain(backend.URL)] = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}}
+
+		for i, s := range c.steps {
+			useReplaced.Store(s.replaced)
+			server.Store(s.server)
+			logs := captureLog(t)
+			if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil)); rec.Code != http.StatusOK {
+				t.Fatalf("%s: 第 %d 个请求状态 %d", c.name, i+1, rec.Code)
+			}
+			if got := logs.FilterLevelExact(zap.WarnLevel).FilterMessageSnippet("身份指纹发生变化").Len(); got != 0 != s.warn {
+				t.Errorf("%s: 第 %d 个请求指纹日志 %d 条", c.name, i+1, got)
+			}
+		}
+	}
+
+	if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend": "http://b", "fingerprint": {}}}}`)); err == nil {
+		t.Error("fingerprint未开启任何字段时期望加载失败")
+	}
+}
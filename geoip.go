@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+var geoHeaders = []string{"X-Geo-Country", "X-Geo-City", "X-Geo-ASN", "X-Geo-ASN-Org"}
+
+var geoFields = map[string]struct{}{"country": {}, "city": {}, "asn": {}}
+
+// 按文件路径缓存已打开的MaxMind数据库，配置重新加载后继续使用
+type GeoIPDatabases struct {
+	mu      sync.Mutex
+	readers map[string]*geoip2.Reader
+}
+
+func NewGeoIPDatabases() *GeoIPDatabases {
+	return &GeoIPDatabases{readers: make(map[string]*geoip2.Reader)}
+}
+
+// 打开失败时返回nil，不影响转发
+func (d *GeoIPDatabases) Reader(path string) *geoip2.Reader {
+	if path == "" {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if reader, ok := d.readers[path]; ok {
+		return reader
+	}
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		log.Warnf("打开GeoIP数据库失败: %v, 不注入对应的地理信息", err)
+	}
+	d.readers[path] = reader
+	return reader
+}
+
+func (d *GeoIPDatabases) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for path, reader := range d.readers {
+		if reader != nil {
+			reader.Close()
+		}
+		delete(d.readers, path)
+	}
+}
+
+// 按客户端IP查询国家、城市和ASN，写入X-Geo-*头，覆盖客户端传入的同名Header
+func (p *ProxyHandler) injectGeoIP(r *http.Request, headers http.Header, config *GeoIPConfig) {
+	for _, key := range geoHeaders {
+		headers.Del(key)
+	}
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return
+	}
+
+	fields := make(map[string]bool, len(config.Fields))
+	for _, field := range config.Fields {
+		fields[field] = true
+	}
+
+	if fields["country"] || fields["city"] {
+		if reader := p.geoIP.Reader(config.Database); reader != nil {
+			if city, err := reader.City(ip); err != nil {
+				log.Debugf("查询GeoIP失败: %s: %v", ip, err)
+			} else {
+				if fields["country"] && city.Country.IsoCode != "" {
+					headers.Set("X-Geo-Country", city.Country.IsoCode)
+				}
+				if name := city.City.Names["en"]; fields["city"] && name != "" {
+					headers.Set("X-Geo-City", name)
+				}
+			}
+		}
+	}
+
+	if fields["asn"] {
+		if reader := p.geoIP.Reader(config.ASNDatabase); reader != nil {
+			if asn, err := reader.ASN(ip); err != nil {
+				log.Debugf("查询ASN失败: %s: %v", ip, err)
+			} else if asn.AutonomousSystemNumber != 0 {
+				headers.Set("X-Geo-ASN", strconv.FormatUint(uint64(asn.AutonomousSystemNumber), 10))
+				if asn.AutonomousSystemOrganization != "" {
+					headers.Set("X-Geo-ASN-Org", asn.AutonomousSystemOrganization)
+				}
+			}
+		}
+	}
+}
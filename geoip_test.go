@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// 按MaxMind DB格式编码数据，只支持测试用到的map、string（最长284字节）和uint32
+func encodeMMDB(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		buf.WriteByte(7<<5 | byte(len(v)))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeMMDB(buf, key)
+			encodeMMDB(buf, v[key])
+		}
+	case string:
+		if len(v) < 29 {
+			buf.WriteByte(2<<5 | byte(len(v)))
+		} else {
+			buf.Write([]byte{2<<5 | 29, byte(len(v) - 29)})
+		}
+		buf.WriteString(v)
+	case uint32:
+		buf.WriteByte(6<<5 | 4)
+		binary.Write(buf, binary.BigEndian, v)
+	}
+}
+
+// 生成只包含一个IPv4地址的MaxMind数据库文件
+func writeTestMMDB(t *testing.T, databaseType string, ip net.IP, record map[string]interface{}) string {
+	t.Helper()
+	const nodeCount = 32
+	ip = ip.To4()
+	var buf bytes.Buffer
+	for i := 0; i < nodeCount; i++ {
+		next := uint32(i + 1)
+		if i == nodeCount-1 {
+			next = nodeCount + 16 // 指向数据区开头
+		}
+		records := [2]uint32{nodeCount, nodeCount}
+		records[ip[i/8]>>(7-i%8)&1] = next
+		for _, r := range records {
+			buf.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	encodeMMDB(&buf, record)
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	var metadata bytes.Buffer
+	encodeMMDB(&metadata, map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint32(24),
+		"ip_version":                  uint32(4),
+		"database_type":               databaseType,
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(0),
+	})
+	buf.Write(metadata.Bytes())
+
+	path := filepath.Join(t.TempDir(), databaseType+".mmdb")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInjectGeoIP(t *testing.T) {
+	city := writeTestMMDB(t, "GeoIP2-City", net.ParseIP("192.0.2.1"), map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "GB"},
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "London"}},
+	})
+	asn := writeTestMMDB(t, "GeoLite2-ASN", net.ParseIP("192.0.2.1"), map[string]interface{}{
+		"autonomous_system_number":       uint32(64496),
+		"autonomous_system_organization": "Example Net",
+	})
+
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name     string
+		fields   string
+		remote   string
+		expected map[string]string
+	}{
+		{"全部字段", `"country", "city", "asn"`, "192.0.2.1:1234", map[string]string{"X-Geo-Country": "GB", "X-Geo-City": "London", "X-Geo-Asn": "64496", "X-Geo-Asn-Org": "Example Net"}},
+		{"仅国家", `"country"`, "192.0.2.1:1234", map[string]string{"X-Geo-Country": "GB"}},
+		// 数据库中没有的地址不注入Header，并删除客户端伪造的Header
+		{"未知地址", `"country", "city", "asn"`, "198.51.100.1:1234", map[string]string{}},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"forward_client": true, "geoip": {
+			"database": "`+city+`", "asn_database": "`+asn+`", "fields": [`+c.fields+`]
+		}}}}}`)
+		req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+		req.RemoteAddr = c.remote
+		req.Header.Set("X-Geo-Country", "spoofed")
+		if rec := serveProxy(handler, req); rec.Code != http.StatusOK {
+			t.Fatalf("%s: 状态 %d: %s", c.name, rec.Code, rec.Body)
+		}
+		for _, key := range geoHeaders {
+			if value := got.Get(key); value != c.expected[http.CanonicalHeaderKey(key)] {
+				t.Errorf("%s: %s = %q, 期望 %q", c.name, key, value, c.expected[http.CanonicalHeaderKey(key)])
+			}
+		}
+	}
+}
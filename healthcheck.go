@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type backendHealth struct {
+	healthy   bool
+	successes int // 连续成功次数
+	failures  int // 连续失败次数
+}
+
+// 定期探测规则的后端，连续失败达到阈值后从轮换中移除，连续成功达到阈值后恢复。
+// 属于某一版配置，配置重新加载时停止并由新配置重新创建
+type HealthChecker struct {
+	host     string
+	config   *HealthCheckConfig
+	backends []string
+	clients  []*http.Client
+	mu       sync.Mutex
+	status   map[string]*backendHealth
+	stop     chan struct{}
+}
+
+// clients为与backends对应的连接池客户端，探测与转发使用相同的TLS等设置
+func NewHealthChecker(host string, config *HealthCheckConfig, backends []string, clients []*http.Client) *HealthChecker {
+	h := &HealthChecker{host: host, config: config, backends: backends, clients: clients, status: make(map[string]*backendHealth), stop: make(chan struct{})}
+	for i, backend := range backends {
+		h.status[backend] = &backendHealth{healthy: true}
+		go h.run(backend, clients[i])
+	}
+	return h
+}
+
+// 是否探测相同的后端并使用相同的连接池，配置重新加载时据此决定能否沿用
+func (h *HealthChecker) same(backends []string, clients []*http.Client) bool {
+	if len(backends) != len(h.backends) {
+		return false
+	}
+	for i := range backends {
+		if backends[i] != h.backends[i] || clients[i] != h.clients[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 未探测的后端（如backup）视为健康
+func (h *HealthChecker) Healthy(backend string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, ok := h.status[backend]
+	return !ok || status.healthy
+}
+
+func (h *HealthChecker) run(backend string, client *http.Client) {
+	ticker := time.NewTicker(time.Duration(h.config.Interval))
+	defer ticker.Stop()
+	for {
+		h.record(backend, h.probe(backend, client))
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *HealthChecker) probe(backend string, client *http.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.config.Timeout))
+	defer cancel()
+
+	if !strings.HasPrefix(backend, "http://") && !strings.HasPrefix(backend, "https://") {
+		backend = "http://" + backend
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(backend, "/")+h.config.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("状态码: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *HealthChecker) record(backend string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := h.status[backend]
+	if err != nil {
+		status.successes = 0
+		status.failures++
+		if status.healthy && status.failures >= h.config.UnhealthyThreshold {
+			status.healthy = false
+			log.Warnf("%s 后端 %s 健康检查连续失败 %d 次, 停止转发: %v", h.host, backend, status.failures, err)
+		}
+		// 不健康期间每次探测失败都关闭空闲连接，进行中的请求完成后归还的连接在下次探测时关闭
+		if !status.healthy && h.config.Drain {
+			h.drain(backend)
+		}
+		return
+	}
+	status.failures = 0
+	status.successes++
+	if !status.healthy && status.successes >= h.config.HealthyThreshold {
+		status.healthy = true
+		log.Infof("%s 后端 %s 健康检查恢复, 重新转发", h.host, backend)
+	}
+}
+
+// 关闭到该后端的空闲连接，后端域名的连接池由使用它的所有规则共享
+func (h *HealthChecker) drain(backend string) {
+	for i, b := range h.backends {
+		if b == backend && h.clients[i] != nil {
+			h.clients[i].CloseIdleConnections()
+			return
+		}
+	}
+}
+
+func (h *HealthChecker) Close() {
+	close(h.stop)
+}
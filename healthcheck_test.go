@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 启动总是返回503并记录连接关闭次数的后端，返回后端地址、已建立一个空闲连接的客户端和已关闭的连接数
+func drainBackend(t *testing.T) (string, *http.Client, *atomic.Int32) {
+	t.Helper()
+	var closed atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return server.URL, client, &closed
+}
+
+func waitClosed(closed *atomic.Int32, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if closed.Load() > 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestHealthCheckDrainsIdleConnections(t *testing.T) {
+	backend, client, closed := drainBackend(t)
+	config := &HealthCheckConfig{Path: "/", Interval: Duration(time.Hour), Timeout: Duration(time.Second), UnhealthyThreshold: 1, HealthyThreshold: 1, Drain: true}
+	h := NewHealthChecker("a.test", config, []string{backend}, []*http.Client{client})
+	defer h.Close()
+
+	h.record(backend, errors.New("探测失败"))
+	if h.Healthy(backend) {
+		t.Fatal("探测失败后后端仍健康")
+	}
+	if !waitClosed(closed, 2*time.Second) {
+		t.Error("后端不健康后空闲连接未关闭")
+	}
+}
+
+func TestHealthCheckWithoutDrainKeepsConnections(t *testing.T) {
+	backend, client, closed := drainBackend(t)
+	config := &HealthCheckConfig{Path: "/", Interval: Duration(time.Hour), Timeout: Duration(time.Second), UnhealthyThreshold: 1, HealthyThreshold: 1}
+	h := NewHealthChecker("a.test", config, []string{backend}, []*http.Client{client})
+	defer h.Close()
+
+	h.record(backend, errors.New("探测失败"))
+	if waitClosed(closed, 200*time.Millisecond) {
+		t.Error("未开启drain时关闭了空闲连接")
+	}
+}
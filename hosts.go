@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 通配符或正则形式的转发规则key
+type hostPattern struct {
+	key    string
+	suffix string         // *.example.com 对应 .example.com
+	re     *regexp.Regexp // ~开头的正则
+}
+
+// key是否为通配符、正则或默认规则，而不是具体的域名
+func isHostPattern(key string) bool {
+	return strings.HasPrefix(key, "~") || strings.Contains(key, "*")
+}
+
+// 从转发规则中取出通配符和正则规则，通配符按后缀从长到短排序，正则按key排序
+func compileHostPatterns(rules map[string]TransitRule) (wildcards, regexes []hostPattern, err error) {
+	for key, rule := range rules {
+		captures := []string{"0"}
+		switch {
+		case strings.HasPrefix(key, "~"):
+			re, err := regexp.Compile(key[1:])
+			if err != nil {
+				return nil, nil, fmt.Errorf("转发规则 %s: 无效的正则: %v", key, err)
+			}
+			regexes = append(regexes, hostPattern{key: key, re: re})
+			for i, name := range re.SubexpNames()[1:] {
+				captures = append(captures, strconv.Itoa(i+1))
+				if name != "" {
+					captures = append(captures, name)
+				}
+			}
+		case key == "*":
+		case strings.HasPrefix(key, "*."):
+			if strings.Contains(key[1:], "*") {
+				return nil, nil, fmt.Errorf("转发规则 %s: 通配符只能出现在开头", key)
+			}
+			wildcards = append(wildcards, hostPattern{key: key, suffix: key[1:]})
+			captures = append(captures, "1")
+		case strings.Contains(key, "*"):
+			return nil, nil, fmt.Errorf("转发规则 %s: 通配符只能以*.开头或单独使用", key)
+		}
+		if err := checkHostCaptures(rule, captures); err != nil {
+			return nil, nil, fmt.Errorf("转发规则 %s: %v", key, err)
+		}
+	}
+	sort.Slice(wildcards, func(i, j int) bool {
+		if len(wildcards[i].suffix) != len(wildcards[j].suffix) {
+			return len(wildcards[i].suffix) > len(wildcards[j].suffix)
+		}
+		return wildcards[i].key < wildcards[j].key
+	})
+	sort.Slice(regexes, func(i, j int) bool { return regexes[i].key < regexes[j].key })
+	return wildcards, regexes, nil
+}
+
+// 按精确 > 通配符（后缀最长优先）> 正则（按key排序）> 默认规则*的顺序查找转发规则，返回匹配的key和域名中捕获的部分：
+// 0为整个域名，通配符规则的1为*匹配的部分，正则规则按分组序号和分组名
+func (c *Config) MatchRule(host string) (string, TransitRule, map[string]string, bool) {
+	captures := map[string]string{"0": host}
+	// 通配符和正则规则的key不能被字面相同的Host精确匹配，否则绕过捕获
+	if rule, ok := c.TransitMap[host]; ok && !isHostPattern(host) {
+		return host, rule, captures, true
+	}
+	for _, pattern := range c.wildcards {
+		if strings.HasSuffix(host, pattern.suffix) && len(host) > len(pattern.suffix) {
+			captures["1"] = strings.TrimSuffix(host, pattern.suffix)
+			return pattern.key, c.TransitMap[pattern.key], captures, true
+		}
+	}
+	for _, pattern := range c.regexes {
+		if match := pattern.re.FindStringSubmatch(host); match != nil {
+			for i, name := range pattern.re.SubexpNames()[1:] {
+				captures[strconv.Itoa(i+1)] = match[i+1]
+				if name != "" {
+					captures[name] = match[i+1]
+				}
+			}
+			return pattern.key, c.TransitMap[pattern.key], captures, true
+		}
+	}
+	if rule, ok := c.TransitMap["*"]; ok {
+		return "*", rule, captures, true
+	}
+	return "", TransitRule{}, nil, false
+}
+
+// backend_prefix和headers的set、extra中引用域名捕获部分的占位符，如{host.1}、{host.tenant}
+var hostCapturePattern = regexp.MustCompile(`\{host\.(\w+)\}`)
+
+// 检查规则中的占位符是否都能由key捕获
+func checkHostCaptures(rule TransitRule, captures []string) error {
+	templates := []string{rule.BackendPrefix}
+	for _, route := range rule.Routes {
+		templates = append(templates, route.BackendPrefix)
+	}
+	for _, value := range rule.Headers.Set {
+		templates = append(templates, value)
+	}
+	for _, value := range rule.Headers.Extra {
+		templates = append(templates, value)
+	}
+	for _, template := range templates {
+		for _, match := range hostCapturePattern.FindAllStringSubmatch(template, -1) {
+			found := false
+			for _, name := range captures {
+				found = found || name == match[1]
+			}
+			if !found {
+				return fmt.Errorf("%s 引用了规则key中不存在的捕获", match[0])
+			}
+		}
+	}
+	return nil
+}
+
+// 替换到后端路径和Header中的捕获部分只能包含字母、数字和-且不能为空，{host.0}为整个域名，额外允许.
+var (
+	hostLabelPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+	hostNamePattern  = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+)
+
+// 将backend_prefix和headers的set、extra中的{host.*}替换为域名中捕获的部分，在选定路由之后执行；
+// 引用的捕获包含其他字符时返回错误，防止客户端通过Host改写后端路径或注入Header
+func (r TransitRule) expandHostCaptures(captures map[string]string) (TransitRule, error) {
+	var invalid error
+	expand := func(template string) string {
+		if !strings.Contains(template, "{host.") {
+			return template
+		}
+		return hostCapturePattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+			name := hostCapturePattern.FindStringSubmatch(placeholder)[1]
+			value, ok := captures[name]
+			if !ok {
+				if invalid == nil {
+					invalid = fmt.Errorf("域名中没有 %s 对应的捕获", placeholder)
+				}
+				return placeholder
+			}
+			pattern := hostLabelPattern
+			if name == "0" {
+				pattern = hostNamePattern
+			}
+			if !pattern.MatchString(value) && invalid == nil {
+				invalid = fmt.Errorf("域名中捕获的 %s 包含无效字符: %q", placeholder, value)
+			}
+			return value
+		})
+	}
+	r.BackendPrefix = expand(r.BackendPrefix)
+	r.Headers.Set = expandValues(r.Headers.Set, expand)
+	r.Headers.Extra = expandValues(r.Headers.Extra, expand)
+	return r, invalid
+}
+
+// 有值需要替换时返回替换后的副本，规则中的map由所有请求共享，不能原地修改
+func expandValues(values map[string]string, expand func(string) string) map[string]string {
+	for _, value := range values {
+		if expand(value) != value {
+			expanded := make(map[string]string, len(values))
+			for key, value := range values {
+				expanded[key] = expand(value)
+			}
+			return expanded
+		}
+	}
+	return values
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// 通配符和正则规则捕获的租户名替换到backend_prefix和转发的Header中
+func TestHostCaptureSubstitution(t *testing.T) {
+	var gotPath, gotTenant string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotTenant = r.URL.Path, r.Header.Get("X-Tenant")
+	}))
+	defer backend.Close()
+
+	config := mustParseConfig(t, strings.ReplaceAll(`{
+		"transit_map": {
+			"*.api.example.com": {
+				"backend_base": "BACKEND",
+				"backend_prefix": "/{host.1}",
+				"headers": {"set": {"X-Tenant": "{host.1}"}}
+			},
+			"~^(?P<tenant>[a-z0-9]+)-(eu|us)\\.example\\.org$": {
+				"backend_base": "BACKEND",
+				"backend_prefix": "/{host.2}/{host.tenant}",
+				"headers": {"extra": {"X-Tenant": "{host.tenant}@{host.0}"}}
+			}
+		}
+	}`, "BACKEND", backend.URL))
+	handler := NewProxyHandler(config)
+	defer handler.Close()
+
+	cases := []struct {
+		host, wantPath, wantTenant string
+	}{
+		{"tenant1.api.example.com", "/tenant1/users", "tenant1"},
+		{"tenant2.api.example.com:8080", "/tenant2/users", "tenant2"},
+		{"acme-eu.example.org", "/eu/acme/users", "acme@acme-eu.example.org"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://"+c.host+"/users", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: 状态 %d: %s", c.host, rec.Code, rec.Body)
+		}
+		if gotPath != c.wantPath || gotTenant != c.wantTenant {
+			t.Errorf("%s: 后端收到路径 %q X-Tenant %q, 期望 %q %q", c.host, gotPath, gotTenant, c.wantPath, c.wantTenant)
+		}
+	}
+
+	// 规则中的Header模板不能被请求改写
+	if set := config.TransitMap["*.api.example.com"].Headers.Set["X-Tenant"]; set != "{host.1}" {
+		t.Errorf("规则的headers.set被修改为 %q", set)
+	}
+}
+
+func TestHostCaptureUnknownReference(t *testing.T) {
+	for _, data := range []string{
+		`{"transit_map": {"api.example.com": {"backend_base": "http://127.0.0.1:9", "backend_prefix": "/{host.1}"}}}`,
+		`{"transit_map": {"*.example.com": {"backend_base": "http://127.0.0.1:9", "headers": {"set": {"X-Tenant": "{host.2}"}}}}}`,
+		`{"transit_map": {"~^(a)\\.example\\.com$": {"backend_base": "http://127.0.0.1:9", "routes": [{"prefix": "/x", "backend_base": "http://127.0.0.1:9", "backend_prefix": "/{host.tenant}"}]}}}`,
+	} {
+		if _, err := ParseConfig([]byte(data)); err == nil {
+			t.Errorf("未拒绝引用不存在捕获的配置: %s", data)
+		}
+	}
+}
+
+// 引用的捕获包含字母、数字和-以外的字符时返回400，不转发给后端
+func TestHostCaptureRejectsHostileHost(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer backend.Close()
+
+	handler := newTestProxy(t, backend, `{"transit_map": {
+		"*.api.example.com": {"backend_base": "BACKEND", "backend_prefix": "/{host.1}"},
+		"*.static.example.com": {"backend_base": "BACKEND"},
+		"~^(?P<tenant>.+)\\.example\\.org$": {"backend_base": "BACKEND", "headers": {"set": {"X-Tenant": "{host.tenant}", "X-Host": "{host.0}"}}},
+		"~^(?P<tenant>[a-z]*)\\.example\\.net$": {"backend_base": "BACKEND", "backend_prefix": "/{host.tenant}"}
+	}}`)
+	cases := []struct {
+		name string
+		host string
+		want int
+	}{
+		{"正常租户名", "tenant-1.api.example.com", http.StatusOK},
+		{"包含.的捕获", "a.b.api.example.com", http.StatusBadRequest},
+		{"编码的路径分隔符", "x%2F..%2Fadmin.api.example.com", http.StatusBadRequest},
+		{"下划线", "a_b.api.example.com", http.StatusBadRequest},
+		{"Header中的特殊字符", "a;b=c.example.org", http.StatusBadRequest},
+		{"正则捕获正常", "acme.example.org", http.StatusOK},
+		{"未引用捕获的规则不校验", "a_b.static.example.com", http.StatusOK},
+		{"字面的通配符key", "*.api.example.com", http.StatusBadRequest},
+		{"字面的正则key", "~^(?P<tenant>.+)\\.example\\.org$", http.StatusNotFound},
+		{"空的捕获", ".example.net", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		before := hits.Load()
+		req := httptest.NewRequest(http.MethodGet, "http://placeholder/users", nil)
+		req.Host = c.host
+		rec := serveProxy(handler, req)
+		if rec.Code != c.want {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, rec.Code, c.want)
+		}
+		if forwarded := hits.Load() != before; forwarded != (c.want == http.StatusOK) {
+			t.Errorf("%s: 是否转发到后端 %v", c.name, forwarded)
+		}
+	}
+}
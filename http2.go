@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// 为https后端启用可配置的HTTP/2传输，设置仅在ALPN协商为h2时生效
+func configureHTTP2(transport *http.Transport, config HTTP2Config) (*http2.Transport, error) {
+	t2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		return nil, err
+	}
+	t2.MaxReadFrameSize = config.MaxReadFrameSize
+	t2.MaxDecoderHeaderTableSize = config.MaxDecoderHeaderTableSize
+	t2.MaxEncoderHeaderTableSize = config.MaxEncoderHeaderTableSize
+	t2.MaxHeaderListSize = config.MaxHeaderListSize
+	t2.StrictMaxConcurrentStreams = config.StrictMaxConcurrentStreams
+	t2.ReadIdleTimeout = time.Duration(config.ReadIdleTimeout)
+	t2.PingTimeout = time.Duration(config.PingTimeout)
+	return t2, nil
+}
+
+func (c *HTTP2Config) validate() error {
+	if c.MaxReadFrameSize != 0 && (c.MaxReadFrameSize < 1<<14 || c.MaxReadFrameSize > 1<<24-1) {
+		return fmt.Errorf("max_read_frame_size必须在16384到16777215之间")
+	}
+	if c.MaxDecoderHeaderTableSize > 1<<20 || c.MaxEncoderHeaderTableSize > 1<<20 {
+		return fmt.Errorf("HPACK动态表大小不能超过1MB")
+	}
+	if c.ReadIdleTimeout < 0 || c.PingTimeout < 0 {
+		return fmt.Errorf("read_idle_timeout和ping_timeout不能小于0")
+	}
+	return nil
+}
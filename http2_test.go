@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 规则的http2配置设置到对应后端连接池的HTTP/2传输上
+func TestConfigureHTTP2(t *testing.T) {
+	config := mustParseConfig(t, `{"transit_map": {
+		"a.test": {"backend_base": "https://h2.test", "http2": {
+			"max_read_frame_size": 65536,
+			"max_decoder_header_table_size": 8192,
+			"max_encoder_header_table_size": 2048,
+			"max_header_list_size": 32768,
+			"strict_max_concurrent_streams": true,
+			"read_idle_timeout": "30s",
+			"ping_timeout": "5s"
+		}},
+		"b.test": {"backend_base": "https://h1.test"}
+	}}`)
+	handler := NewProxyHandler(config)
+	defer handler.Close()
+	state := handler.state.Load()
+
+	cases := []struct {
+		domain string
+		h2     bool
+	}{
+		{"h2.test", true},
+		{"h1.test", false},
+	}
+	for _, c := range cases {
+		transport := state.clients[c.domain].Transport.(*http.Transport)
+		if _, ok := transport.TLSNextProto["h2"]; ok != c.h2 {
+			t.Errorf("%s: 连接池配置了HTTP/2: %t, 期望 %t", c.domain, ok, c.h2)
+		}
+	}
+
+	t2, err := configureHTTP2(&http.Transport{}, *config.TransitMap["a.test"].HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t2.MaxReadFrameSize != 65536 || t2.MaxDecoderHeaderTableSize != 8192 || t2.MaxEncoderHeaderTableSize != 2048 || t2.MaxHeaderListSize != 32768 ||
+		!t2.StrictMaxConcurrentStreams || t2.ReadIdleTimeout != 30*time.Second || t2.PingTimeout != 5*time.Second {
+		t.Errorf("HTTP/2传输参数: %+v", t2)
+	}
+}
+
+func TestHTTP2ConfigValidate(t *testing.T) {
+	cases := []struct {
+		config string
+		valid  bool
+	}{
+		{`{"max_read_frame_size": 16384}`, true},
+		{`{"max_read_frame_size": 16777215}`, true},
+		{`{"max_read_frame_size": 1024}`, false},
+		{`{"max_read_frame_size": 16777216}`, false},
+		{`{"max_decoder_header_table_size": 2097152}`, false},
+		{`{"max_encoder_header_table_size": 2097152}`, false},
+		{`{"read_idle_timeout": "-1s"}`, false},
+		{`{"ping_timeout": "-1s"}`, false},
+	}
+	for _, c := range cases {
+		_, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend_base": "https://b.test", "http2": ` + c.config + `}}}`))
+		if (err == nil) != c.valid {
+			t.Errorf("%s: %v, 期望有效: %t", c.config, err, c.valid)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// 解析后端域名，默认使用系统解析，规则配置resolve时使用DNSResolver
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// 按后端解析出的IP限制连接数，域名解析到多个IP时轮流使用未达上限的IP
+type IPConnLimiter struct {
+	limit    int
+	dialer   *net.Dialer
+	resolver ipResolver
+
+	mu       sync.Mutex
+	conns    map[string]int
+	next     int
+	released chan struct{} // 有连接关闭时close，唤醒等待的拨号
+}
+
+func NewIPConnLimiter(limit int, dialer *net.Dialer, resolver ipResolver) *IPConnLimiter {
+	return &IPConnLimiter{
+		limit:    limit,
+		dialer:   dialer,
+		resolver: resolver,
+		conns:    make(map[string]int),
+		released: make(chan struct{}),
+	}
+}
+
+// 所有IP的连接数都达到上限时排队等待，直到有连接关闭或请求取消
+func (l *IPConnLimiter) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := l.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		ip, released := l.acquire(addrs)
+		if ip != "" {
+			conn, err := l.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err != nil {
+				l.release(ip)
+				return nil, err
+			}
+			return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// 选择一个未达上限的IP并占用名额，没有可用IP时返回等待用的channel
+func (l *IPConnLimiter) acquire(addrs []net.IPAddr) (string, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	start := l.next
+	l.next++
+	for i := range addrs {
+		ip := addrs[(start+i)%len(addrs)].IP.String()
+		if l.conns[ip] < l.limit {
+			l.conns[ip]++
+			return ip, nil
+		}
+	}
+	return "", l.released
+}
+
+func (l *IPConnLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// max_conns_per_ip限制到每个后端IP的连接数，超出的请求排队等待连接释放
+func TestMaxConnsPerIP(t *testing.T) {
+	cases := []struct {
+		name  string
+		limit int
+		want  int32 // 期望的最大并发连接数
+	}{
+		{"限制2个连接", 2, 2},
+		{"不限制", 0, 6},
+	}
+	for _, c := range cases {
+		var conns, peak atomic.Int32
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+		}))
+		backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				if n := conns.Add(1); n > peak.Load() {
+					peak.Store(n)
+				}
+			case http.StateClosed, http.StateHijacked:
+				conns.Add(-1)
+			}
+		}
+		backend.Start()
+		defer backend.Close()
+
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "max_conns_per_ip": `+strconv.Itoa(c.limit)+`}}}`)
+		var wg sync.WaitGroup
+		var failed atomic.Int32
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil)); rec.Code != http.StatusOK {
+					failed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if failed.Load() != 0 || peak.Load() != c.want {
+			t.Errorf("%s: 失败 %d 个请求, 最大并发连接数 %d, 期望 %d", c.name, failed.Load(), peak.Load(), c.want)
+		}
+	}
+}
+
+// 所有IP都达到上限时排队等待，连接关闭后释放名额，请求取消时返回
+func TestIPConnLimiterWait(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	limiter := NewIPConnLimiter(1, &net.Dialer{}, net.DefaultResolver)
+	first, err := limiter.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.DialContext(ctx, "tcp", listener.Addr().String()); err != context.DeadlineExceeded {
+		t.Errorf("达到上限时的拨号: %v, 期望等待至超时", err)
+	}
+
+	time.AfterFunc(20*time.Millisecond, func() { first.Close() })
+	second, err := limiter.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("连接释放后拨号失败: %v", err)
+	}
+	second.Close()
+}
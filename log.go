@@ -73,3 +73,17 @@ func SetLogger(level string, file string) (string, string) {
 	log = zap.New(core).Sugar()
 	return level, file
 }
+
+// 应用日志配置，只在启动时调用一次：替换全局logger与处理中的请求并发不安全，
+// 重复调用还会重复打开日志文件，因此重新加载配置时日志设置不生效
+func ApplyLogConfig(config LogConfig) {
+	if config.Level == "" && config.File == "" {
+		return
+	}
+	level, file := SetLogger(config.Level, config.File)
+	if file == "" {
+		log.Infof("日志级别设置为: %s", level)
+	} else {
+		log.Infof("日志级别设置为: %s, 日志文件设置为: %s", level, file)
+	}
+}
@@ -1,43 +1,121 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
+// 退出时等待进行中的请求完成的最长时间
+const shutdownTimeout = 30 * time.Second
+
 func main() {
-	var configFile = flag.String("config", "config.json", "配置文件路径")
+	var configFile = flag.String("config", "config.json", "配置文件路径或http(s)地址")
 	flag.Parse()
 
-	config, err := LoadConfig(*configFile)
+	var config *Config
+	var err error
+	var watcher *RemoteConfigWatcher
+	if isRemoteConfig(*configFile) {
+		watcher = NewRemoteConfigWatcher(*configFile)
+		config, err = watcher.Load()
+	} else {
+		config, err = LoadConfig(*configFile)
+	}
 	if err != nil {
 		log.Fatalf("加载配置失败: %v", err)
 	}
+	ApplyLogConfig(config.Log)
+
+	scheme := "http"
+	if config.Server.TLS != nil || config.Server.ACME != nil {
+		scheme = "https"
+	}
 
 	// 根据public配置决定绑定地址
 	var addr string
 	if config.Server.Public {
 		addr = fmt.Sprintf(":%d", config.Server.Port)
-		log.Infof("服务器地址监听: 0.0.0.0:%d", config.Server.Port)
+		log.Infof("服务器地址监听: %s://0.0.0.0:%d", scheme, config.Server.Port)
 	} else {
 		addr = fmt.Sprintf("127.0.0.1:%d", config.Server.Port)
-		log.Infof("服务器地址监听: 127.0.0.1:%d", config.Server.Port)
+		log.Infof("服务器地址监听: %s://127.0.0.1:%d", scheme, config.Server.Port)
 	}
 
-	server := &http.Server{Addr: addr, Handler: NewProxyHandler(config)}
+	handler := NewProxyHandler(config)
+	server := &http.Server{Addr: addr, Handler: handler}
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if t := config.Server.TLS; t != nil {
+			err = server.ListenAndServeTLS(t.CertFile, t.KeyFile)
+		} else if acme := config.Server.ACME; acme != nil {
+			manager := newCertManager(acme, handler)
+			if acme.HTTPChallenge {
+				go serveHTTPChallenge(manager)
+			}
+			server.TLSConfig = manager.TLSConfig()
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("服务器启动失败: %v", err)
 		}
 	}()
 
+	if config.Admin != nil {
+		adminAddr := fmt.Sprintf("127.0.0.1:%d", config.Admin.Port)
+		if config.Admin.Public {
+			adminAddr = fmt.Sprintf(":%d", config.Admin.Port)
+		}
+		log.Infof("管理接口地址监听: %s", adminAddr)
+		go func() {
+			if err := http.ListenAndServe(adminAddr, NewAdminHandler(handler)); err != nil {
+				log.Fatalf("管理接口启动失败: %v", err)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	if watcher != nil {
+		go watcher.Run(handler, stop)
+	}
+
+	// 收到SIGHUP时重新读取本地配置文件，新配置无效时保留当前配置
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if watcher != nil {
+				log.Infof("远程配置按remote_config.poll_interval更新, 忽略SIGHUP")
+				continue
+			}
+			newConfig, err := LoadConfig(*configFile)
+			if err != nil {
+				log.Warnf("重新加载配置失败: %v, 继续使用当前配置", err)
+				continue
+			}
+			handler.Reload(newConfig)
+			log.Infof("配置已重新加载: %s", *configFile)
+		}
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
+	close(stop)
 
+	// 先停止接受新请求并等待进行中的请求完成，之后再关闭审计和trace的写入
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("等待进行中的请求完成失败: %v", err)
+	}
+	cancel()
+	handler.Close()
 	log.Info("服务器关闭")
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 请求耗时直方图的分桶上限（秒）
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 直方图分桶中最近一次带trace的观测，OpenMetrics格式输出时作为exemplar
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+type hostMetrics struct {
+	requests      map[string]int64 // 按状态码类别（2xx等）计数
+	buckets       []int64          // 与latencyBuckets对应，不累加
+	exemplars     []*exemplar      // 与latencyBuckets对应，最后一个为+Inf
+	latencySum    float64
+	latencyCount  int64
+	requestBytes  int64
+	responseBytes int64
+}
+
+type connMetrics struct {
+	newConns    int64
+	reusedConns int64
+}
+
+// 按转发域名和后端域名汇总的运行指标，保存在ProxyHandler上，配置重新加载后保持不变
+type Metrics struct {
+	mu    sync.Mutex
+	hosts map[string]*hostMetrics
+	conns map[string]*connMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{hosts: make(map[string]*hostMetrics), conns: make(map[string]*connMetrics)}
+}
+
+// 记录一次请求，status为写给客户端的状态码，traceID为本次转发的span的trace ID，未采样时为空
+func (m *Metrics) ObserveRequest(host string, status int, elapsed time.Duration, requestBytes, responseBytes int64, traceID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.hosts[host]
+	if !ok {
+		h = &hostMetrics{requests: make(map[string]int64), buckets: make([]int64, len(latencyBuckets)), exemplars: make([]*exemplar, len(latencyBuckets)+1)}
+		m.hosts[host] = h
+	}
+	h.requests[fmt.Sprintf("%dxx", status/100)]++
+	seconds := elapsed.Seconds()
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+			bucket = i
+			break
+		}
+	}
+	if traceID != "" {
+		h.exemplars[bucket] = &exemplar{traceID: traceID, value: seconds, time: time.Now()}
+	}
+	h.latencySum += seconds
+	h.latencyCount++
+	h.requestBytes += requestBytes
+	h.responseBytes += responseBytes
+}
+
+// 记录一次发往后端的请求使用的是新建还是复用的连接
+func (m *Metrics) ObserveConn(domain string, reused bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.conns[domain]
+	if !ok {
+		c = &connMetrics{}
+		m.conns[domain] = c
+	}
+	if reused {
+		c.reusedConns++
+	} else {
+		c.newConns++
+	}
+}
+
+// 按Prometheus文本格式输出，pools为当前的连接池数量；openMetrics为true时按OpenMetrics格式输出，
+// 请求耗时直方图的分桶附带exemplar
+func (m *Metrics) WriteTo(w io.Writer, pools int, openMetrics bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hosts := make([]string, 0, len(m.hosts))
+	for host := range m.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	domains := make([]string, 0, len(m.conns))
+	for domain := range m.conns {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	writeCounterHeader(w, "http_transit_requests_total", "转发的请求数", openMetrics)
+	for _, host := range hosts {
+		classes := make([]string, 0, len(m.hosts[host].requests))
+		for class := range m.hosts[host].requests {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(w, "http_transit_requests_total{host=%s,code=%q} %d\n", promLabel(host), class, m.hosts[host].requests[class])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP http_transit_request_duration_seconds 请求处理耗时")
+	fmt.Fprintln(w, "# TYPE http_transit_request_duration_seconds histogram")
+	for _, host := range hosts {
+		h := m.hosts[host]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "http_transit_request_duration_seconds_bucket{host=%s,le=\"%g\"} %d%s\n", promLabel(host), bound, cumulative, h.exemplar(i, openMetrics))
+		}
+		fmt.Fprintf(w, "http_transit_request_duration_seconds_bucket{host=%s,le=\"+Inf\"} %d%s\n", promLabel(host), h.latencyCount, h.exemplar(len(latencyBuckets), openMetrics))
+		fmt.Fprintf(w, "http_transit_request_duration_seconds_sum{host=%s} %g\n", promLabel(host), h.latencySum)
+		fmt.Fprintf(w, "http_transit_request_duration_seconds_count{host=%s} %d\n", promLabel(host), h.latencyCount)
+	}
+
+	writeCounterHeader(w, "http_transit_request_bytes_total", "从客户端读取的请求体字节数", openMetrics)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "http_transit_request_bytes_total{host=%s} %d\n", promLabel(host), m.hosts[host].requestBytes)
+	}
+	writeCounterHeader(w, "http_transit_response_bytes_total", "写给客户端的响应体字节数", openMetrics)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "http_transit_response_bytes_total{host=%s} %d\n", promLabel(host), m.hosts[host].responseBytes)
+	}
+
+	writeCounterHeader(w, "http_transit_backend_connections_total", "发往后端的请求使用的连接，reused区分新建和复用", openMetrics)
+	for _, domain := range domains {
+		c := m.conns[domain]
+		fmt.Fprintf(w, "http_transit_backend_connections_total{domain=%s,reused=\"false\"} %d\n", promLabel(domain), c.newConns)
+		fmt.Fprintf(w, "http_transit_backend_connections_total{domain=%s,reused=\"true\"} %d\n", promLabel(domain), c.reusedConns)
+	}
+
+	fmt.Fprintln(w, "# HELP http_transit_connection_pools 按后端域名创建的连接池数量")
+	fmt.Fprintln(w, "# TYPE http_transit_connection_pools gauge")
+	fmt.Fprintf(w, "http_transit_connection_pools %d\n", pools)
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
+
+// OpenMetrics中counter的HELP和TYPE使用不带_total后缀的名称
+func writeCounterHeader(w io.Writer, name, help string, openMetrics bool) {
+	if openMetrics {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+}
+
+func (h *hostMetrics) exemplar(bucket int, openMetrics bool) string {
+	e := h.exemplars[bucket]
+	if !openMetrics || e == nil {
+		return ""
+	}
+	return fmt.Sprintf(" # {trace_id=%q} %g %.3f", e.traceID, e.value, float64(e.time.UnixMilli())/1000)
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(value string) string {
+	return `"` + promLabelEscaper.Replace(value) + `"`
+}
+
+// 统计从客户端读取的请求体字节数
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Accept中带有application/openmetrics-text时按OpenMetrics格式输出，以便Prometheus采集exemplar
+func (p *ProxyHandler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	p.metrics.WriteTo(w, len(p.state.Load().clients), openMetrics)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExemplars(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveRequest("a.test", 200, 30*time.Millisecond, 0, 0, "4bf92f3577b34da6a3ce929d0e0e4736")
+	m.ObserveRequest("a.test", 200, 3*time.Millisecond, 0, 0, "")
+	m.ObserveRequest("a.test", 500, 20*time.Second, 0, 0, "00f067aa0ba902b700f067aa0ba902b7")
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf, 1, true)
+	out := buf.String()
+	for _, want := range []string{
+		`http_transit_request_duration_seconds_bucket{host="a.test",le="0.05"} 2 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.03 `,
+		`http_transit_request_duration_seconds_bucket{host="a.test",le="+Inf"} 3 # {trace_id="00f067aa0ba902b700f067aa0ba902b7"} 20 `,
+		`http_transit_request_duration_seconds_bucket{host="a.test",le="0.005"} 1` + "\n",
+		"# TYPE http_transit_requests counter\n",
+		"\n# EOF\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("OpenMetrics输出缺少 %q:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	m.WriteTo(&buf, 1, false)
+	if out := buf.String(); strings.Contains(out, "trace_id") || strings.Contains(out, "# EOF") || !strings.Contains(out, "# TYPE http_transit_requests_total counter") {
+		t.Errorf("Prometheus文本格式不应包含exemplar:\n%s", out)
+	}
+}
+
+// 采样的请求在耗时直方图中记录其span的trace ID
+func TestProxyRecordsExemplarTraceID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	handler := NewProxyHandler(mustParseConfig(t, `{
+		"tracing": {"endpoint": "http://127.0.0.1:9/v1/traces", "rate": 1},
+		"transit_map": {"a.test": {"backend_base": "`+backend.URL+`"}}
+	}`))
+	defer handler.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	handler.serveMetrics(rec, req)
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/openmetrics-text") {
+		t.Errorf("Content-Type: %s", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`) {
+		t.Errorf("耗时直方图未记录trace ID:\n%s", rec.Body)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// 按mirror.rate将请求异步复制到mirror后端，副本请求不影响客户端：响应被丢弃，
+// 失败只记录debug日志，超出max_rate或同时进行的副本请求达到max_inflight时丢弃新的副本
+func (p *ProxyHandler) mirror(state *transitState, r *http.Request, method string, headers http.Header, body []byte, rule TransitRule) {
+	config := rule.Mirror
+	if config.Rate < 1 && rand.Float64() >= config.Rate {
+		return
+	}
+	if !config.allow() {
+		config.drop(r, "超出max_rate")
+		return
+	}
+	mirrorURL, err := p.buildTransitBackendURL(config.BackendBase, rule, r)
+	if err != nil {
+		log.Debugf("%s %s%s | 构建镜像后端URL失败: %v", r.Method, r.Host, r.URL.Path, err)
+		return
+	}
+	select {
+	case config.slots <- struct{}{}:
+	default:
+		config.drop(r, "镜像请求过多")
+		return
+	}
+
+	// 与客户端请求的生命周期分离，客户端断开或响应完成后副本请求继续进行
+	headers = headers.Clone()
+	client := p.getClientForDomain(state, mirrorURL)
+	go func() {
+		defer func() { <-config.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout))
+		defer cancel()
+
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, method, mirrorURL, bytes.NewReader(body))
+		if err != nil {
+			log.Debugf("%s %s | 创建镜像请求失败: %v", method, mirrorURL, err)
+			return
+		}
+		req.Header = headers
+		setRequestHost(req, headers, rule)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Debugf("%s %s | 镜像请求失败: %v", method, mirrorURL, err)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		log.Debugf("%s %s | 镜像请求耗时: %v | 状态: %d", method, mirrorURL, time.Since(start), resp.StatusCode)
+	}()
+}
+
+// 从max_rate的令牌桶取一个令牌，未配置max_rate时总是允许
+func (c *MirrorConfig) allow() bool {
+	if c.MaxRate <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	burst := math.Max(1, c.MaxRate)
+	now := time.Now()
+	if c.bucket.last.IsZero() {
+		c.bucket.tokens = burst
+	} else {
+		c.bucket.tokens = math.Min(burst, c.bucket.tokens+now.Sub(c.bucket.last).Seconds()*c.MaxRate)
+	}
+	c.bucket.last = now
+	if c.bucket.tokens < 1 {
+		return false
+	}
+	c.bucket.tokens--
+	return true
+}
+
+// 记录丢弃的副本，每丢弃1000个记录一次warn日志
+func (c *MirrorConfig) drop(r *http.Request, reason string) {
+	log.Debugf("%s %s%s | %s, 丢弃副本", r.Method, r.Host, r.URL.Path, reason)
+	if dropped := c.dropped.Add(1); dropped%1000 == 1 {
+		log.Warnf("镜像 %s 丢弃副本请求, 累计: %d", c.BackendBase, dropped)
+	}
+}
+
+// 累计丢弃的副本请求数，配置重新加载后重新计数
+func (c *MirrorConfig) Dropped() int64 {
+	return c.dropped.Load()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// max_rate和max_inflight限制复制的请求数，超出的副本被丢弃并计数，客户端请求不受影响
+func TestMirrorLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	cases := []struct {
+		name        string
+		mirror      string
+		block       bool
+		wantMirrors int64
+	}{
+		{"不限制", `{"backend_base": "MIRROR"}`, false, 20},
+		{"max_rate", `{"backend_base": "MIRROR", "max_rate": 5}`, false, 5},
+		{"max_inflight", `{"backend_base": "MIRROR", "max_inflight": 1}`, true, 1},
+	}
+	for _, c := range cases {
+		var mirrors atomic.Int64
+		release := make(chan struct{})
+		mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mirrors.Add(1)
+			if c.block {
+				<-release
+			}
+		}))
+		config := `{"transit_map": {"a.example.com": {"backend_base": "BACKEND", "mirror": ` + strings.ReplaceAll(c.mirror, "MIRROR", mirror.URL) + `}}}`
+		handler := newTestProxy(t, backend, config)
+		rule := handler.state.Load().config.TransitMap["a.example.com"]
+
+		for i := 0; i < 20; i++ {
+			if c.block && i == 1 {
+				// 等待第一个副本到达镜像后端，之后的副本都超出max_inflight
+				waitMirrors(t, &mirrors, 1)
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://a.example.com/x", nil)
+			if rec := serveProxy(handler, req); rec.Code != http.StatusOK {
+				t.Errorf("%s: 状态 %d, 期望 200", c.name, rec.Code)
+			}
+		}
+		waitMirrors(t, &mirrors, c.wantMirrors)
+		close(release)
+		mirror.Close()
+
+		// max_rate允许1秒的突发，测试期间补充的令牌最多多复制1个
+		if got := mirrors.Load(); got < c.wantMirrors || got > c.wantMirrors+1 {
+			t.Errorf("%s: 复制 %d 个请求, 期望 %d", c.name, got, c.wantMirrors)
+		}
+		if got := rule.Mirror.Dropped(); got != 20-mirrors.Load() {
+			t.Errorf("%s: 丢弃 %d 个副本, 期望 %d", c.name, got, 20-mirrors.Load())
+		}
+	}
+}
+
+// 等待镜像后端收到至少n个副本
+func waitMirrors(t *testing.T, mirrors *atomic.Int64, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for mirrors.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("镜像后端收到 %d 个副本, 期望至少 %d", mirrors.Load(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -2,12 +2,26 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -21,12 +35,44 @@ type ProxyTrace struct {
 	Method     string
 	StatusCode int
 	Error      error
+	Rule       string         // 匹配的转发规则key
+	Attempts   []AttemptTrace // 开启retry.max_attempts时每次尝试的结果
 
 	RequestHeaders  http.Header
 	TransitHeaders  http.Header
 	ResponseHeaders http.Header
 	RequestBody     []byte
 	ResponseBody    []byte
+
+	ResponseTrailers http.Header // 后端在响应体之后发送的Trailer，仅在规则开启forward_trailers时记录
+
+	TLS *tls.ConnectionState // 与后端的TLS连接信息，仅在规则开启log_tls时记录
+
+	WireSize    int64 // 后端响应体的传输大小（压缩后），仅在规则开启decompressed_size时记录
+	DecodedSize int64 // 后端响应体解压后的大小
+
+	DNS *DNSTrace // 后端域名的解析过程，复用连接或后端为IP地址时为空
+
+	RemoteAddr string // 本次请求使用的后端连接地址（IP:端口）
+}
+
+type DNSTrace struct {
+	Host     string
+	Duration time.Duration
+	Addrs    []string
+	Err      error
+}
+
+// 文本类型的请求/响应体原样输出，其他类型只输出类型和大小
+func bodyString(contentType string, body []byte) string {
+	if strings.Contains(strings.ToLower(contentType), "application/json") ||
+		strings.Contains(strings.ToLower(contentType), "application/x-www-form-urlencoded") ||
+		strings.Contains(strings.ToLower(contentType), "text/") {
+		return string(body)
+	} else if contentType != "" && len(body) > 0 {
+		return fmt.Sprintf("[%s %s]", contentType, humanize.IBytes(uint64(len(body))))
+	}
+	return ""
 }
 
 func (p *ProxyTrace) String() string {
@@ -44,14 +90,7 @@ func (p *ProxyTrace) String() string {
 	sort.Strings(trsHeaders)
 	trsHeaderString := strings.Join(trsHeaders, "; ")
 
-	reqBodyString, reqContentType := "", p.RequestHeaders.Get("Content-Type")
-	if strings.Contains(strings.ToLower(reqContentType), "application/json") ||
-		strings.Contains(strings.ToLower(reqContentType), "application/x-www-form-urlencoded") ||
-		strings.Contains(strings.ToLower(reqContentType), "text/") {
-		reqBodyString = string(p.RequestBody)
-	} else if reqContentType != "" && len(p.RequestBody) > 0 {
-		reqBodyString = fmt.Sprintf("[%s %s]", reqContentType, humanize.IBytes(uint64(len(p.RequestBody))))
-	}
+	reqBodyString := bodyString(p.RequestHeaders.Get("Content-Type"), p.RequestBody)
 
 	rspHeaders := make([]string, 0, len(p.ResponseHeaders))
 	for key, values := range p.ResponseHeaders {
@@ -60,17 +99,27 @@ func (p *ProxyTrace) String() string {
 	sort.Strings(rspHeaders)
 	rspHeaderString := strings.Join(rspHeaders, "; ")
 
-	rspBodyString, rspContentType := "", p.ResponseHeaders.Get("Content-Type")
-	if strings.Contains(strings.ToLower(rspContentType), "application/json") ||
-		strings.Contains(strings.ToLower(rspContentType), "application/x-www-form-urlencoded") ||
-		strings.Contains(strings.ToLower(rspContentType), "text/") {
-		rspBodyString = string(p.ResponseBody)
-	} else if rspContentType != "" && len(p.ResponseBody) > 0 {
-		rspBodyString = fmt.Sprintf("[%s %s]", rspContentType, humanize.IBytes(uint64(len(p.ResponseBody))))
-	}
+	rspBodyString := bodyString(p.ResponseHeaders.Get("Content-Type"), p.ResponseBody)
 
 	builder := strings.Builder{}
 	builder.WriteString(fmt.Sprintf("%s %s -> %s | 耗时: %v | 状态: %d", p.Method, p.RequestURL, p.BackendURL, p.Duration, p.StatusCode))
+	if p.Rule != "" {
+		builder.WriteString(fmt.Sprintf(" | 规则: %s", p.Rule))
+	}
+	if p.RemoteAddr != "" {
+		builder.WriteString(fmt.Sprintf(" | 后端地址: %s", p.RemoteAddr))
+	}
+	if len(p.Attempts) > 1 {
+		attempts := make([]string, 0, len(p.Attempts))
+		for _, attempt := range p.Attempts {
+			result := strconv.Itoa(attempt.StatusCode)
+			if attempt.Error != nil {
+				result = attempt.Error.Error()
+			}
+			attempts = append(attempts, fmt.Sprintf("%v %s", attempt.Duration, result))
+		}
+		builder.WriteString(fmt.Sprintf(" | 尝试: %s", strings.Join(attempts, ", ")))
+	}
 
 	if reqHeaderString != "" {
 		builder.WriteString(fmt.Sprintf(" | 请求头: %s", reqHeaderString))
@@ -87,56 +136,312 @@ func (p *ProxyTrace) String() string {
 	if rspBodyString != "" {
 		builder.WriteString(fmt.Sprintf(" | 响应体: %s", rspBodyString))
 	}
+	if p.WireSize > 0 {
+		builder.WriteString(fmt.Sprintf(" | 响应大小: 传输 %s 解压 %s", humanize.IBytes(uint64(p.WireSize)), humanize.IBytes(uint64(p.DecodedSize))))
+	}
+	if p.TLS != nil {
+		builder.WriteString(fmt.Sprintf(" | TLS: %s %s 会话复用: %t", tls.VersionName(p.TLS.Version), tls.CipherSuiteName(p.TLS.CipherSuite), p.TLS.DidResume))
+	}
 
 	return builder.String()
 }
 
+// 与配置相关的转发状态，配置重新加载时整体替换
+type transitState struct {
+	config    *Config
+	clients   map[string]*http.Client
+	breakers  map[string]*CircuitBreaker
+	limiters  map[string]*ByteLimiter   // 共享带宽的规则使用的限速器
+	pools     map[string]poolConfig     // 各后端域名连接池使用的传输配置
+	dns       map[string]*DNSBackoff    // 按后端域名记录的解析失败状态
+	bodies    map[string]*RecentHashes  // 审计记录去重使用的最近请求体/响应体哈希
+	balancers map[string]*LoadBalancer  // 配置了load_balance的规则
+	health    map[string]*HealthChecker // 配置了health_check的规则，切换配置时停止
+	limits    map[string]*RateLimiter   // 配置了rate_limit的规则
+}
+
 type ProxyHandler struct {
-	config  *Config
-	clients map[string]*http.Client
+	state      atomic.Pointer[transitState]
+	cache      *ResponseCache
+	audit      *AuditWriter
+	tracer     *Tracer
+	blueGreen  *BlueGreenSwitch
+	ranges     *RangeCache
+	connReuse  *ConnReuseStats
+	identities *FingerprintTracker
+	geoIP      *GeoIPDatabases
+	accessLogs *AccessLogWriters
+	metrics    *Metrics
+	adminMu    sync.Mutex // 串行执行管理接口对转发规则的修改
 }
 
 func NewProxyHandler(config *Config) *ProxyHandler {
-	handler := &ProxyHandler{
-		config:  config,
-		clients: make(map[string]*http.Client),
+	handler := &ProxyHandler{cache: NewResponseCache(), ranges: NewRangeCache(), connReuse: NewConnReuseStats(), identities: NewFingerprintTracker(), blueGreen: NewBlueGreenSwitch(), geoIP: NewGeoIPDatabases(), accessLogs: NewAccessLogWriters(), metrics: NewMetrics()}
+
+	if config.Audit != nil {
+		sink, err := NewAuditSink(config.Audit)
+		if err != nil {
+			log.Errorf("创建审计写入目标失败: %v", err)
+		} else {
+			handler.audit = NewAuditWriter(sink, config.Audit.BufferSize)
+		}
+	}
+
+	if config.Tracing != nil {
+		handler.tracer = NewTracer(config.Tracing)
 	}
 
-	// 启动时为所有配置的域名创建连接池
-	handler.initializeClientPools()
+	handler.state.Store(handler.newTransitState(config, nil))
 	return handler
 }
 
-// 初始化所有域名的连接池
-func (p *ProxyHandler) initializeClientPools() {
-	for _, rule := range p.config.TransitMap {
-		if _, ok := p.clients[rule.BackendBase]; ok {
+func (p *ProxyHandler) newTransitState(config *Config, old *transitState) *transitState {
+	state := &transitState{
+		config:    config,
+		clients:   make(map[string]*http.Client),
+		breakers:  make(map[string]*CircuitBreaker),
+		limiters:  make(map[string]*ByteLimiter),
+		pools:     make(map[string]poolConfig),
+		dns:       make(map[string]*DNSBackoff),
+		bodies:    make(map[string]*RecentHashes),
+		balancers: make(map[string]*LoadBalancer),
+		health:    make(map[string]*HealthChecker),
+		limits:    make(map[string]*RateLimiter),
+	}
+
+	// 规则的某项配置未变化时沿用旧状态中的对象，保留熔断、限流、健康检查等运行时状态，
+	// 避免通过管理接口修改其他规则或重新加载配置时全部重置
+	var oldRules map[string]TransitRule
+	if old != nil {
+		oldRules = old.config.TransitMap
+	}
+	unchanged := func(host string, rule TransitRule, component func(TransitRule) interface{}) bool {
+		oldRule, ok := oldRules[host]
+		return ok && reflect.DeepEqual(component(oldRule), component(rule))
+	}
+
+	for host, rule := range config.TransitMap {
+		if rule.CircuitBreaker != nil {
+			if unchanged(host, rule, func(r TransitRule) interface{} { return r.CircuitBreaker }) && old.breakers[host] != nil {
+				state.breakers[host] = old.breakers[host]
+			} else {
+				state.breakers[host] = NewCircuitBreaker(rule.CircuitBreaker)
+			}
+		}
+		if rule.BandwidthLimit != nil && rule.BandwidthLimit.Shared {
+			if unchanged(host, rule, func(r TransitRule) interface{} { return r.BandwidthLimit }) && old.limiters[host] != nil {
+				state.limiters[host] = old.limiters[host]
+			} else {
+				state.limiters[host] = NewByteLimiter(int64(rule.BandwidthLimit.Rate))
+			}
+		}
+		if rule.LoadBalance != nil {
+			if unchanged(host, rule, func(r TransitRule) interface{} { return r.LoadBalance }) && old.balancers[host] != nil {
+				state.balancers[host] = old.balancers[host]
+			} else {
+				state.balancers[host] = NewLoadBalancer(rule.LoadBalance)
+			}
+		}
+		if rule.RateLimit != nil {
+			if unchanged(host, rule, func(r TransitRule) interface{} { return r.RateLimit }) && old.limits[host] != nil {
+				state.limits[host] = old.limits[host]
+			} else {
+				state.limits[host] = NewRateLimiter(host, rule.RateLimit)
+			}
+		}
+		if rule.Audit != nil && rule.Audit.DedupBodies > 0 {
+			if unchanged(host, rule, func(r TransitRule) interface{} { return r.Audit }) && old.bodies[host] != nil {
+				state.bodies[host] = old.bodies[host]
+			} else {
+				state.bodies[host] = NewRecentHashes(rule.Audit.DedupBodies)
+			}
+		}
+		if rule.DNSBackoff != nil {
+			for _, backend := range rule.Backends() {
+				domain := p.extractDomain(backend)
+				if state.dns[domain] != nil {
+					continue
+				}
+				if old != nil && old.dns[domain] != nil && *old.dns[domain].config == *rule.DNSBackoff {
+					state.dns[domain] = old.dns[domain]
+				} else {
+					state.dns[domain] = NewDNSBackoff(rule.DNSBackoff)
+				}
+			}
+		}
+	}
+
+	// 启动时为所有配置的域名创建连接池，重新加载时沿用旧配置中已有的连接池
+	p.initializeClientPools(state, old)
+
+	for host, rule := range config.TransitMap {
+		if rule.HealthCheck == nil {
 			continue
 		}
+		backends := []string{rule.BackendBase}
+		if rule.LoadBalance != nil {
+			backends = rule.LoadBalance.Backends
+		}
+		clients := make([]*http.Client, len(backends))
+		for i, backend := range backends {
+			clients[i] = p.getClientForDomain(state, backend)
+		}
+		// 探测配置、后端和连接池都未变化时继续使用原来的健康状态，不健康的后端不会因重新加载而恢复转发
+		if checker := oldHealth(old, host); checker != nil && unchanged(host, rule, func(r TransitRule) interface{} { return r.HealthCheck }) && checker.same(backends, clients) {
+			state.health[host] = checker
+			continue
+		}
+		state.health[host] = NewHealthChecker(host, rule.HealthCheck, backends, clients)
+	}
+	return state
+}
 
-		domain := p.extractDomain(rule.BackendBase)
+func oldHealth(old *transitState, host string) *HealthChecker {
+	if old == nil {
+		return nil
+	}
+	return old.health[host]
+}
 
-		transport := &http.Transport{
-			MaxIdleConns:        100,             // 降低全局最大空闲连接数
-			MaxIdleConnsPerHost: 20,              // 增加每个主机的最大空闲连接数
-			MaxConnsPerHost:     100,             // 增加每个主机的最大连接数
-			IdleConnTimeout:     5 * time.Minute, // 空闲连接超时时间
-			DisableCompression:  false,           // 启用压缩
+// 切换到新配置，进行中的请求继续使用旧的连接池完成
+func (p *ProxyHandler) Reload(config *Config) {
+	old := p.state.Load()
+	state := p.newTransitState(config, old)
+	p.state.Store(state)
+	for host, checker := range old.health {
+		if state.health[host] != checker {
+			checker.Close()
 		}
+	}
+	for host, limiter := range old.limits {
+		if state.limits[host] != limiter {
+			limiter.Close()
+		}
+	}
+	for domain, client := range old.clients {
+		if state.clients[domain] != client {
+			client.CloseIdleConnections()
+		}
+	}
+	p.warmup(state, old)
+	if (config.Audit == nil) != (p.audit == nil) {
+		log.Warnf("audit配置的修改需要重启后生效")
+	}
+	if (config.Tracing == nil) != (p.tracer == nil) {
+		log.Warnf("tracing配置的修改需要重启后生效")
+	}
+}
 
-		client := &http.Client{
-			Transport: transport,
-			Timeout:   600 * time.Second, // 请求超时时间
+// 释放后台资源，等待审计记录写完
+func (p *ProxyHandler) Close() {
+	for _, checker := range p.state.Load().health {
+		checker.Close()
+	}
+	for _, limiter := range p.state.Load().limits {
+		limiter.Close()
+	}
+	p.geoIP.Close()
+	p.accessLogs.Close()
+	if p.tracer != nil {
+		p.tracer.Close()
+	}
+	if p.audit != nil {
+		if err := p.audit.Close(); err != nil {
+			log.Warnf("关闭审计写入目标失败: %v", err)
 		}
+	}
+}
+
+// 决定连接池能否在配置重新加载后沿用的传输配置
+type poolConfig struct {
+	HTTP2         HTTP2Config
+	TLS           BackendTLSConfig
+	MaxConnsPerIP int
+	Timeouts      TimeoutConfig
+	Size          PoolSizeConfig
+	Resolve       string // resolve配置的字符串形式，ResolveConfig包含列表不能直接比较
+	Hosts         string // 合并后的静态解析的字符串形式
+}
+
+// 初始化所有域名的连接池
+func (p *ProxyHandler) initializeClientPools(state, old *transitState) {
+	for _, rule := range state.config.TransitMap {
+		for _, backend := range rule.Backends() {
+			domain := p.extractDomain(backend)
+			pool := poolConfig{MaxConnsPerIP: rule.MaxConnsPerIP, Timeouts: *rule.Timeouts, Size: *rule.Pool}
+			if rule.HTTP2 != nil {
+				pool.HTTP2 = *rule.HTTP2
+			}
+			if rule.TLS != nil {
+				pool.TLS = *rule.TLS
+			}
+			if rule.Resolve != nil {
+				pool.Resolve = fmt.Sprint(*rule.Resolve)
+			}
+			if len(rule.hosts) > 0 {
+				pool.Hosts = fmt.Sprint(rule.hosts)
+			}
+			if _, ok := state.clients[domain]; ok {
+				if state.pools[domain] != pool {
+					log.Warnf("后端 %s 被多个规则使用且tls、http2、max_conns_per_ip、timeouts、pool、resolve或hosts配置不一致, 只有一个配置生效", domain)
+				}
+				continue
+			}
+			state.pools[domain] = pool
+			if old != nil && old.clients[domain] != nil && old.pools[domain] == pool {
+				state.clients[domain] = old.clients[domain]
+				continue
+			}
+
+			dialer := &net.Dialer{Timeout: time.Duration(pool.Timeouts.DialTimeout), KeepAlive: 30 * time.Second}
+			var resolver ipResolver = net.DefaultResolver
+			dial := dialer.DialContext
+			if rule.Resolve != nil || len(rule.hosts) > 0 {
+				dnsResolver := NewDNSResolver(rule.Resolve, rule.hosts)
+				resolver = dnsResolver
+				dial = (&resolvingDialer{resolver: dnsResolver, dialer: dialer}).DialContext
+			}
+			transport := &http.Transport{
+				DialContext:           dial,
+				ForceAttemptHTTP2:     true,                                               // 自定义DialContext后保持与默认一致的HTTP/2协商
+				MaxIdleConns:          pool.Size.MaxIdleConns,                             // 最大空闲连接数
+				MaxIdleConnsPerHost:   pool.Size.MaxIdleConnsPerHost,                      // 每个主机的最大空闲连接数
+				MaxConnsPerHost:       pool.Size.MaxConnsPerHost,                          // 每个主机的最大连接数
+				IdleConnTimeout:       time.Duration(pool.Timeouts.IdleConnTimeout),       // 空闲连接超时时间
+				ResponseHeaderTimeout: time.Duration(pool.Timeouts.ResponseHeaderTimeout), // 等待响应头的超时时间
+				DisableCompression:    false,                                              // 启用压缩
+			}
+			if pool.MaxConnsPerIP > 0 {
+				transport.DialContext = NewIPConnLimiter(pool.MaxConnsPerIP, dialer, resolver).DialContext
+			}
+			if rule.TLS != nil {
+				tlsConfig, err := pool.TLS.clientConfig()
+				if err != nil {
+					log.Warnf("配置后端 %s 的TLS失败: %v", domain, err)
+				}
+				transport.TLSClientConfig = tlsConfig
+			}
+			if rule.HTTP2 != nil {
+				if _, err := configureHTTP2(transport, pool.HTTP2); err != nil {
+					log.Warnf("配置后端 %s 的HTTP/2失败: %v", domain, err)
+				}
+			}
 
-		p.clients[domain] = client
+			client := &http.Client{
+				Transport:     transport,
+				Timeout:       time.Duration(pool.Timeouts.RequestTimeout), // 请求超时时间
+				CheckRedirect: checkRedirect,
+			}
+
+			state.clients[domain] = client
+		}
 	}
 }
 
 // 获取域名的HTTP客户端
-func (p *ProxyHandler) getClientForDomain(backendBase string) *http.Client {
+func (p *ProxyHandler) getClientForDomain(state *transitState, backendBase string) *http.Client {
 	domain := p.extractDomain(backendBase)
-	return p.clients[domain]
+	return state.clients[domain]
 }
 
 // 从backend_base中提取域名
@@ -153,42 +458,407 @@ func (p *ProxyHandler) extractDomain(backendBase string) string {
 }
 
 func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	state := p.state.Load()
+	r = withClientAddr(r, state.config.Server.trustedProxies)
+
+	// HTTP/1.0客户端可以不携带Host，使用server.default_host匹配转发规则
+	if r.Host == "" && !r.ProtoAtLeast(1, 1) {
+		r.Host = state.config.Server.DefaultHost
+	}
 	host := r.Host
 	if idx := strings.Index(host, ":"); idx != -1 {
 		host = host[:idx]
 	}
 
-	rule, exists := p.config.TransitMap[host]
+	key, rule, captures, exists := state.config.MatchRule(host)
 	if !exists {
 		log.Infof("未找到转发规则: %s", host)
 		http.Error(w, "转发规则未找到", http.StatusNotFound)
 		return
 	}
+	// 通配符和正则规则的熔断、限速等状态由匹配的所有域名共享
+	host = key
+
+	if state.config.Server.EarlyData && rejectEarlyData(r) {
+		log.Infof("%s %s%s | 拒绝以TLS早期数据发送的非安全请求", r.Method, r.Host, r.URL.Path)
+		http.Error(w, "请在TLS握手完成后重试", http.StatusTooEarly)
+		return
+	}
+
+	rule, err := rule.matchMethod(r.Method).matchRoute(r.URL.Path).matchHeaders(r).expandHostCaptures(captures)
+	if err != nil {
+		log.Warnf("%s %s%s | %v", r.Method, r.Host, r.URL.Path, err)
+		http.Error(w, "无效的Host", http.StatusBadRequest)
+		return
+	}
+
+	if rule.MinBodyRate != nil && r.Body != nil {
+		r.Body = newSlowBodyReader(w, r.Body, rule.MinBodyRate)
+	}
+
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	defer func() {
+		var traceID string
+		if span := spanFromContext(r.Context()); span != nil {
+			traceID = hex.EncodeToString(span.traceID[:])
+		}
+		p.metrics.ObserveRequest(host, rec.Status(), time.Since(start), body.n, rec.bytes, traceID)
+		if rule.AccessLog != nil {
+			p.accessLogs.Write(rule.AccessLog, r, rec, start)
+		}
+	}()
+
+	if rule.Maintenance != nil && rule.Maintenance.Enabled {
+		if err := rule.Maintenance.Serve(w, r); err != nil {
+			log.Warnf("%s %s%s | 写入维护页面失败: %v", r.Method, r.Host, r.URL.Path, err)
+		} else {
+			log.Infof("%s %s%s | 维护模式", r.Method, r.Host, r.URL.Path)
+		}
+		return
+	}
+
+	if !rule.methodAllowed(r.Method) {
+		log.Infof("%s %s%s | 不允许的请求方法", r.Method, r.Host, r.URL.Path)
+		w.Header().Set("Allow", strings.Join(rule.AllowedMethods, ", "))
+		http.Error(w, "不允许的请求方法", http.StatusMethodNotAllowed)
+		return
+	}
 
-	targetURL, err := p.buildTransitBackendURL(rule, r)
+	if rule.RedirectTo != nil {
+		rule.RedirectTo.Serve(w, r)
+		log.Infof("%s %s%s | 重定向: %s", r.Method, r.Host, r.URL.Path, w.Header().Get("Location"))
+		return
+	}
+
+	if rule.Respond != nil {
+		if err := rule.Respond.Serve(w, r); err != nil {
+			log.Warnf("%s %s%s | 写入静态响应失败: %v", r.Method, r.Host, r.URL.Path, err)
+		}
+		return
+	}
+
+	if static := rule.matchStatic(r.URL.Path); static != nil {
+		static.Serve(w, r)
+		log.Infof("%s %s%s | 静态文件: %d", r.Method, r.Host, r.URL.Path, rec.Status())
+		return
+	}
+
+	if err := p.checkRequiredHeaders(r, rule); err != nil {
+		log.Infof("%s %s%s | %v", r.Method, r.Host, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if limiter := state.limits[host]; limiter != nil {
+		tier := limiter.Tier(r)
+		if wait, ok := limiter.AllowTier(tier, clientIP(r)); !ok {
+			log.Infof("%s %s%s | 请求频率超过限制: %s", r.Method, r.Host, r.URL.Path, clientIP(r))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "请求过于频繁", http.StatusTooManyRequests)
+			return
+		}
+		release, ok := limiter.Acquire(r.Context(), tier)
+		if !ok {
+			log.Infof("%s %s%s | 排队等待转发超时: %s", r.Method, r.Host, r.URL.Path, clientIP(r))
+			http.Error(w, "服务繁忙", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+
+	// 负载均衡选出的后端作为本次请求的backend_base，开启健康检查时跳过不健康的后端，
+	// 全部不健康时使用backup，没有backup时返回fallback_response，都没有则忽略健康状态
+	checker := state.health[host]
+	allDown := false
+	if lb := state.balancers[host]; lb != nil && rule.LoadBalance != nil {
+		var available func(string) bool
+		if checker != nil {
+			available = checker.Healthy
+		}
+		backend, release, ok := lb.Acquire(available)
+		if !ok && rule.HealthCheck.Backup == "" {
+			if allDown = checker != nil && rule.FallbackResponse != nil; !allDown {
+				backend, release, ok = lb.Acquire(nil)
+			}
+		}
+		if ok {
+			defer release()
+			rule.BackendBase = backend
+		} else {
+			rule.BackendBase = rule.HealthCheck.Backup
+		}
+	} else if checker != nil && !checker.Healthy(rule.BackendBase) {
+		if rule.HealthCheck.Backup != "" {
+			rule.BackendBase = rule.HealthCheck.Backup
+		} else {
+			allDown = rule.FallbackResponse != nil
+		}
+	}
+	if allDown {
+		log.Warnf("%s %s%s | 所有后端都不健康, 返回静态响应", r.Method, r.Host, r.URL.Path)
+		if err := rule.FallbackResponse.Serve(w); err != nil {
+			log.Warnf("%s %s%s | 写入静态响应失败: %v", r.Method, r.Host, r.URL.Path, err)
+		}
+		return
+	}
+
+	targetURL, err := p.buildTransitBackendURL(p.selectBackend(host, rule, r), rule, r)
 	if err != nil {
 		log.Infof("构建目标URL失败: %v", err)
 		http.Error(w, "内部错误", http.StatusInternalServerError)
 		return
 	}
 
-	trace := p.forwardRequest(w, r, targetURL, rule)
+	if rule.WebSocket != nil && isWebSocketUpgrade(r) {
+		if status := p.proxyWebSocket(state, w, r, targetURL, rule); status == http.StatusSwitchingProtocols {
+			rec.status = status
+		}
+		return
+	}
+
+	if rule.BandwidthLimit != nil {
+		limiter := state.limiters[host]
+		if limiter == nil {
+			limiter = NewByteLimiter(int64(rule.BandwidthLimit.Rate))
+		}
+		w = &throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), limiter: limiter}
+	}
+
+	ranged := rangeRequested(r, rule)
+
+	// 客户端携带If-Range时由后端判断，不使用范围缓存
+	var partial *rangeLookup
+	if rule.RangeCache != nil && r.Method == http.MethodGet && r.Header.Get("Range") != "" && r.Header.Get("If-Range") == "" {
+		partial = p.ranges.Lookup(targetURL, r.Header.Get("Range"))
+	}
+	if partial != nil && partial.fetch == "" {
+		if err := partial.object.serve(w, partial.want); err != nil {
+			log.Warnf("%s %s%s | 写入范围缓存响应失败: %v", r.Method, r.Host, r.URL.Path, err)
+			return
+		}
+		log.Infof("%s %s%s | 范围缓存命中, Range: %s", r.Method, r.Host, r.URL.Path, r.Header.Get("Range"))
+		return
+	}
+	if partial != nil && partial.rewritten() {
+		// 只请求缺失的部分，If-Range保证与已缓存的部分属于同一版本，版本变化时后端返回完整响应
+		r.Header.Set("Range", partial.fetch)
+		r.Header.Set("If-Range", partial.object.validator())
+	}
+
+	// 缓存未过期时直接返回，不请求后端
+	var cached *cacheEntry
+	cacheKey := responseCacheKey(key, captures["0"], targetURL)
+	if rule.Cache != nil && r.Method == http.MethodGet {
+		cached = p.cache.Get(cacheKey, r)
+		// 缓存未命中或过期时只由一个请求访问后端刷新，其他请求等待刷新结果或返回过期缓存
+		if (cached == nil || !cached.Fresh()) && rule.Cache.LockTimeout > 0 && !requestNoCache(r) {
+			release, refreshed := p.cache.LockRefresh(cacheKey)
+			if release != nil {
+				defer release()
+			} else if cached != nil && time.Since(cached.Expires) <= time.Duration(rule.Cache.StaleWhileRefresh) {
+				if err := p.cache.Serve(w, cached, true); err != nil {
+					log.Warnf("%s %s%s | 写入缓存响应失败: %v", r.Method, r.Host, r.URL.Path, err)
+					return
+				}
+				log.Infof("%s %s%s | 缓存刷新中, 返回过期缓存", r.Method, r.Host, r.URL.Path)
+				return
+			} else {
+				timer := time.NewTimer(time.Duration(rule.Cache.LockTimeout))
+				select {
+				case <-refreshed:
+				case <-timer.C:
+				case <-r.Context().Done():
+				}
+				timer.Stop()
+				cached = p.cache.Get(cacheKey, r)
+			}
+		}
+		if cached != nil && cached.Fresh() && !requestNoCache(r) {
+			if ranged {
+				serveRange(w, r, cached.Header, cached.Body)
+				log.Infof("%s %s%s | 缓存命中, Range: %s", r.Method, r.Host, r.URL.Path, r.Header.Get("Range"))
+				return
+			}
+			if err := p.cache.Serve(w, cached, false); err != nil {
+				log.Warnf("%s %s%s | 写入缓存响应失败: %v", r.Method, r.Host, r.URL.Path, err)
+				return
+			}
+			log.Infof("%s %s%s | 缓存命中", r.Method, r.Host, r.URL.Path)
+			return
+		}
+	}
+
+	breaker := state.breakers[host]
+	if breaker != nil && !breaker.Allow() {
+		log.Warnf("%s %s%s | 后端熔断中, 拒绝请求", r.Method, r.Host, r.URL.Path)
+		if rule.FallbackResponse != nil {
+			if err := rule.FallbackResponse.Serve(w); err != nil {
+				log.Warnf("%s %s%s | 写入静态响应失败: %v", r.Method, r.Host, r.URL.Path, err)
+			}
+			return
+		}
+		http.Error(w, "后端熔断中", http.StatusServiceUnavailable)
+		return
+	}
+
+	var span *Span
+	if p.tracer != nil {
+		if span = p.tracer.Start(r, host); span != nil {
+			r = r.WithContext(context.WithValue(r.Context(), spanKey{}, span))
+		}
+	}
+
+	stream := streamed(r, rule)
+	var trace *ProxyTrace
+	if stream {
+		trace = p.streamRequest(state, w, r, targetURL, rule)
+	} else {
+		trace = p.forwardRequest(state, r, targetURL, rule)
+	}
 	trace.Duration = time.Since(trace.StartTime)
-	log.Debug(trace)
+	trace.Rule = key
+	if span != nil {
+		p.tracer.End(span, trace)
+	}
+	if rule.TraceSampling.Sampled(r.URL.Path) {
+		log.Debug(trace)
+	}
+	if rule.LogBodyOnError && (trace.Error != nil || trace.StatusCode >= 400) {
+		if body := bodyString(r.Header.Get("Content-Type"), trace.RequestBody); body != "" {
+			log.Warnf("%s %s | 状态: %d | 请求体: %s", trace.Method, trace.RequestURL, trace.StatusCode, body)
+		}
+	}
+
+	if rule.Audit != nil && p.audit != nil {
+		defer func() { p.audit.Submit(buildAuditRecord(r, trace, rule.Audit.Fields, state.bodies[host])) }()
+	}
+
+	if breaker != nil && breaker.Record(trace.Duration, trace.Error != nil || trace.StatusCode >= 500) {
+		log.Warnf("%s 后端耗时超过阈值 %v, 熔断 %v", host, time.Duration(rule.CircuitBreaker.LatencyThreshold), time.Duration(rule.CircuitBreaker.Cooldown))
+	}
+
+	// 流式转发拿到后端响应后已直接写出
+	if stream && trace.StatusCode != 0 {
+		if trace.Error != nil {
+			log.Warnf("%s %s | 耗时: %v | %s", trace.Method, trace.RequestURL, trace.Duration, trace.Error)
+			return
+		}
+		log.Infof("%s %s | 耗时: %v | 流式转发", trace.Method, trace.RequestURL, trace.Duration)
+		return
+	}
+
+	// 后端不可用或返回5xx时，在允许的过期时长内返回过期缓存
+	if cached != nil && (trace.Error != nil || trace.StatusCode >= 500) && cached.Usable(time.Duration(rule.Cache.MaxStale)) {
+		reason := fmt.Sprintf("状态: %d", trace.StatusCode)
+		if trace.Error != nil {
+			reason = trace.Error.Error()
+		}
+		log.Warnf("%s %s | 耗时: %v | 后端失败, 返回过期缓存 | %s", trace.Method, trace.RequestURL, trace.Duration, reason)
+		if err := p.cache.Serve(w, cached, true); err != nil {
+			log.Warnf("%s %s | 写入缓存响应失败: %v", trace.Method, trace.RequestURL, err)
+		}
+		return
+	}
+
+	if rule.FallbackResponse != nil && rule.FallbackResponse.Applies(trace) {
+		reason := fmt.Sprintf("状态: %d", trace.StatusCode)
+		if trace.Error != nil {
+			reason = trace.Error.Error()
+		}
+		log.Warnf("%s %s | 耗时: %v | 后端无法处理请求, 返回静态响应 | %s", trace.Method, trace.RequestURL, trace.Duration, reason)
+		if err := rule.FallbackResponse.Serve(w); err != nil {
+			log.Warnf("%s %s | 写入静态响应失败: %v", trace.Method, trace.RequestURL, err)
+		}
+		return
+	}
+
 	if trace.Error != nil {
 		log.Warnf("%s %s | 耗时: %v | %s", trace.Method, trace.RequestURL, trace.Duration, trace.Error)
-		http.Error(w, trace.Error.Error(), http.StatusInternalServerError)
-	} else {
-		log.Infof("%s %s | 耗时: %v", trace.Method, trace.RequestURL, trace.Duration)
+		http.Error(w, trace.Error.Error(), errorStatus(trace.Error))
+		return
+	}
+
+	if rule.Cache != nil && r.Method == http.MethodGet {
+		p.cache.Store(cacheKey, r, trace, rule.Cache)
+	}
+
+	if partial != nil {
+		if object := p.ranges.Store(partial, trace, rule.RangeCache); object != nil && object.covers(partial.want) {
+			if err := object.serve(w, partial.want); err != nil {
+				log.Warnf("%s %s | 耗时: %v | 写入响应体失败: %v", trace.Method, trace.RequestURL, trace.Duration, err)
+				return
+			}
+			log.Infof("%s %s | 耗时: %v | 后端Range: %s", trace.Method, trace.RequestURL, trace.Duration, partial.fetch)
+			return
+		}
+		if partial.rewritten() {
+			log.Warnf("%s %s | 耗时: %v | 后端Range响应无法与缓存合并, 状态: %d", trace.Method, trace.RequestURL, trace.Duration, trace.StatusCode)
+			http.Error(w, "后端Range响应无效", http.StatusBadGateway)
+			return
+		}
+	}
+
+	if ranged && trace.StatusCode == http.StatusOK {
+		serveRange(w, r, trace.ResponseHeaders, trace.ResponseBody)
+		log.Infof("%s %s | 耗时: %v | Range: %s", trace.Method, trace.RequestURL, trace.Duration, r.Header.Get("Range"))
+		return
 	}
+
+	// HTTP/1.0不支持chunked编码，无法发送Trailer，保留Content-Length以便连接复用
+	if !r.ProtoAtLeast(1, 1) {
+		trace.ResponseTrailers = nil
+	}
+
+	if err := p.writeResponse(w, trace); err != nil {
+		log.Warnf("%s %s | 耗时: %v | 写入响应体失败: %v", trace.Method, trace.RequestURL, trace.Duration, err)
+		return
+	}
+	log.Infof("%s %s | 耗时: %v", trace.Method, trace.RequestURL, trace.Duration)
 }
 
-func (p *ProxyHandler) buildTransitBackendURL(rule TransitRule, r *http.Request) (string, error) {
-	backendBase := strings.TrimSuffix(rule.BackendBase, "/")
-	path := rule.BackendPrefix + r.URL.Path
+// 选择本次请求使用的后端
+func (p *ProxyHandler) selectBackend(host string, rule TransitRule, r *http.Request) string {
+	if rule.BlueGreen != nil {
+		return rule.BlueGreen.Backend(p.blueGreen.Color(host, rule.BlueGreen))
+	}
+	if sr := rule.SizeRouting; sr != nil {
+		// 请求体大小未知（chunked）时使用unknown_size指定的后端
+		if r.ContentLength < 0 {
+			if sr.UnknownSize == "small" {
+				return sr.Small
+			}
+			return sr.Large
+		}
+		if r.ContentLength >= int64(sr.Threshold) {
+			return sr.Large
+		}
+		return sr.Small
+	}
+	return rule.BackendBase
+}
+
+func (p *ProxyHandler) buildTransitBackendURL(backendBase string, rule TransitRule, r *http.Request) (string, error) {
+	backendBase = strings.TrimSuffix(backendBase, "/")
+	path := strings.TrimPrefix(r.URL.Path, rule.stripPrefix)
+	for _, rewrite := range rule.Rewrites {
+		if rewrite.pattern.MatchString(path) {
+			path = rewrite.pattern.ReplaceAllString(path, rewrite.Replace)
+			break
+		}
+	}
+	path = rule.BackendPrefix + path
 
-	if r.URL.RawQuery != "" {
-		path += "?" + r.URL.RawQuery
+	if query := applyQuery(dedupQuery(r.URL.RawQuery, rule.QueryDedup), rule.Query); query != "" {
+		// rewrites的replace中可以带查询参数，与请求的查询参数合并
+		if strings.Contains(path, "?") {
+			path += "&" + query
+		} else {
+			path += "?" + query
+		}
 	}
 
 	if !strings.HasPrefix(path, "/") {
@@ -202,6 +872,87 @@ func (p *ProxyHandler) buildTransitBackendURL(rule TransitRule, r *http.Request)
 	return backendBase + path, nil
 }
 
+// 按策略处理重复的查询参数，保持参数的原始顺序和编码
+func dedupQuery(rawQuery, policy string) string {
+	if rawQuery == "" || policy == "" || policy == "all" {
+		return rawQuery
+	}
+
+	pairs := strings.Split(rawQuery, "&")
+	kept := make([]string, 0, len(pairs))
+	index := make(map[string]int, len(pairs))
+	for _, pair := range pairs {
+		if pair == "" {
+			continue
+		}
+		rawKey, _, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if i, ok := index[key]; ok {
+			if policy == "last" {
+				kept[i] = pair
+			}
+			continue
+		}
+		index[key] = len(kept)
+		kept = append(kept, pair)
+	}
+	return strings.Join(kept, "&")
+}
+
+// 按query配置删除、覆盖和添加查询参数，保留的参数顺序和编码不变，新增的参数按名称排序追加在后面
+func applyQuery(rawQuery string, config *QueryConfig) string {
+	if config == nil {
+		return rawQuery
+	}
+
+	removed := func(key string) bool {
+		if _, ok := config.Set[key]; ok {
+			return true
+		}
+		for _, remove := range config.Remove {
+			if prefix, ok := strings.CutSuffix(remove, "*"); (ok && strings.HasPrefix(key, prefix)) || remove == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	var kept []string
+	present := make(map[string]bool)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, _, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if removed(key) {
+			continue
+		}
+		present[key] = true
+		kept = append(kept, pair)
+	}
+
+	added := url.Values{}
+	for key, value := range config.Set {
+		added.Set(key, value)
+	}
+	for key, value := range config.Extra {
+		if _, ok := config.Set[key]; !ok && !present[key] {
+			added.Set(key, value)
+		}
+	}
+	if encoded := added.Encode(); encoded != "" {
+		kept = append(kept, encoded)
+	}
+	return strings.Join(kept, "&")
+}
+
 func (p *ProxyHandler) processHeaders(r *http.Request, rule TransitRule) http.Header {
 	headers := make(http.Header)
 
@@ -227,10 +978,197 @@ func (p *ProxyHandler) processHeaders(r *http.Request, rule TransitRule) http.He
 		headers.Set(key, value)
 	}
 
-	headers.Set("Host", p.extractHost(rule.BackendBase))
+	// 由代理处理Range时向后端请求完整响应体
+	if rule.ServeRanges {
+		headers.Del("Range")
+		headers.Del("If-Range")
+	}
+
+	// 使用范围缓存时Range和If-Range由代理设置，并向后端请求未压缩的内容
+	if rule.RangeCache != nil && r.Method == http.MethodGet {
+		for _, key := range []string{"Range", "If-Range"} {
+			headers.Del(key)
+			if value := r.Header.Get(key); value != "" {
+				headers.Set(key, value)
+			}
+		}
+		headers.Del("Accept-Encoding")
+	}
+
+	p.limitHeaders(r, headers, rule)
+
+	if rule.Headers.ClientCert != nil {
+		p.injectClientCert(r, headers, rule.Headers.ClientCert)
+	}
+
+	if rule.Headers.GeoIP != nil {
+		p.injectGeoIP(r, headers, rule.Headers.GeoIP)
+	}
+
+	if rule.Headers.Forwarded {
+		p.injectForwarded(r, headers)
+	}
+
+	// 导出trace时将本次转发的span作为后端请求的父span
+	if span := spanFromContext(r.Context()); span != nil {
+		headers.Set("traceparent", span.traceparent())
+	}
+
+	switch {
+	case rule.Headers.PreserveHost:
+		headers.Set("Host", r.Host)
+	case rule.Headers.Host != "":
+		headers.Set("Host", rule.Headers.Host)
+	default:
+		headers.Set("Host", p.extractHost(rule.BackendBase))
+	}
 	return headers
 }
 
+// 配置了preserve_host或host时使用processHeaders设置的Host，否则由后端地址决定
+func setRequestHost(req *http.Request, headers http.Header, rule TransitRule) {
+	if rule.Headers.PreserveHost || rule.Headers.Host != "" {
+		req.Host = headers.Get("Host")
+	}
+}
+
+// 检查客户端是否携带了规则要求的Header
+func (p *ProxyHandler) checkRequiredHeaders(r *http.Request, rule TransitRule) error {
+	for _, required := range rule.Headers.Required {
+		values := r.Header.Values(required.Name)
+		if len(values) == 0 || values[0] == "" {
+			return fmt.Errorf("缺少必需的Header: %s", required.Name)
+		}
+		if required.pattern != nil {
+			for _, value := range values {
+				if !required.pattern.MatchString(value) {
+					return fmt.Errorf("Header格式不正确: %s", required.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 按配置丢弃或截断超长Header，并限制转发Header的总数
+func (p *ProxyHandler) limitHeaders(r *http.Request, headers http.Header, rule TransitRule) {
+	if size := rule.Headers.MaxHeaderSize; size > 0 {
+		for key, values := range headers {
+			kept := values[:0:0]
+			for _, value := range values {
+				if len(value) <= size {
+					kept = append(kept, value)
+				} else if rule.Headers.OversizeAction == "truncate" {
+					log.Warnf("%s %s%s | 截断超长Header: %s (%d > %d)", r.Method, r.Host, r.URL.Path, key, len(value), size)
+					kept = append(kept, value[:size])
+				} else {
+					log.Warnf("%s %s%s | 丢弃超长Header: %s (%d > %d)", r.Method, r.Host, r.URL.Path, key, len(value), size)
+				}
+			}
+			if len(kept) == 0 {
+				delete(headers, key)
+			} else {
+				headers[key] = kept
+			}
+		}
+	}
+
+	if count := rule.Headers.MaxHeaderCount; count > 0 && len(headers) > count {
+		// set/extra配置的Header优先保留，其余按名称排序后保留
+		keys := make([]string, 0, len(headers))
+		for key := range headers {
+			keys = append(keys, key)
+		}
+		configured := make(map[string]bool)
+		for key := range rule.Headers.Set {
+			configured[http.CanonicalHeaderKey(key)] = true
+		}
+		for key := range rule.Headers.Extra {
+			configured[http.CanonicalHeaderKey(key)] = true
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			ci, cj := configured[keys[i]], configured[keys[j]]
+			if ci != cj {
+				return ci
+			}
+			return keys[i] < keys[j]
+		})
+		log.Warnf("%s %s%s | Header数量超出限制, 丢弃: %s (%d > %d)", r.Method, r.Host, r.URL.Path, strings.Join(keys[count:], ","), len(keys), count)
+		for _, key := range keys[count:] {
+			delete(headers, key)
+		}
+	}
+}
+
+// 客户端证书相关的转发头
+var clientCertHeaders = []string{"X-Client-Cert", "X-Client-DN", "X-Client-SAN", "X-Client-Cert-Fingerprint"}
+
+// 注入已校验的客户端证书信息，客户端自带的同名Header一律删除以防伪造
+func (p *ProxyHandler) injectClientCert(r *http.Request, headers http.Header, config *ClientCertConfig) {
+	for _, key := range clientCertHeaders {
+		headers.Del(key)
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	headers.Set("X-Client-DN", cert.Subject.String())
+
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	if len(sans) > 0 {
+		headers.Set("X-Client-SAN", strings.Join(sans, ","))
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	headers.Set("X-Client-Cert-Fingerprint", hex.EncodeToString(fingerprint[:]))
+	if config.IncludeCert {
+		headers.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+}
+
+// 将连接的对端地址追加到客户端传入的X-Forwarded-For之后（配置trusted_proxies时只保留受信任代理传入的值），X-Forwarded-Proto、X-Forwarded-Host和X-Real-IP覆盖客户端传入的值
+func (p *ProxyHandler) injectForwarded(r *http.Request, headers http.Header) {
+	forwardedFor := peerIP(r)
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 && forwardedForTrusted(r) {
+		forwardedFor = strings.Join(prior, ", ") + ", " + forwardedFor
+	}
+	headers.Set("X-Forwarded-For", forwardedFor)
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	headers.Set("X-Forwarded-Proto", proto)
+	headers.Set("X-Forwarded-Host", r.Host)
+	headers.Set("X-Real-IP", clientIP(r))
+}
+
+// 由请求方法、地址和请求体生成幂等令牌，同一请求的重试和故障转移会携带相同令牌；
+// 客户端已提供令牌时保持不变
+func (p *ProxyHandler) injectIdempotencyKey(headers http.Header, r *http.Request, body []byte, config *IdempotencyConfig) {
+	if headers.Get(config.Header) != "" {
+		return
+	}
+	for _, method := range config.Methods {
+		if strings.EqualFold(method, r.Method) {
+			hash := sha256.New()
+			hash.Write([]byte(r.Method + " " + r.Host + r.URL.RequestURI() + "\n"))
+			hash.Write(body)
+			headers.Set(config.Header, hex.EncodeToString(hash.Sum(nil)))
+			return
+		}
+	}
+}
+
 func (p *ProxyHandler) extractHost(backendBase string) string {
 	parsedURL, err := url.Parse(backendBase)
 	if err != nil {
@@ -239,10 +1177,14 @@ func (p *ProxyHandler) extractHost(backendBase string) string {
 	return parsedURL.Host
 }
 
-func (p *ProxyHandler) forwardRequest(w http.ResponseWriter, r *http.Request, targetURL string, rule TransitRule) *ProxyTrace {
+func (p *ProxyHandler) forwardRequest(state *transitState, r *http.Request, targetURL string, rule TransitRule) *ProxyTrace {
 	trace := &ProxyTrace{StartTime: time.Now(), RequestURL: fmt.Sprintf("%s%s", r.Host, r.URL.Path), BackendURL: targetURL, Method: r.Method, RequestHeaders: r.Header}
 
 	reqBody, err := io.ReadAll(r.Body)
+	if errors.Is(err, errBodyTooSlow) {
+		trace.Error = &HTTPError{Status: http.StatusRequestTimeout, Err: err}
+		return trace
+	}
 	if err != nil {
 		trace.Error = fmt.Errorf("读取请求体失败: %v", err)
 		return trace
@@ -250,42 +1192,387 @@ func (p *ProxyHandler) forwardRequest(w http.ResponseWriter, r *http.Request, ta
 	defer r.Body.Close()
 	trace.RequestBody = reqBody
 
-	req, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(reqBody))
+	headers := p.processHeaders(r, rule)
+	// 告知后端该请求以早期数据发送，可能被重放
+	if state.config.Server.EarlyData && r.Header.Get("Early-Data") == "1" {
+		headers.Set("Early-Data", "1")
+	}
+	if rule.Idempotency != nil {
+		p.injectIdempotencyKey(headers, r, reqBody, rule.Idempotency)
+	}
+	if sh := rule.SamplingHeader; sh != nil {
+		headers.Set(sh.Header, "0")
+		if sh.Sampled(r, p.tracer != nil) {
+			headers.Set(sh.Header, "1")
+		}
+	}
+	var reqID string
+	if rule.RequestIDBody != nil {
+		reqID = requestID(r, rule.RequestIDBody.Header)
+		headers.Set(rule.RequestIDBody.Header, reqID)
+	}
+	trace.TransitHeaders = headers
+
+	if rule.SniffContentType {
+		if err := checkContentSniff(r.Header.Get("Content-Type"), reqBody); err != nil {
+			trace.Error = err
+			return trace
+		}
+	}
+
+	if rule.MaxJSONDepth > 0 {
+		if err := checkJSONDepth(r.Header.Get("Content-Type"), reqBody, rule.MaxJSONDepth); err != nil {
+			trace.Error = err
+			return trace
+		}
+	}
+
+	transitBody, err := p.transformRequestBody(r, headers, reqBody, rule)
 	if err != nil {
-		trace.Error = fmt.Errorf("创建请求失败: %v", err)
+		trace.Error = err
 		return trace
 	}
 
-	req.Header = p.processHeaders(r, rule)
-	trace.TransitHeaders = req.Header
+	method := r.Method
+	if rule.Script != nil && rule.Script.onRequest != nil {
+		method, targetURL, headers, transitBody, err = rule.Script.OnRequest(method, targetURL, headers, transitBody)
+		if err != nil {
+			trace.Error = err
+			return trace
+		}
+		trace.BackendURL, trace.TransitHeaders = targetURL, headers
+	}
+
+	if rule.Transcode != nil {
+		if transitBody, err = transcodeRequest(r, headers, transitBody, rule.Transcode); err != nil {
+			trace.Error = err
+			return trace
+		}
+	}
+
+	if rule.Mirror != nil {
+		p.mirror(state, r, method, headers, transitBody, rule)
+	}
+
+	ctx := r.Context()
+	if rule.PayloadTimeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, payloadTimeout(r.ContentLength, rule.PayloadTimeout))
+		defer cancel()
+	}
+
+	var secondary <-chan *ProxyTrace
+	if rule.Diff != nil && rule.Diff.applies(method) {
+		secondary = p.sendDiff(state, r, method, headers, transitBody, rule)
+	}
+
+	// 幂等请求失败时按retry_on重试，每次尝试记录在trace中
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		p.sendRequest(ctx, state, trace, method, targetURL, headers, transitBody, rule)
+		rt := rule.Retry
+		if rt == nil || rt.MaxAttempts <= 1 {
+			break
+		}
+		trace.Attempts = append(trace.Attempts, AttemptTrace{BackendURL: targetURL, StatusCode: trace.StatusCode, Duration: time.Since(start), Error: trace.Error})
+		if attempt >= rt.MaxAttempts || !idempotentMethod(method) || !rt.retryable(trace) {
+			break
+		}
+		delay := rt.delay(attempt)
+		result := fmt.Sprintf("状态: %d", trace.StatusCode)
+		if trace.Error != nil {
+			result = trace.Error.Error()
+		}
+		log.Infof("%s %s | 第%d次尝试失败(%s), %v后重试", trace.Method, trace.RequestURL, attempt, result, delay)
+		if sleepContext(ctx, delay) != nil {
+			break
+		}
+		trace.StatusCode, trace.Error = 0, nil
+		trace.ResponseHeaders, trace.ResponseBody, trace.ResponseTrailers = nil, nil, nil
+	}
+
+	// 后端返回指定状态码时，改由备用后端重新处理
+	if trace.Error == nil && rule.Retry != nil {
+		if fallback, ok := rule.Retry.Fallback[trace.StatusCode]; ok {
+			fallbackURL, err := p.buildTransitBackendURL(fallback, rule, r)
+			if err != nil {
+				trace.Error = fmt.Errorf("构建备用后端URL失败: %v", err)
+				return trace
+			}
+			log.Infof("%s %s | 后端返回 %d, 改由备用后端处理: %s", trace.Method, trace.RequestURL, trace.StatusCode, fallbackURL)
+			// 备用后端也无法连接时trace不应保留原后端的状态码
+			trace.BackendURL, trace.StatusCode = fallbackURL, 0
+			p.sendRequest(ctx, state, trace, method, fallbackURL, headers, transitBody, rule)
+		}
+	}
+
+	// 与后端的原始响应对比，在改写响应之前取快照，不等待对比后端
+	if secondary != nil {
+		logDiff(trace, secondary, rule.Diff)
+	}
+
+	if trace.Error == nil {
+		rewriteResponseHeaders(r, trace, rule)
+	}
+
+	if trace.Error == nil && rule.Transcode != nil {
+		if err := transcodeResponse(trace, acceptFormat(r)); err != nil {
+			trace.Error = err
+		}
+	}
+
+	if trace.Error == nil && rule.SchemaDrift != nil {
+		checkSchemaDrift(trace, rule.SchemaDrift)
+	}
+
+	if trace.Error == nil && rule.Script != nil && rule.Script.onResponse != nil {
+		if err := rule.Script.OnResponse(trace); err != nil {
+			trace.Error = err
+		}
+	}
+
+	if trace.Error == nil && rule.RequestIDBody != nil {
+		injectRequestID(trace, rule.RequestIDBody.Field, reqID)
+	}
+
+	if trace.Error == nil && rule.CDNHeaders != nil {
+		applyCDNHeaders(r, trace, rule.CDNHeaders)
+	}
+
+	if trace.Error == nil && len(rule.AcceptRanges) > 0 {
+		advertiseRanges(r, trace, rule.AcceptRanges)
+	}
+
+	if trace.Error == nil && rule.ExpectedContentType != "" {
+		if err := checkContentType(trace, rule); err != nil {
+			trace.Error = err
+		}
+	}
+
+	return trace
+}
+
+// 发送请求，sent表示是否已拿到与后端的连接，未拿到连接时请求一定没有发出，reused表示连接是否复用；
+// 新建连接时将域名解析过程记录到trace中
+func doRequest(client *http.Client, req *http.Request, trace *ProxyTrace) (resp *http.Response, sent, reused bool, err error) {
+	var connected, reusedConn atomic.Bool
+	var remoteAddr atomic.Value
+	var dnsMu sync.Mutex
+	var dns *DNSTrace
+	var dnsStart time.Time
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reusedConn.Store(info.Reused)
+			connected.Store(true)
+			remoteAddr.Store(info.Conn.RemoteAddr().String())
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			dnsMu.Lock()
+			defer dnsMu.Unlock()
+			dns, dnsStart = &DNSTrace{Host: info.Host}, time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			dnsMu.Lock()
+			defer dnsMu.Unlock()
+			if dns == nil {
+				return
+			}
+			dns.Duration, dns.Err = time.Since(dnsStart), info.Err
+			for _, addr := range info.Addrs {
+				dns.Addrs = append(dns.Addrs, addr.String())
+			}
+		},
+	})
+	resp, err = client.Do(req.WithContext(ctx))
+
+	dnsMu.Lock()
+	if dns != nil {
+		snapshot := *dns
+		trace.DNS = &snapshot
+	}
+	dnsMu.Unlock()
+	if addr, ok := remoteAddr.Load().(string); ok {
+		trace.RemoteAddr = addr
+	}
+	return resp, connected.Load(), reusedConn.Load(), err
+}
+
+// 向后端发送请求并将响应记录到trace中
+func (p *ProxyHandler) sendRequest(ctx context.Context, state *transitState, trace *ProxyTrace, method, targetURL string, headers http.Header, body []byte, rule TransitRule) {
+	if rule.Redirect != nil {
+		ctx = withRedirectPolicy(ctx, rule.Redirect)
+	}
+	if rule.RewriteLocation {
+		ctx = withoutRedirects(ctx)
+	}
+
+	// 客户端未声明Accept-Encoding时由代理主动请求gzip并自行解压，以便同时统计传输和解压后的大小
+	decode := rule.DecompressedSize && headers.Get("Accept-Encoding") == ""
+	if decode {
+		headers = headers.Clone()
+		headers.Set("Accept-Encoding", "gzip")
+	}
+
+	retries := 0
+	if rule.Retry != nil {
+		retries = rule.Retry.PreSend
+	}
+
+	domain := p.extractDomain(targetURL)
+	backoff := state.dns[domain]
+	if backoff != nil && !backoff.Allow() {
+		trace.Error = &HTTPError{Status: http.StatusBadGateway, Err: fmt.Errorf("后端域名 %s 解析持续失败, 暂停转发", domain)}
+		return
+	}
 
 	// 使用域名特定的连接池中的HTTP客户端
-	client := p.getClientForDomain(rule.BackendBase)
-	resp, err := client.Do(req)
+	client := p.getClientForDomain(state, targetURL)
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, targetURL, bytes.NewReader(body))
+		if err != nil {
+			trace.Error = fmt.Errorf("创建请求失败: %v", err)
+			return
+		}
+		req.Header = headers
+		setRequestHost(req, headers, rule)
+
+		var sent, reused bool
+		resp, sent, reused, err = doRequest(client, req, trace)
+		if sent {
+			p.metrics.ObserveConn(domain, reused)
+		}
+		if sent && rule.ConnReuse != nil {
+			if ratio, low := p.connReuse.Record(domain, reused, rule.ConnReuse); low {
+				log.Warnf("后端 %s 连接复用率过低: 最近 %d 个请求中 %.0f%% 复用连接, 请检查后端是否关闭了连接(Connection: close)", domain, rule.ConnReuse.Window, ratio*100)
+			}
+		}
+		// 未拿到连接时请求一定没有发出，任何方法都可以安全重试
+		if err == nil || sent || attempt >= retries || ctx.Err() != nil {
+			break
+		}
+		log.Infof("%s %s | 连接后端失败, 请求未发出, 重试(%d/%d): %v", trace.Method, trace.RequestURL, attempt+1, retries, err)
+	}
+	if backoff != nil && backoff.Record(err) {
+		log.Warnf("后端域名 %s 解析连续失败, 暂停转发 %v", domain, time.Duration(backoff.config.Cooldown))
+	}
 	if err != nil {
 		trace.Error = fmt.Errorf("转发请求失败: %v", err)
-		return trace
+		var httpErr *HTTPError
+		if errors.Is(err, context.DeadlineExceeded) {
+			trace.Error = &HTTPError{Status: http.StatusGatewayTimeout, Err: trace.Error}
+		} else if errors.As(err, &httpErr) {
+			trace.Error = &HTTPError{Status: httpErr.Status, Err: trace.Error}
+		}
+		return
 	}
 	defer resp.Body.Close()
+
+	count := 0
+	for _, values := range resp.Header {
+		count += len(values)
+	}
+	if count > rule.Headers.MaxResponseHeaderCount {
+		log.Warnf("%s %s | 后端返回 %d 个Header, 超过上限 %d", trace.Method, trace.RequestURL, count, rule.Headers.MaxResponseHeaderCount)
+		trace.Error = &HTTPError{Status: http.StatusBadGateway, Err: fmt.Errorf("后端响应Header数量超过上限: %d", count)}
+		return
+	}
 	trace.StatusCode, trace.ResponseHeaders = resp.StatusCode, resp.Header
+	if fp := rule.Fingerprint; fp != nil {
+		fingerprint := backendFingerprint(resp, fp)
+		if previous, changed := p.identities.Observe(domain, fingerprint, fp.Threshold); changed {
+			log.Warnf("后端 %s 的身份指纹发生变化, 可能被替换或劫持: %s -> %s", domain, previous, fingerprint)
+		}
+	}
+	if rule.LogTLS {
+		trace.TLS = resp.TLS
+	}
 
 	rspBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		trace.Error = fmt.Errorf("读取响应体失败: %v", err)
-		return trace
+		if errors.Is(err, context.DeadlineExceeded) {
+			trace.Error = &HTTPError{Status: http.StatusGatewayTimeout, Err: trace.Error}
+		}
+		return
 	}
 	trace.ResponseBody = rspBody
+	if rule.ForwardTrailers && len(resp.Trailer) > 0 {
+		trace.ResponseTrailers = resp.Trailer
+	}
 
-	for key, values := range resp.Header {
-		w.Header()[key] = values
+	if rule.DecompressedSize {
+		trace.WireSize, trace.DecodedSize = int64(len(rspBody)), int64(len(rspBody))
+		if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+			decoded, err := gunzip(rspBody)
+			if err != nil {
+				trace.Error = fmt.Errorf("解压响应体失败: %v", err)
+				return
+			}
+			trace.DecodedSize = int64(len(decoded))
+			if decode {
+				trace.ResponseBody = decoded
+				resp.Header.Del("Content-Encoding")
+				resp.Header.Del("Content-Length")
+			}
+		}
+	}
+}
+
+// 按请求体大小计算超时时间，大小未知时使用上限
+func payloadTimeout(contentLength int64, config *PayloadTimeoutConfig) time.Duration {
+	if contentLength < 0 {
+		if config.Max > 0 {
+			return time.Duration(config.Max)
+		}
+		return time.Duration(config.Base)
 	}
-	w.WriteHeader(resp.StatusCode)
 
-	_, err = w.Write(rspBody)
+	timeout := time.Duration(config.Base) + time.Duration(float64(config.PerMB)*float64(contentLength)/(1<<20))
+	if config.Max > 0 && timeout > time.Duration(config.Max) {
+		timeout = time.Duration(config.Max)
+	}
+	return timeout
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
-		trace.Error = fmt.Errorf("写入响应体失败: %v", err)
-		return trace
+		return nil, err
 	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
 
-	return trace
+// 描述与后端连接的逐跳Header不转发给客户端，连接是否保持由服务端按客户端的协议版本决定
+func isHopHeader(key string) bool {
+	return key == "Connection" || key == "Keep-Alive"
+}
+
+// 将后端响应写回客户端
+func (p *ProxyHandler) writeResponse(w http.ResponseWriter, trace *ProxyTrace) error {
+	for key, values := range trace.ResponseHeaders {
+		if isHopHeader(key) {
+			continue
+		}
+		w.Header()[key] = values
+	}
+	// 声明后端返回的Trailer，以chunked编码在响应体之后发送
+	if len(trace.ResponseTrailers) > 0 {
+		w.Header().Del("Content-Length")
+		for key := range trace.ResponseTrailers {
+			w.Header().Add("Trailer", key)
+		}
+	}
+	w.WriteHeader(trace.StatusCode)
+
+	if _, err := w.Write(trace.ResponseBody); err != nil {
+		return err
+	}
+	for key, values := range trace.ResponseTrailers {
+		w.Header()[key] = values
+	}
+	return nil
 }
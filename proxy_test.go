@@ -0,0 +1,1322 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func mustParseConfig(t *testing.T, data string) *Config {
+	t.Helper()
+	config, err := ParseConfig([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// 创建转发到backend的代理，config中的BACKEND替换为后端地址
+func newTestProxy(t *testing.T, backend *httptest.Server, config string) *ProxyHandler {
+	t.Helper()
+	handler := NewProxyHandler(mustParseConfig(t, strings.ReplaceAll(config, "BACKEND", backend.URL)))
+	t.Cleanup(handler.Close)
+	return handler
+}
+
+// 将全局日志替换为可检查的observer，测试结束后恢复
+func captureLog(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zap.DebugLevel)
+	old := log
+	log = zap.New(core).Sugar()
+	t.Cleanup(func() { log = old })
+	return logs
+}
+
+func serveProxy(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// 开启log_tls时trace记录与后端的TLS连接信息
+func TestLogTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	cases := []struct {
+		config string
+		want   string
+	}{
+		{`{"transit_map": {"a.test": {"backend_base": "BACKEND", "log_tls": true}}}`, "TLS: TLS 1.3 TLS_"},
+		{`{"transit_map": {"a.test": {"backend_base": "BACKEND"}}}`, ""},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, c.config)
+		state := handler.state.Load()
+		state.clients[handler.extractDomain(backend.URL)] = backend.Client()
+		rule := state.config.TransitMap["a.test"]
+
+		trace := handler.forwardRequest(state, httptest.NewRequest(http.MethodGet, "http://a.test/", nil), backend.URL+"/", rule)
+		if trace.Error != nil {
+			t.Fatal(trace.Error)
+		}
+		if c.want == "" {
+			if trace.TLS != nil || strings.Contains(trace.String(), "TLS:") {
+				t.Errorf("未开启log_tls时记录了TLS信息: %s", trace)
+			}
+			continue
+		}
+		if trace.TLS == nil || !strings.Contains(trace.String(), c.want) || !strings.Contains(trace.String(), "会话复用: false") {
+			t.Errorf("trace中的TLS信息: %s", trace)
+		}
+	}
+}
+
+func TestLimitHeaders(t *testing.T) {
+	long := strings.Repeat("x", 20)
+	cases := []struct {
+		name    string
+		headers http.Header
+		config  HeadersConfig
+		want    http.Header
+	}{
+		{
+			"丢弃超长Header",
+			http.Header{"X-Long": {long}, "X-Short": {"ok"}},
+			HeadersConfig{MaxHeaderSize: 10},
+			http.Header{"X-Short": {"ok"}},
+		},
+		{
+			"截断超长Header",
+			http.Header{"X-Long": {long, "ok"}, "X-Short": {"ok"}},
+			HeadersConfig{MaxHeaderSize: 10, OversizeAction: "truncate"},
+			http.Header{"X-Long": {long[:10], "ok"}, "X-Short": {"ok"}},
+		},
+		{
+			// 超出数量时优先保留set/extra配置的Header，其余按名称保留
+			"超出数量",
+			http.Header{"A": {"1"}, "B": {"1"}, "C": {"1"}, "Z-Set": {"1"}, "Z-Extra": {"1"}},
+			HeadersConfig{MaxHeaderCount: 3, Set: map[string]string{"z-set": "1"}, Extra: map[string]string{"Z-Extra": "1"}},
+			http.Header{"A": {"1"}, "Z-Set": {"1"}, "Z-Extra": {"1"}},
+		},
+		{
+			"未超出限制",
+			http.Header{"A": {"1"}, "B": {long}},
+			HeadersConfig{MaxHeaderSize: 20, MaxHeaderCount: 2},
+			http.Header{"A": {"1"}, "B": {long}},
+		},
+	}
+	for _, c := range cases {
+		(&ProxyHandler{}).limitHeaders(httptest.NewRequest(http.MethodGet, "http://a.test/", nil), c.headers, TransitRule{Headers: c.config})
+		if !reflect.DeepEqual(c.headers, c.want) {
+			t.Errorf("%s: %v, 期望 %v", c.name, c.headers, c.want)
+		}
+	}
+}
+
+func TestInjectClientCert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+	cert := server.Certificate()
+	fingerprint := sha256.Sum256(cert.Raw)
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	cases := []struct {
+		name   string
+		tls    *tls.ConnectionState
+		config ClientCertConfig
+		want   http.Header
+	}{
+		{"附带完整证书", verified, ClientCertConfig{IncludeCert: true}, http.Header{
+			"X-Client-Dn":               {"O=Acme Co"},
+			"X-Client-San":              {"example.com,*.example.com,127.0.0.1,::1"},
+			"X-Client-Cert-Fingerprint": {hex.EncodeToString(fingerprint[:])},
+			"X-Client-Cert":             {base64.StdEncoding.EncodeToString(cert.Raw)},
+		}},
+		{"不附带完整证书", verified, ClientCertConfig{}, http.Header{
+			"X-Client-Dn":               {"O=Acme Co"},
+			"X-Client-San":              {"example.com,*.example.com,127.0.0.1,::1"},
+			"X-Client-Cert-Fingerprint": {hex.EncodeToString(fingerprint[:])},
+		}},
+		// 未校验客户端证书时删除客户端伪造的Header
+		{"未校验证书", &tls.ConnectionState{}, ClientCertConfig{IncludeCert: true}, http.Header{}},
+		{"HTTP请求", nil, ClientCertConfig{}, http.Header{}},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "https://a.test/", nil)
+		r.TLS = c.tls
+		headers := http.Header{"X-Client-Dn": {"CN=spoofed"}, "X-Client-Cert": {"spoofed"}}
+		(&ProxyHandler{}).injectClientCert(r, headers, &c.config)
+		if !reflect.DeepEqual(headers, c.want) {
+			t.Errorf("%s: %v, 期望 %v", c.name, headers, c.want)
+		}
+	}
+}
+
+// 相同的写请求每次转发携带相同的幂等令牌，客户端已携带令牌时保持不变
+func TestIdempotencyKey(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Idempotency-Key")))
+	}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"forward_client": true}, "idempotency": {}}}}`)
+	key := func(method, body, clientKey string) string {
+		req := httptest.NewRequest(method, "http://a.test/orders", strings.NewReader(body))
+		if clientKey != "" {
+			req.Header.Set("Idempotency-Key", clientKey)
+		}
+		return serveProxy(handler, req).Body.String()
+	}
+
+	first := key(http.MethodPost, `{"id": 1}`, "")
+	if len(first) != 64 {
+		t.Fatalf("幂等令牌: %q", first)
+	}
+
+	cases := []struct {
+		name            string
+		method, body    string
+		clientKey, want string
+	}{
+		{"相同请求", http.MethodPost, `{"id": 1}`, "", first},
+		{"客户端携带令牌", http.MethodPost, `{"id": 1}`, "client", "client"},
+		{"GET请求", http.MethodGet, "", "", ""},
+	}
+	for _, c := range cases {
+		if got := key(c.method, c.body, c.clientKey); got != c.want {
+			t.Errorf("%s: 幂等令牌 %q, 期望 %q", c.name, got, c.want)
+		}
+	}
+	if got := key(http.MethodPost, `{"id": 2}`, ""); got == first || len(got) != 64 {
+		t.Errorf("不同请求体的幂等令牌: %q", got)
+	}
+}
+
+// 后端返回retry.fallback中配置的状态码时由对应的备用后端重新处理，并携带相同的幂等令牌；其他状态码原样返回
+func TestRetryFallbackOnStatus(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	record := func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("fallback " + r.Method + " " + r.URL.Path + " " + string(body)))
+	}))
+	defer fallback.Close()
+	handler := newTestProxy(t, primary, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "idempotency": {}, "retry": {"fallback": {"503": "`+fallback.URL+`"}}}}}`)
+
+	cases := []struct {
+		status   string
+		wantCode int
+		wantBody string
+		attempts int
+	}{
+		{"503", http.StatusOK, "fallback POST /x body", 2},
+		{"500", http.StatusInternalServerError, "primary", 1},
+		{"404", http.StatusNotFound, "primary", 1},
+	}
+	for _, c := range cases {
+		keys = nil
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodPost, "http://a.test/x?status="+c.status, strings.NewReader("body")))
+		if rec.Code != c.wantCode || rec.Body.String() != c.wantBody {
+			t.Errorf("后端返回 %s: %d %q, 期望 %d %q", c.status, rec.Code, rec.Body, c.wantCode, c.wantBody)
+		}
+		if len(keys) != c.attempts || keys[0] == "" || keys[len(keys)-1] != keys[0] {
+			t.Errorf("后端返回 %s: 各次转发的幂等令牌 %q", c.status, keys)
+		}
+	}
+}
+
+// 熔断期间以及后端和retry.fallback的备用后端都无法连接时返回fallback_response，开启on_5xx时后端的5xx同样返回静态响应
+func TestFallbackResponse(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(max(status, http.StatusOK))
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(page, []byte("<h1>维护中</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		rule     string
+		path     string
+		warmup   int // 先发送的请求数，用于触发熔断
+		wantCode int
+		wantBody string
+		wantType string
+		forward  bool // 是否应转发给后端
+	}{
+		{"熔断期间", `"backend_base": "BACKEND", "circuit_breaker": {"latency_threshold": "10ms", "window": 3, "min_requests": 3}, "fallback_response": {"body": "稍后再试"}`,
+			"/?slow=1", 3, http.StatusServiceUnavailable, "稍后再试", "text/plain; charset=utf-8", false},
+		{"后端无法连接", `"backend_base": "` + dead.URL + `", "fallback_response": {"status": 200, "body": "{}", "content_type": "application/json"}`,
+			"/", 0, http.StatusOK, "{}", "application/json", false},
+		{"备用后端同样无法连接", `"backend_base": "BACKEND", "retry": {"fallback": {"503": "` + dead.URL + `"}}, "fallback_response": {"file": "` + filepath.ToSlash(page) + `"}`,
+			"/?status=503", 0, http.StatusServiceUnavailable, "<h1>维护中</h1>", "text/html; charset=utf-8", true},
+		{"后端返回5xx", `"backend_base": "BACKEND", "fallback_response": {"body": "稍后再试"}`,
+			"/?status=500", 0, http.StatusInternalServerError, "backend", "", true},
+		{"开启on_5xx", `"backend_base": "BACKEND", "fallback_response": {"body": "稍后再试", "on_5xx": true}`,
+			"/?status=500", 0, http.StatusServiceUnavailable, "稍后再试", "text/plain; charset=utf-8", true},
+		{"后端正常", `"backend_base": "BACKEND", "fallback_response": {"body": "稍后再试", "on_5xx": true}`,
+			"/", 0, http.StatusOK, "backend", "", true},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {`+c.rule+`}}}`)
+		for i := 0; i < c.warmup; i++ {
+			serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test"+c.path, nil))
+		}
+		before := hits.Load()
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test"+c.path, nil))
+		if rec.Code != c.wantCode || rec.Body.String() != c.wantBody {
+			t.Errorf("%s: %d %q, 期望 %d %q", c.name, rec.Code, rec.Body, c.wantCode, c.wantBody)
+		}
+		if c.wantType != "" && (rec.Header().Get("Content-Type") != c.wantType || rec.Header().Get("Cache-Control") != "no-store") {
+			t.Errorf("%s: Content-Type %q, Cache-Control %q", c.name, rec.Header().Get("Content-Type"), rec.Header().Get("Cache-Control"))
+		}
+		if forwarded := hits.Load() != before; forwarded != c.forward {
+			t.Errorf("%s: 是否转发到后端 %v", c.name, forwarded)
+		}
+	}
+}
+
+// health_check判定所有后端都不健康且未配置backup时直接返回fallback_response，不再转发
+func TestFallbackResponseWhenAllUnhealthy(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		hits.Add(1)
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backup"))
+	}))
+	defer backup.Close()
+	healthCheck := `"health_check": {"path": "/health", "interval": "1h", "unhealthy_threshold": 1`
+
+	cases := []struct {
+		name     string
+		rule     string
+		wantCode int
+		wantBody string
+		forward  bool // 是否应转发给不健康的后端
+	}{
+		{"单个后端", `"backend_base": "BACKEND", ` + healthCheck + `}, "fallback_response": {"body": "稍后再试"}`,
+			http.StatusServiceUnavailable, "稍后再试", false},
+		{"负载均衡", `"load_balance": {"backends": ["BACKEND"]}, ` + healthCheck + `}, "fallback_response": {"status": 200, "body": "{}"}`,
+			http.StatusOK, "{}", false},
+		{"优先使用backup", `"backend_base": "BACKEND", ` + healthCheck + `, "backup": "` + backup.URL + `"}, "fallback_response": {"body": "稍后再试"}`,
+			http.StatusOK, "backup", false},
+		{"未配置fallback_response", `"backend_base": "BACKEND", ` + healthCheck + `}`,
+			http.StatusOK, "backend", true},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {`+c.rule+`}}}`)
+		checker := handler.state.Load().health["a.test"]
+		for deadline := time.Now().Add(2 * time.Second); checker.Healthy(backend.URL); {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: 后端未被判定为不健康", c.name)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		before := hits.Load()
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil))
+		if rec.Code != c.wantCode || rec.Body.String() != c.wantBody {
+			t.Errorf("%s: %d %q, 期望 %d %q", c.name, rec.Code, rec.Body, c.wantCode, c.wantBody)
+		}
+		if forwarded := hits.Load() != before; forwarded != c.forward {
+			t.Errorf("%s: 是否转发到后端 %v", c.name, forwarded)
+		}
+	}
+}
+
+// 开启decompressed_size时同时记录gzip响应的传输大小和解压后大小，客户端未声明Accept-Encoding时由代理解压
+func TestDecompressedSize(t *testing.T) {
+	body := strings.Repeat("a", 10000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(body))
+		gz.Close()
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name           string
+		enabled        bool
+		acceptEncoding string
+		wantDecoded    bool // 返回给客户端的响应体是否已解压
+	}{
+		{"客户端声明gzip", true, "gzip", false},
+		{"客户端未声明gzip", true, "", true},
+		{"未开启", false, "gzip", false},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"forward_client": true}, "decompressed_size": `+strconv.FormatBool(c.enabled)+`}}}`)
+		state := handler.state.Load()
+		req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+		if c.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+		trace := handler.forwardRequest(state, req, backend.URL+"/", state.config.TransitMap["a.test"])
+		if trace.Error != nil {
+			t.Fatal(trace.Error)
+		}
+		if (string(trace.ResponseBody) == body) != c.wantDecoded || (trace.ResponseHeaders.Get("Content-Encoding") == "gzip") == c.wantDecoded {
+			t.Errorf("%s: 响应体 %d 字节, Content-Encoding %q", c.name, len(trace.ResponseBody), trace.ResponseHeaders.Get("Content-Encoding"))
+		}
+		if !c.enabled {
+			if trace.WireSize != 0 || strings.Contains(trace.String(), "响应大小") {
+				t.Errorf("%s: 记录了响应大小 %d", c.name, trace.WireSize)
+			}
+			continue
+		}
+		if trace.DecodedSize != int64(len(body)) || trace.WireSize <= 0 || trace.WireSize >= trace.DecodedSize {
+			t.Errorf("%s: 传输大小 %d, 解压大小 %d", c.name, trace.WireSize, trace.DecodedSize)
+		}
+		if !strings.Contains(trace.String(), "响应大小: 传输") {
+			t.Errorf("%s: trace中没有响应大小: %s", c.name, trace)
+		}
+	}
+}
+
+// 缺少required_headers或值不匹配pattern时返回400
+func TestRequiredHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"required_headers": [
+		{"name": "X-Tenant"},
+		{"name": "Authorization", "pattern": "^Bearer [A-Za-z0-9.]+$"}
+	]}}}}`)
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"全部满足", map[string]string{"X-Tenant": "a", "Authorization": "Bearer abc.def"}, http.StatusOK},
+		{"缺少Header", map[string]string{"Authorization": "Bearer abc"}, http.StatusBadRequest},
+		{"Header为空", map[string]string{"X-Tenant": "", "Authorization": "Bearer abc"}, http.StatusBadRequest},
+		{"不匹配pattern", map[string]string{"X-Tenant": "a", "Authorization": "Basic abc"}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+		for key, value := range c.headers {
+			req.Header.Set(key, value)
+		}
+		if rec := serveProxy(handler, req); rec.Code != c.want {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, rec.Code, c.want)
+		}
+	}
+
+	for _, invalid := range []string{`[{"pattern": "x"}]`, `[{"name": "X-Tenant", "pattern": "("}]`} {
+		if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend_base": "http://b.test", "headers": {"required_headers": ` + invalid + `}}}}`)); err == nil {
+			t.Errorf("%s: 期望加载配置失败", invalid)
+		}
+	}
+}
+
+func TestPayloadTimeout(t *testing.T) {
+	config := &PayloadTimeoutConfig{Base: Duration(time.Second), PerMB: Duration(2 * time.Second), Max: Duration(10 * time.Second)}
+	cases := []struct {
+		name   string
+		size   int64
+		config *PayloadTimeoutConfig
+		want   time.Duration
+	}{
+		{"空请求体", 0, config, time.Second},
+		{"512KB", 1 << 19, config, 2 * time.Second},
+		{"3MB", 3 << 20, config, 7 * time.Second},
+		{"超出上限", 100 << 20, config, 10 * time.Second},
+		{"大小未知", -1, config, 10 * time.Second},
+		{"大小未知且未设置max", -1, &PayloadTimeoutConfig{Base: Duration(time.Second)}, time.Second},
+	}
+	for _, c := range cases {
+		if got := payloadTimeout(c.size, c.config); got != c.want {
+			t.Errorf("%s: 超时时间 %v, 期望 %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 后端在按请求体大小计算的时间内未响应时返回504
+func TestPayloadTimeoutExceeded(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "payload_timeout": {"base": "50ms", "per_mb": "1s"}}}}`)
+
+	cases := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"小请求体", "small", http.StatusGatewayTimeout},
+		{"1MB请求体", strings.Repeat("x", 1<<20), http.StatusOK},
+	}
+	for _, c := range cases {
+		if rec := serveProxy(handler, httptest.NewRequest(http.MethodPost, "http://a.test/", strings.NewReader(c.body))); rec.Code != c.want {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, rec.Code, c.want)
+		}
+	}
+}
+
+const reloadConfig = `{
+	"transit_map": {
+		"a.test": {
+			"backend_base": "http://127.0.0.1:9",
+			"circuit_breaker": {"latency_threshold": "2s"},
+			"rate_limit": {"rate": 1},
+			"bandwidth_limit": {"rate": 1000, "shared": true},
+			"health_check": {"interval": "1h"}
+		},
+		"b.test": {"backend_base": "http://127.0.0.1:10", "rate_limit": {"rate": RATE}}
+	}
+}`
+
+// 重新加载时配置未变化的规则沿用熔断、限流和健康检查状态，变化的规则重新创建
+func TestReloadKeepsUnchangedRuleState(t *testing.T) {
+	handler := NewProxyHandler(mustParseConfig(t, strings.Replace(reloadConfig, "RATE", "1", 1)))
+	defer handler.Close()
+	old := handler.state.Load()
+
+	if _, ok := old.limits["a.test"].Allow(""); !ok {
+		t.Fatal("首个请求被限流")
+	}
+
+	handler.Reload(mustParseConfig(t, strings.Replace(reloadConfig, "RATE", "2", 1)))
+	state := handler.state.Load()
+
+	if state.breakers["a.test"] != old.breakers["a.test"] {
+		t.Error("a.test的熔断状态被重置")
+	}
+	if state.limits["a.test"] != old.limits["a.test"] {
+		t.Error("a.test的限流状态被重置")
+	}
+	if state.limiters["a.test"] != old.limiters["a.test"] {
+		t.Error("a.test的带宽限速状态被重置")
+	}
+	if state.health["a.test"] != old.health["a.test"] {
+		t.Error("a.test的健康检查被重新创建")
+	}
+	if _, ok := state.limits["a.test"].Allow(""); ok {
+		t.Error("重新加载后a.test的令牌桶被回满")
+	}
+	if state.limits["b.test"] == old.limits["b.test"] {
+		t.Error("b.test的rate_limit变化后仍沿用旧的限流器")
+	}
+}
+
+// 重新加载后为新增或连接池配置变化的后端预先建立reload_warmup个连接，沿用原有连接池的后端不预热
+func TestReloadWarmup(t *testing.T) {
+	var existingHeads atomic.Int32
+	existing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			existingHeads.Add(1)
+		}
+	}))
+	defer existing.Close()
+
+	cases := []struct {
+		name    string
+		oldRule string // 重新加载前b.test的规则，为空表示新增
+		newRule string // 重新加载后b.test的规则，WARM替换为后端地址，WARMHOST替换为不带scheme的后端地址
+		warmup  int
+	}{
+		{"新增后端预热3个连接", "", `"backend_base": "WARM", "reload_warmup": 3`, 3},
+		{"不预热", "", `"backend_base": "WARM"`, 0},
+		{"省略scheme的后端", "", `"backend_base": "WARMHOST", "reload_warmup": 2`, 2},
+		{"连接池配置变化", `"backend_base": "WARM"`, `"backend_base": "WARM", "reload_warmup": 2, "max_conns_per_ip": 10`, 2},
+		{"连接池配置未变化", `"backend_base": "WARM"`, `"backend_base": "WARM", "reload_warmup": 2`, 0},
+	}
+	for _, c := range cases {
+		var heads, conns, idle atomic.Int32
+		warm := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				heads.Add(1)
+				time.Sleep(50 * time.Millisecond)
+			}
+		}))
+		warm.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				conns.Add(1)
+			case http.StateIdle:
+				idle.Add(1)
+			}
+		}
+		warm.Start()
+		defer warm.Close()
+		expand := strings.NewReplacer("WARMHOST", strings.TrimPrefix(warm.URL, "http://"), "WARM", warm.URL).Replace
+
+		config := `{"transit_map": {"a.test": {"backend_base": "BACKEND"}}}`
+		if c.oldRule != "" {
+			config = `{"transit_map": {"a.test": {"backend_base": "BACKEND"}, "b.test": {` + expand(c.oldRule) + `}}}`
+		}
+		handler := newTestProxy(t, existing, config)
+		old := handler.state.Load()
+		handler.Reload(mustParseConfig(t, `{"transit_map": {
+			"a.test": {"backend_base": "`+existing.URL+`", "reload_warmup": 3},
+			"b.test": {`+expand(c.newRule)+`}
+		}}`))
+
+		deadline := time.Now().Add(2 * time.Second)
+		for idle.Load() < int32(c.warmup) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if heads.Load() != int32(c.warmup) || conns.Load() != int32(c.warmup) {
+			t.Errorf("%s: 预热发送了 %d 个HEAD请求, 建立了 %d 个连接, 期望 %d", c.name, heads.Load(), conns.Load(), c.warmup)
+		}
+		domain := handler.extractDomain(existing.URL)
+		if handler.state.Load().clients[domain] != old.clients[domain] || existingHeads.Load() != 0 {
+			t.Errorf("%s: 未变化的后端的连接池被重新创建或被预热", c.name)
+		}
+
+		// 预热的连接留在连接池中，之后的请求不再新建连接；服务端空闲后稍等客户端将连接放回连接池
+		time.Sleep(20 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://b.test/", nil))
+		}
+		if want := int32(max(c.warmup, 1)); conns.Load() != want {
+			t.Errorf("%s: 预热后的请求共建立 %d 个连接, 期望 %d", c.name, conns.Load(), want)
+		}
+	}
+}
+
+func TestDedupQuery(t *testing.T) {
+	cases := []struct {
+		query, policy, want string
+	}{
+		{"a=1&b=2&a=3", "all", "a=1&b=2&a=3"},
+		{"a=1&b=2&a=3", "", "a=1&b=2&a=3"},
+		{"a=1&b=2&a=3", "first", "a=1&b=2"},
+		{"a=1&b=2&a=3", "last", "a=3&b=2"},
+		{"a%5B%5D=1&a[]=2&flag&flag=x", "first", "a%5B%5D=1&flag"},
+		{"a=1&&a=2&", "last", "a=2"},
+		{"q=hello%20world&q=x+y", "last", "q=x+y"},
+		{"", "first", ""},
+	}
+	for _, c := range cases {
+		if got := dedupQuery(c.query, c.policy); got != c.want {
+			t.Errorf("dedupQuery(%q, %q) = %q, 期望 %q", c.query, c.policy, got, c.want)
+		}
+	}
+}
+
+// 连接后端失败、请求尚未发出时按retry.pre_send重试，POST请求同样重试；请求发出后失败不重试
+func TestRetryPreSend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("close") != "" {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name      string
+		preSend   int
+		failDials int32 // 前几次建连失败
+		query     string
+		wantCode  int
+		wantDials int32
+	}{
+		{"重试后成功", 2, 2, "", http.StatusOK, 3},
+		{"重试次数用尽", 1, 2, "", http.StatusInternalServerError, 2},
+		{"未配置重试", 0, 1, "", http.StatusInternalServerError, 1},
+		{"请求已发出", 2, 0, "?close=1", http.StatusInternalServerError, 1},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "retry": {"pre_send": `+strconv.Itoa(c.preSend)+`}}}}`)
+		var dials atomic.Int32
+		dialer := &net.Dialer{}
+		handler.state.Load().clients[handler.extractDomain(backend.URL)] = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if dials.Add(1) <= c.failDials {
+					return nil, errors.New("connection refused")
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}}
+
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodPost, "http://a.test/"+c.query, strings.NewReader("body")))
+		if rec.Code != c.wantCode || dials.Load() != c.wantDials {
+			t.Errorf("%s: 状态 %d, 建连 %d 次, 期望 %d %d 次", c.name, rec.Code, dials.Load(), c.wantCode, c.wantDials)
+		}
+		if c.wantCode == http.StatusOK && rec.Body.String() != "body" {
+			t.Errorf("%s: 重试后的请求体 %q", c.name, rec.Body)
+		}
+	}
+}
+
+// 开启log_body_on_error时仅在后端返回4xx/5xx时记录请求体，非文本类型只记录类型和大小
+func TestLogBodyOnError(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name        string
+		enabled     bool
+		status      string
+		contentType string
+		want        string // 期望记录的请求体，为空表示不记录
+	}{
+		{"2xx", true, "200", "application/json", ""},
+		{"4xx", true, "404", "application/json", `请求体: {"id": 1}`},
+		{"5xx", true, "502", "text/plain", `请求体: {"id": 1}`},
+		{"非文本类型", true, "500", "application/octet-stream", "请求体: [application/octet-stream 9 B]"},
+		{"未开启", false, "500", "application/json", ""},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "log_body_on_error": `+strconv.FormatBool(c.enabled)+`}}}`)
+		logs := captureLog(t)
+		req := httptest.NewRequest(http.MethodPost, "http://a.test/?status="+c.status, strings.NewReader(`{"id": 1}`))
+		req.Header.Set("Content-Type", c.contentType)
+		serveProxy(handler, req)
+
+		logged := logs.FilterLevelExact(zap.WarnLevel).FilterMessageSnippet("请求体").All()
+		if c.want == "" {
+			if len(logged) != 0 {
+				t.Errorf("%s: 记录了请求体: %s", c.name, logged[0].Message)
+			}
+			continue
+		}
+		if len(logged) != 1 || !strings.HasSuffix(logged[0].Message, c.want) {
+			t.Errorf("%s: 日志 %v, 期望包含 %q", c.name, logged, c.want)
+		}
+	}
+}
+
+// 开启sniff_content_type时请求体内容与声明的Content-Type明显不符返回415
+func TestSniffContentType(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	html := "<!DOCTYPE html><script>alert(1)</script>"
+
+	cases := []struct {
+		name        string
+		enabled     bool
+		contentType string
+		body        string
+		want        int
+	}{
+		{"图片内容相符", true, "image/png", png, http.StatusOK},
+		{"声明图片但内容是HTML", true, "image/png", html, http.StatusUnsupportedMediaType},
+		{"声明PNG但内容是GIF", true, "image/png", "GIF89a\x01\x00\x01\x00", http.StatusOK},
+		{"声明JSON但内容是HTML", true, "application/json", html, http.StatusUnsupportedMediaType},
+		{"JSON内容", true, "application/json; charset=utf-8", `{"id": 1}`, http.StatusOK},
+		{"SVG", true, "image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, http.StatusOK},
+		{"无法识别的内容", true, "audio/mpeg", "\x00\x01\x02\x03", http.StatusOK},
+		{"未开启", false, "image/png", html, http.StatusOK},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "sniff_content_type": `+strconv.FormatBool(c.enabled)+`}}}`)
+		req := httptest.NewRequest(http.MethodPost, "http://a.test/upload", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		if rec := serveProxy(handler, req); rec.Code != c.want {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, rec.Code, c.want)
+		}
+	}
+}
+
+// JSON请求体嵌套深度超过max_json_depth时返回400，非JSON或格式错误的请求体交由后端处理
+func TestMaxJSONDepth(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"未超过深度", "application/json", `{"a": [1, {"b": 2}]}`, http.StatusOK},
+		{"超过深度", "application/json", `{"a": [1, {"b": [3]}]}`, http.StatusBadRequest},
+		{"+json类型", "application/merge-patch+json", `[[[[1]]]]`, http.StatusBadRequest},
+		{"深度恢复后的兄弟节点", "application/json", `[[[1]], [[2]], [[3]]]`, http.StatusOK},
+		{"非JSON类型", "text/plain", `[[[[1]]]]`, http.StatusOK},
+		{"格式错误", "application/json", `[[[`, http.StatusOK},
+	}
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "max_json_depth": 3}}}`)
+	for _, c := range cases {
+		before := hits.Load()
+		req := httptest.NewRequest(http.MethodPost, "http://a.test/", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		rec := serveProxy(handler, req)
+		if rec.Code != c.want {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, rec.Code, c.want)
+		}
+		if forwarded := hits.Load() != before; forwarded != (c.want == http.StatusOK) {
+			t.Errorf("%s: 是否转发到后端 %v", c.name, forwarded)
+		}
+	}
+}
+
+// script中的on_request/on_response修改转发的请求和返回的响应，脚本出错时返回500
+func TestScript(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Backend", "1")
+		fmt.Fprintf(w, `{"request": "%s %s %s %s"}`, r.Method, r.URL.RequestURI(), r.Header.Get("X-Script"), body)
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name     string
+		script   string
+		wantCode int
+		wantBody string
+		header   string // 期望响应中X-Backend的值
+	}{
+		{"修改请求", `
+def on_request(req):
+    req["method"] = "PUT"
+    req["path"] = "/v2" + req["path"]
+    req["query"] = "id=1"
+    req["headers"]["X-Script"] = "yes"
+    req["body"] = req["body"].upper()
+`, http.StatusOK, `{"request": "PUT /v2/orders?id=1 yes BODY"}`, "1"},
+		{"修改响应", `
+def on_response(resp):
+    data = json.decode(resp["body"])
+    resp["status"] = 201
+    resp["headers"].pop("X-Backend")
+    resp["body"] = json.encode({"wrapped": data["request"]})
+`, http.StatusCreated, `{"wrapped":"POST /orders?a=1  body"}`, ""},
+		{"超出执行步数", `
+def on_request(req):
+    for i in range(100000):
+        req["body"] += ""
+`, http.StatusInternalServerError, "", ""},
+		{"返回无效的status", `
+def on_response(resp):
+    resp["status"] = "ok"
+`, http.StatusInternalServerError, "", ""},
+		{"返回无效的headers", `
+def on_request(req):
+    req["headers"] = None
+`, http.StatusInternalServerError, "", ""},
+	}
+	for _, c := range cases {
+		script := filepath.Join(t.TempDir(), "script.star")
+		if err := os.WriteFile(script, []byte(c.script), 0644); err != nil {
+			t.Fatal(err)
+		}
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "script": {"file": "`+script+`", "max_steps": 10000}}}}`)
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodPost, "http://a.test/orders?a=1", strings.NewReader("body")))
+		if rec.Code != c.wantCode || (c.wantBody != "" && rec.Body.String() != c.wantBody) {
+			t.Errorf("%s: %d %s, 期望 %d %s", c.name, rec.Code, rec.Body, c.wantCode, c.wantBody)
+		}
+		if c.wantCode < 300 && rec.Header().Get("X-Backend") != c.header {
+			t.Errorf("%s: X-Backend: %q, 期望 %q", c.name, rec.Header().Get("X-Backend"), c.header)
+		}
+	}
+
+	for _, invalid := range []string{"def on_request(req)\n", "x = 1\n", "on_request = 1\n"} {
+		script := filepath.Join(t.TempDir(), "script.star")
+		if err := os.WriteFile(script, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend_base": "http://b.test", "script": {"file": "` + script + `"}}}}`)); err == nil {
+			t.Errorf("%q: 期望加载配置失败", invalid)
+		}
+	}
+}
+
+// 后端域名连续解析失败dns_backoff.failures次后在冷却期内直接返回502，冷却后首次解析仍失败立即再次冷却
+func TestDNSBackoff(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "dns_backoff": {"failures": 2, "cooldown": "50ms"}}}}`)
+	var dials atomic.Int32
+	var resolvable atomic.Bool
+	dialer := &net.Dialer{}
+	handler.state.Load().clients[handler.extractDomain(backend.URL)] = &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			if !resolvable.Load() {
+				return nil, &net.DNSError{Err: "no such host", Name: "b.test", IsNotFound: true}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+
+	steps := []struct {
+		name       string
+		sleep      time.Duration
+		resolvable bool
+		wantCode   int
+		wantDial   bool
+	}{
+		{"首次解析失败", 0, false, http.StatusInternalServerError, true},
+		{"第二次解析失败进入冷却", 0, false, http.StatusInternalServerError, true},
+		{"冷却期内", 0, false, http.StatusBadGateway, false},
+		{"冷却后仍失败", 60 * time.Millisecond, false, http.StatusInternalServerError, true},
+		{"再次冷却", 0, false, http.StatusBadGateway, false},
+		{"冷却后恢复", 60 * time.Millisecond, true, http.StatusOK, true},
+		{"恢复后解析失败不立即冷却", 0, false, http.StatusInternalServerError, true},
+		{"未达到失败次数", 0, true, http.StatusOK, true},
+	}
+	for _, step := range steps {
+		time.Sleep(step.sleep)
+		resolvable.Store(step.resolvable)
+		before := dials.Load()
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil))
+		if rec.Code != step.wantCode || (dials.Load() != before) != step.wantDial {
+			t.Errorf("%s: 状态 %d, 解析后端: %t, 期望 %d %t", step.name, rec.Code, dials.Load() != before, step.wantCode, step.wantDial)
+		}
+	}
+}
+
+// request_id_body将转发给后端的请求ID写入JSON响应体的指定字段，其他响应原样返回
+func TestRequestIDBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Id", r.Header.Get("X-Request-ID"))
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name        string
+		field       string
+		contentType string
+		body        string
+		clientID    string
+		want        string // ID替换为实际转发的请求ID
+	}{
+		{"顶层字段", "_request_id", "application/json", `{"a":1}`, "", `{"_request_id":"ID","a":1}`},
+		{"创建嵌套对象", "meta.request_id", "application/json", `{"a":1.50}`, "", `{"a":1.50,"meta":{"request_id":"ID"}}`},
+		{"写入已有对象", "meta.request_id", "application/problem+json", `{"meta":{"v":2}}`, "", `{"meta":{"request_id":"ID","v":2}}`},
+		{"路径中存在非对象", "meta.request_id", "application/json", `{"meta":"x"}`, "", `{"meta":"x"}`},
+		{"顶层为数组", "_request_id", "application/json", `[1,2]`, "", `[1,2]`},
+		{"非JSON响应", "_request_id", "text/plain", `{"a":1}`, "", `{"a":1}`},
+		{"客户端携带请求ID", "_request_id", "application/json", `{}`, "client-id", `{"_request_id":"ID"}`},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"forward_client": true}, "request_id_body": {"field": "`+c.field+`"}}}}`)
+		req := httptest.NewRequest(http.MethodGet, "http://a.test/?"+url.Values{"type": {c.contentType}, "body": {c.body}}.Encode(), nil)
+		if c.clientID != "" {
+			req.Header.Set("X-Request-ID", c.clientID)
+		}
+		rec := serveProxy(handler, req)
+		id := rec.Header().Get("X-Seen-Id")
+		if len(id) != 32 && id != c.clientID {
+			t.Errorf("%s: 转发的请求ID %q", c.name, id)
+		}
+		if want := strings.ReplaceAll(c.want, "ID", id); rec.Body.String() != want || rec.Header().Get("Content-Length") != strconv.Itoa(len(want)) {
+			t.Errorf("%s: %s (Content-Length: %s), 期望 %s", c.name, rec.Body, rec.Header().Get("Content-Length"), want)
+		}
+	}
+
+	if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend_base": "http://b.test", "request_id_body": {}}}}`)); err == nil {
+		t.Error("缺少field时期望加载配置失败")
+	}
+}
+
+// size_routing按Content-Length选择后端，大小未知时使用unknown_size指定的后端
+func TestSizeRouting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name          string
+		unknownSize   string
+		contentLength int64
+		want          string
+	}{
+		{"小于阈值", "", 99, "/small/"},
+		{"等于阈值", "", 100, "/large/"},
+		{"大于阈值", "", 1000, "/large/"},
+		{"大小未知默认large", "", -1, "/large/"},
+		{"大小未知使用small", "small", -1, "/small/"},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"size_routing": {"threshold": "100B", "small": "BACKEND/small", "large": "BACKEND/large", "unknown_size": "`+c.unknownSize+`"}}}}`)
+		req := httptest.NewRequest(http.MethodPost, "http://a.test/", strings.NewReader(strings.Repeat("x", int(max(c.contentLength, 0)))))
+		req.ContentLength = c.contentLength
+		if got := serveProxy(handler, req).Body.String(); got != c.want {
+			t.Errorf("%s: 请求发往 %s, 期望 %s", c.name, got, c.want)
+		}
+	}
+
+	for _, invalid := range []string{
+		`"size_routing": {"threshold": "1MB", "small": "http://s.test"}`,
+		`"size_routing": {"small": "http://s.test", "large": "http://l.test"}`,
+		`"size_routing": {"threshold": "1MB", "small": "http://s.test", "large": "http://l.test", "unknown_size": "medium"}`,
+		`"size_routing": {"threshold": "1MB", "small": "http://s.test", "large": "http://l.test"}, "blue_green": {"blue": "http://b.test", "green": "http://g.test", "active": "blue"}`,
+	} {
+		if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {` + invalid + `}}}`)); err == nil {
+			t.Errorf("%s: 期望加载配置失败", invalid)
+		}
+	}
+}
+
+// 开启forward_trailers时后端响应的Trailer在响应体之后转发给客户端
+func TestForwardTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("body"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name    string
+		enabled bool
+		want    string
+	}{
+		{"转发Trailer", true, "abc"},
+		{"未开启", false, ""},
+	}
+	for _, c := range cases {
+		proxy := httptest.NewServer(newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "forward_trailers": `+strconv.FormatBool(c.enabled)+`}}}`))
+		defer proxy.Close()
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		req.Host = "a.test"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "body" || resp.Trailer.Get("X-Checksum") != c.want {
+			t.Errorf("%s: 响应体 %q, Trailer: %v, 期望 X-Checksum: %q", c.name, body, resp.Trailer, c.want)
+		}
+	}
+}
+
+// 后端响应Header数量（含同名Header的多个值）超过max_response_header_count时返回502
+func TestMaxResponseHeaderCount(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		for i := 0; i < n; i++ {
+			if r.URL.Query().Get("same") != "" {
+				w.Header().Add("X-Same", strconv.Itoa(i))
+			} else {
+				w.Header().Set("X-H-"+strconv.Itoa(i), "1")
+			}
+		}
+	}))
+	defer backend.Close()
+
+	// 后端另外返回Date和Content-Length两个Header
+	cases := []struct {
+		name  string
+		limit int
+		query string
+		want  int
+	}{
+		{"未超出", 10, "n=8", http.StatusOK},
+		{"超出", 10, "n=9", http.StatusBadGateway},
+		{"同名Header的多个值", 10, "n=9&same=1", http.StatusBadGateway},
+		{"默认上限", 0, "n=998", http.StatusOK},
+		{"超出默认上限", 0, "n=999", http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"max_response_header_count": `+strconv.Itoa(c.limit)+`}}}}`)
+		if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/?"+c.query, nil)); rec.Code != c.want {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, rec.Code, c.want)
+		}
+	}
+}
+
+// cdn_headers为GET的200响应补充ETag、Cache-Control和Vary，不覆盖后端已设置的值
+func TestCDNHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range r.URL.Query() {
+			if key != "status" {
+				w.Header()[key] = values
+			}
+		}
+		if status, _ := strconv.Atoi(r.URL.Query().Get("status")); status != 0 {
+			w.WriteHeader(status)
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "cdn_headers": {"etag": true, "cache_control": "public, max-age=60", "vary": ["Accept-Encoding", "Accept"]}}}}`)
+	sum := sha256.Sum256([]byte("hello"))
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+
+	cases := []struct {
+		name   string
+		method string
+		query  string
+		want   http.Header
+	}{
+		{"补充缓存头", http.MethodGet, "", http.Header{"Etag": {etag}, "Cache-Control": {"public, max-age=60"}, "Vary": {"Accept-Encoding", "Accept"}}},
+		{"保留后端的值", http.MethodGet, "?ETag=%22v1%22&Cache-Control=no-store&Vary=accept", http.Header{"Etag": {`"v1"`}, "Cache-Control": {"no-store"}, "Vary": {"accept", "Accept-Encoding"}}},
+		{"Vary为*", http.MethodGet, "?Vary=*", http.Header{"Etag": {etag}, "Cache-Control": {"public, max-age=60"}, "Vary": {"*"}}},
+		{"非200响应", http.MethodGet, "?status=404", http.Header{}},
+		{"POST请求", http.MethodPost, "", http.Header{}},
+	}
+	for _, c := range cases {
+		rec := serveProxy(handler, httptest.NewRequest(c.method, "http://a.test/"+c.query, nil))
+		for _, key := range []string{"Etag", "Cache-Control", "Vary"} {
+			if got := rec.Header()[key]; !reflect.DeepEqual(got, c.want[key]) {
+				t.Errorf("%s: %s: %q, 期望 %q", c.name, key, got, c.want[key])
+			}
+		}
+	}
+}
+
+// 请求体上传速度低于min_body_rate时中止读取并返回408，客户端停止发送时同样生效
+func TestMinBodyRate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	proxy := httptest.NewServer(newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "min_body_rate": {"rate": "100B", "grace": "50ms"}}}}`))
+	defer proxy.Close()
+
+	cases := []struct {
+		name   string
+		chunks []string // 依次发送的请求体片段，片段之间间隔pause
+		pause  time.Duration
+		want   int
+	}{
+		{"一次发送", []string{strings.Repeat("x", 20)}, 0, http.StatusOK},
+		{"速度足够", []string{"0123456789", "0123456789"}, 50 * time.Millisecond, http.StatusOK},
+		{"速度过慢", []string{"0123456789", "0123456789"}, 500 * time.Millisecond, http.StatusRequestTimeout},
+		{"停止发送", []string{"0123456789"}, time.Second, http.StatusRequestTimeout},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: a.test\r\nContent-Length: 20\r\n\r\n")
+		for i, chunk := range c.chunks {
+			if i > 0 || len(c.chunks) == 1 {
+				time.Sleep(c.pause)
+			}
+			conn.Write([]byte(chunk))
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if resp.StatusCode != c.want {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, resp.StatusCode, c.want)
+		}
+		conn.Close()
+	}
+}
+
+// 开启stream_on_sse时SSE请求流式转发，事件在后端响应结束前到达客户端；未开启时SSE请求照常缓冲转发，
+// 依赖完整body的校验仍然生效
+func TestStreamOnSSE(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	cases := []struct {
+		name      string
+		rule      string
+		body      string
+		wantCode  int
+		wantEvent bool // 后端响应结束前是否收到事件
+	}{
+		{"开启stream_on_sse", `"stream_on_sse": true`, "", http.StatusOK, true},
+		{"未开启时校验请求体", `"max_json_depth": 1`, `{"a": {"b": 1}}`, http.StatusBadRequest, false},
+	}
+	for _, c := range cases {
+		proxy := httptest.NewServer(newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", `+c.rule+`}}}`))
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL, strings.NewReader(c.body))
+		req.Host = "a.test"
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if resp.StatusCode != c.wantCode {
+			t.Errorf("%s: 状态 %d, 期望 %d", c.name, resp.StatusCode, c.wantCode)
+		}
+		if c.wantEvent {
+			line, err := bufio.NewReader(resp.Body).ReadString('\n')
+			if err != nil || line != "data: 1\n" {
+				t.Errorf("%s: 读取事件 %q %v", c.name, line, err)
+			}
+		}
+		resp.Body.Close()
+		proxy.Close()
+	}
+
+	// stream_on_sse与依赖完整body的选项不能同时开启
+	if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend_base": "http://b", "stream_on_sse": true, "max_json_depth": 1}}}`)); err == nil {
+		t.Error("stream_on_sse与max_json_depth同时开启时未报错")
+	}
+}
+
+// 开启server.early_data时，以早期数据发送的安全方法请求正常转发并携带Early-Data，其他方法返回425
+func TestEarlyData(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Early-Data", r.Header.Get("Early-Data"))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name      string
+		enabled   bool
+		stream    bool
+		method    string
+		earlyData string
+		wantCode  int
+		wantEarly string // 后端收到的Early-Data
+	}{
+		{"GET", true, false, http.MethodGet, "1", http.StatusOK, "1"},
+		{"HEAD", true, false, http.MethodHead, "1", http.StatusOK, "1"},
+		{"POST", true, false, http.MethodPost, "1", http.StatusTooEarly, ""},
+		{"DELETE", true, false, http.MethodDelete, "1", http.StatusTooEarly, ""},
+		{"握手完成后的POST", true, false, http.MethodPost, "", http.StatusOK, ""},
+		{"未开启", false, false, http.MethodPost, "1", http.StatusOK, ""},
+		{"流式转发GET", true, true, http.MethodGet, "1", http.StatusOK, "1"},
+		{"流式转发POST", true, true, http.MethodPost, "1", http.StatusTooEarly, ""},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"server": {"early_data": `+strconv.FormatBool(c.enabled)+`}, "transit_map": {"a.test": {"backend_base": "BACKEND", "stream": `+strconv.FormatBool(c.stream)+`}}}`)
+		req := httptest.NewRequest(c.method, "http://a.test/", strings.NewReader("body"))
+		if c.earlyData != "" {
+			req.Header.Set("Early-Data", c.earlyData)
+		}
+		rec := serveProxy(handler, req)
+		if rec.Code != c.wantCode || rec.Header().Get("X-Early-Data") != c.wantEarly {
+			t.Errorf("%s: 状态 %d, 后端收到Early-Data %q, 期望 %d %q", c.name, rec.Code, rec.Header().Get("X-Early-Data"), c.wantCode, c.wantEarly)
+		}
+	}
+}
+
+// HTTP/1.0请求未携带Host时使用server.default_host，携带Connection: keep-alive时保持连接
+func TestHTTP10(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, r.Host+r.URL.Path)
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+	proxy := httptest.NewServer(newTestProxy(t, backend, `{"server": {"default_host": "a.test"},
+		"transit_map": {"a.test": {"backend_base": "BACKEND", "forward_trailers": true}, "b.test": {"backend_base": "BACKEND"}}}`))
+	defer proxy.Close()
+
+	cases := []struct {
+		name      string
+		requests  []string // 在同一连接上依次发送的请求
+		want      []string // 各请求期望的响应体后缀
+		keepAlive bool
+	}{
+		{"未携带Host使用default_host", []string{"GET /x HTTP/1.0\r\n\r\n"}, []string{"/x"}, false},
+		{"携带Host", []string{"GET /y HTTP/1.0\r\nHost: b.test\r\n\r\n"}, []string{"/y"}, false},
+		{"keep-alive复用连接", []string{
+			"GET /1 HTTP/1.0\r\nConnection: keep-alive\r\n\r\n",
+			"GET /2 HTTP/1.0\r\nHost: b.test\r\nConnection: keep-alive\r\n\r\n",
+		}, []string{"/1", "/2"}, true},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		for i, request := range c.requests {
+			io.WriteString(conn, request)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("%s: 第 %d 个请求: %v", c.name, i+1, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || !strings.HasSuffix(string(body), c.want[i]) {
+				t.Errorf("%s: 第 %d 个请求: %d %q, 期望 200 *%s", c.name, i+1, resp.StatusCode, body, c.want[i])
+			}
+			if resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) > 0 {
+				t.Errorf("%s: 第 %d 个请求: Content-Length %d, Transfer-Encoding %v", c.name, i+1, resp.ContentLength, resp.TransferEncoding)
+			}
+			if resp.Close == c.keepAlive {
+				t.Errorf("%s: 第 %d 个请求: 连接关闭 %v, 期望保持 %v", c.name, i+1, resp.Close, c.keepAlive)
+			}
+		}
+		conn.Close()
+	}
+
+	if _, err := ParseConfig([]byte(`{"server": {"default_host": "c.test"}, "transit_map": {"a.test": {"backend": "http://b"}}}`)); err == nil {
+		t.Error("default_host没有转发规则时期望加载失败")
+	}
+}
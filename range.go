@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+)
+
+// 客户端的Range请求是否由代理根据完整响应体处理
+func rangeRequested(r *http.Request, rule TransitRule) bool {
+	return rule.ServeRanges && r.Method == http.MethodGet && r.Header.Get("Range") != ""
+}
+
+// 从完整响应体中截取Range指定的部分返回，
+// 多段Range返回multipart/byteranges，无效Range返回416
+func serveRange(w http.ResponseWriter, r *http.Request, header http.Header, body []byte) {
+	for key, values := range header {
+		switch key {
+		case "Content-Length", "Content-Range", "Accept-Ranges":
+			continue
+		}
+		w.Header()[key] = values
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	// If-Range按Last-Modified或ETag判断，ServeContent从w.Header()中读取ETag
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
+
+// 后端未声明Accept-Ranges时，为匹配类型的完整响应补充Accept-Ranges: bytes
+func advertiseRanges(r *http.Request, trace *ProxyTrace, types []string) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || trace.StatusCode != http.StatusOK {
+		return
+	}
+	if trace.ResponseHeaders.Get("Accept-Ranges") != "" {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(trace.ResponseHeaders.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+	for _, pattern := range types {
+		if mediaTypeMatches(mediaType, pattern) {
+			trace.ResponseHeaders.Set("Accept-Ranges", "bytes")
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 开启serve_ranges时向后端请求完整响应体，由代理按客户端的Range返回206
+func TestServeRanges(t *testing.T) {
+	var backendRange atomic.Value
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		backendRange.Store(r.Header.Get("Range"))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("0123456789"))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name        string
+		path        string
+		rangeHeader string
+		wantCode    int
+		wantType    string
+		wantBody    []string // 响应体需包含的内容
+		cached      bool     // 是否应直接从缓存返回
+	}{
+		{"单段Range", "/file", "bytes=2-5", http.StatusPartialContent, "text/plain", []string{"2345"}, false},
+		{"后缀Range", "/file", "bytes=-3", http.StatusPartialContent, "text/plain", []string{"789"}, false},
+		{"超出范围", "/file", "bytes=20-30", http.StatusRequestedRangeNotSatisfiable, "", nil, false},
+		{"多段Range", "/file", "bytes=0-1,8-9", http.StatusPartialContent, "multipart/byteranges", []string{"\r\n01\r\n", "\r\n89\r\n"}, false},
+		{"无Range", "/file", "", http.StatusOK, "text/plain", []string{"0123456789"}, false},
+		// 第二次请求从缓存返回，同样按Range截取
+		{"首次请求写入缓存", "/cached", "bytes=0-2", http.StatusPartialContent, "text/plain", []string{"012"}, false},
+		{"缓存命中", "/cached", "bytes=3-4", http.StatusPartialContent, "text/plain", []string{"34"}, true},
+	}
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"forward_client": true}, "serve_ranges": true, "cache": {"ttl": "1m"}}}}`)
+	for _, c := range cases {
+		backendRange.Store("")
+		before := hits.Load()
+		req := httptest.NewRequest(http.MethodGet, "http://a.test"+c.path, nil)
+		if c.rangeHeader != "" {
+			req.Header.Set("Range", c.rangeHeader)
+		}
+		rec := serveProxy(handler, req)
+		if rec.Code != c.wantCode || !strings.HasPrefix(rec.Header().Get("Content-Type"), c.wantType) {
+			t.Errorf("%s: %d %s, 期望 %d %s", c.name, rec.Code, rec.Header().Get("Content-Type"), c.wantCode, c.wantType)
+		}
+		for _, want := range c.wantBody {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("%s: 响应体 %q 不包含 %q", c.name, rec.Body, want)
+			}
+		}
+		if got := backendRange.Load(); got != "" {
+			t.Errorf("%s: 后端收到了Range: %v", c.name, got)
+		}
+		if c.cached && hits.Load() != before {
+			t.Errorf("%s: 请求了后端", c.name)
+		}
+	}
+}
+
+// 开启range_cache时已缓存的范围直接返回，只向后端请求缺失的部分，文件变化时替换缓存
+func TestRangeCache(t *testing.T) {
+	var content atomic.Value
+	content.Store("0123456789abcdef")
+	var backendRange, backendIfRange atomic.Value
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		backendRange.Store(r.Header.Get("Range"))
+		backendIfRange.Store(r.Header.Get("If-Range"))
+		body := content.Load().(string)
+		w.Header().Set("ETag", `"`+body+`"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name        string
+		content     string // 不为空时在请求前替换后端文件
+		rangeHeader string
+		wantBody    string
+		wantFetch   string // 后端收到的Range，为空表示不应请求后端
+		wantIfRange bool
+	}{
+		{"首次请求", "", "bytes=0-3", "0123", "bytes=0-3", false},
+		{"部分重叠只请求缺失部分", "", "bytes=2-7", "234567", "bytes=4-7", true},
+		{"已全部缓存", "", "bytes=1-6", "123456", "", false},
+		{"后缀Range", "", "bytes=-4", "cdef", "bytes=12-15", true},
+		{"文件变化后替换缓存", "ABCDEFGHIJKLMNOP", "bytes=8-11", "IJKL", "bytes=8-11", true},
+		{"替换后的完整缓存", "", "bytes=0-3", "ABCD", "", false},
+	}
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "range_cache": {"ttl": "1m"}}}}`)
+	for _, c := range cases {
+		if c.content != "" {
+			content.Store(c.content)
+		}
+		backendRange.Store("")
+		backendIfRange.Store("")
+		before := hits.Load()
+		req := httptest.NewRequest(http.MethodGet, "http://a.test/video", nil)
+		req.Header.Set("Range", c.rangeHeader)
+		rec := serveProxy(handler, req)
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != c.wantBody {
+			t.Errorf("%s: %d %q, 期望 206 %q", c.name, rec.Code, rec.Body, c.wantBody)
+		}
+		if rec.Header().Get("Content-Length") != strconv.Itoa(len(c.wantBody)) {
+			t.Errorf("%s: Content-Length %s", c.name, rec.Header().Get("Content-Length"))
+		}
+		if c.wantFetch == "" {
+			if hits.Load() != before {
+				t.Errorf("%s: 请求了后端", c.name)
+			}
+			continue
+		}
+		if got := backendRange.Load(); got != c.wantFetch {
+			t.Errorf("%s: 后端收到Range %v, 期望 %s", c.name, got, c.wantFetch)
+		}
+		if got := backendIfRange.Load(); (got != "") != c.wantIfRange {
+			t.Errorf("%s: 后端收到If-Range %q", c.name, got)
+		}
+	}
+
+	if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend": "http://b", "serve_ranges": true, "range_cache": {}}}}`)); err == nil {
+		t.Error("range_cache和serve_ranges同时开启时期望加载失败")
+	}
+}
+
+// accept_ranges为匹配类型的完整响应补充Accept-Ranges，客户端随后的Range请求返回206
+func TestAcceptRanges(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if value := r.URL.Query().Get("accept"); value != "" {
+			w.Header().Set("Accept-Ranges", value)
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"匹配通配符", "?type=video/mp4", "bytes"},
+		{"匹配完整类型", "?type=application/octet-stream", "bytes"},
+		{"类型不匹配", "?type=text/html", ""},
+		{"后端已声明", "?type=video/mp4&accept=none", "none"},
+	}
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "serve_ranges": true, "accept_ranges": ["video/*", "application/octet-stream"]}}}`)
+	for _, c := range cases {
+		rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/file"+c.query, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Accept-Ranges") != c.want {
+			t.Errorf("%s: %d Accept-Ranges %q, 期望 %q", c.name, rec.Code, rec.Header().Get("Accept-Ranges"), c.want)
+		}
+		if c.want != "bytes" {
+			continue
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://a.test/file"+c.query, nil)
+		req.Header.Set("Range", "bytes=2-4")
+		if rec := serveProxy(handler, req); rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+			t.Errorf("%s: Range请求 %d %q, 期望 206 \"234\"", c.name, rec.Code, rec.Body)
+		}
+	}
+
+	if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend": "http://b", "accept_ranges": ["video/*"]}}}`)); err == nil {
+		t.Error("accept_ranges没有处理Range的方式时期望加载失败")
+	}
+}
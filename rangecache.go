@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 单段Range，start为负数表示取最后-start个字节，end为负数表示到结尾
+type byteRange struct {
+	start, end int64
+}
+
+// 只解析单段Range，多段或格式无效时返回false
+func parseByteRange(header string) (byteRange, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false
+		}
+		return byteRange{start: -n, end: -1}, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+	if last == "" {
+		return byteRange{start: start, end: -1}, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return byteRange{}, false
+	}
+	return byteRange{start: start, end: end}, true
+}
+
+// 按对象大小换算为闭区间，范围无法满足时返回false
+func (b byteRange) resolve(size int64) (int64, int64, bool) {
+	start, end := b.start, b.end
+	if start < 0 {
+		start = max(0, size+start)
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	return start, end, start <= end
+}
+
+// 解析"bytes a-b/size"，总大小未知时返回false
+func parseContentRange(header string) (start, end, size int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	span, total, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	start, err1 = strconv.ParseInt(first, 10, 64)
+	end, err2 = strconv.ParseInt(last, 10, 64)
+	size, err3 = strconv.ParseInt(total, 10, 64)
+	ok = err1 == nil && err2 == nil && err3 == nil && 0 <= start && start <= end && end < size
+	return start, end, size, ok
+}
+
+type rangeSegment struct {
+	start int64
+	data  []byte
+}
+
+func (s rangeSegment) end() int64 {
+	return s.start + int64(len(s.data))
+}
+
+// 已缓存部分字节范围的对象，更新时整体替换，读取时无需加锁
+type rangeObject struct {
+	Size     int64
+	Header   http.Header
+	segments []rangeSegment // 按起始位置排序，互不重叠且不相邻
+	Expires  time.Time
+}
+
+// 请求缺失部分时携带的If-Range，弱ETag不能用于If-Range
+func (o *rangeObject) validator() string {
+	if etag := o.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return o.Header.Get("Last-Modified")
+}
+
+// 闭区间[start, end]中第一个和最后一个未缓存的字节，全部已缓存时first > last
+func (o *rangeObject) missing(start, end int64) (first, last int64) {
+	first, last = start, end
+	for _, seg := range o.segments {
+		if seg.start <= first && first < seg.end() {
+			first = seg.end()
+		}
+	}
+	for i := len(o.segments) - 1; i >= 0; i-- {
+		if seg := o.segments[i]; seg.start <= last && last < seg.end() {
+			last = seg.start - 1
+		}
+	}
+	return first, last
+}
+
+// 范围已全部缓存，或按对象大小可判定为无效范围
+func (o *rangeObject) covers(want byteRange) bool {
+	start, end, ok := want.resolve(o.Size)
+	if !ok {
+		return true
+	}
+	first, last := o.missing(start, end)
+	return first > last
+}
+
+func (o *rangeObject) serve(w http.ResponseWriter, want byteRange) error {
+	start, end, ok := want.resolve(o.Size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", o.Size))
+		http.Error(w, "请求的范围无效", http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+
+	var data []byte
+	for _, seg := range o.segments {
+		if seg.start <= start && end < seg.end() {
+			data = seg.data[start-seg.start : end-seg.start+1]
+			break
+		}
+	}
+
+	for key, values := range o.Header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, o.Size))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusPartialContent)
+	_, err := w.Write(data)
+	return err
+}
+
+// 合并新取得的字节范围，返回新的分段列表
+func mergeSegments(segments []rangeSegment, added rangeSegment) []rangeSegment {
+	merged := make([]rangeSegment, 0, len(segments)+1)
+	inserted := false
+	for _, seg := range segments {
+		if !inserted && added.start < seg.start {
+			merged = appendSegment(merged, added)
+			inserted = true
+		}
+		merged = appendSegment(merged, seg)
+	}
+	if !inserted {
+		merged = appendSegment(merged, added)
+	}
+	return merged
+}
+
+// 追加分段，与最后一个分段重叠或相邻时拼接
+func appendSegment(segments []rangeSegment, seg rangeSegment) []rangeSegment {
+	if n := len(segments); n > 0 && seg.start <= segments[n-1].end() {
+		last := segments[n-1]
+		if seg.end() > last.end() {
+			data := make([]byte, 0, seg.end()-last.start)
+			data = append(data, last.data...)
+			data = append(data, seg.data[last.end()-seg.start:]...)
+			segments[n-1] = rangeSegment{start: last.start, data: data}
+		}
+		return segments
+	}
+	return append(segments, seg)
+}
+
+// 一次Range请求的查找结果
+type rangeLookup struct {
+	key    string
+	want   byteRange
+	object *rangeObject // 查找时已缓存的对象，可能为空
+	fetch  string       // 需要向后端请求的Range，为空表示已全部缓存
+}
+
+// 已缓存部分范围时只向后端请求缺失的部分
+func (l *rangeLookup) rewritten() bool {
+	return l.object != nil && l.fetch != ""
+}
+
+// 按字节范围缓存后端响应，重叠的Range请求由缓存返回，只向后端请求缺失的部分
+type RangeCache struct {
+	mu      sync.Mutex
+	objects map[string]*rangeObject
+}
+
+func NewRangeCache() *RangeCache {
+	return &RangeCache{objects: make(map[string]*rangeObject)}
+}
+
+// 多段Range不使用缓存，返回nil
+func (c *RangeCache) Lookup(key, header string) *rangeLookup {
+	want, ok := parseByteRange(header)
+	if !ok {
+		return nil
+	}
+	lookup := &rangeLookup{key: key, want: want, fetch: header}
+
+	c.mu.Lock()
+	object := c.objects[key]
+	c.mu.Unlock()
+	if object == nil || !time.Now().Before(object.Expires) {
+		return lookup
+	}
+
+	lookup.object = object
+	start, end, ok := want.resolve(object.Size)
+	if !ok {
+		lookup.fetch = ""
+		return lookup
+	}
+	if first, last := object.missing(start, end); first <= last {
+		lookup.fetch = fmt.Sprintf("bytes=%d-%d", first, last)
+	} else {
+		lookup.fetch = ""
+	}
+	return lookup
+}
+
+// 将后端的200或206响应并入缓存，返回合并后的对象，响应无法使用时返回nil。
+// 没有ETag/Last-Modified的部分响应无法判断是否属于同一版本，只用于本次返回，不写入缓存
+func (c *RangeCache) Store(lookup *rangeLookup, trace *ProxyTrace, config *RangeCacheConfig) *rangeObject {
+	if trace.ResponseHeaders.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	header := trace.ResponseHeaders.Clone()
+	header.Del("Content-Length")
+	header.Del("Content-Range")
+	object := &rangeObject{Header: header, Expires: time.Now().Add(time.Duration(config.TTL))}
+
+	switch trace.StatusCode {
+	case http.StatusOK:
+		object.Size = int64(len(trace.ResponseBody))
+		object.segments = []rangeSegment{{start: 0, data: trace.ResponseBody}}
+	case http.StatusPartialContent:
+		start, end, size, ok := parseContentRange(trace.ResponseHeaders.Get("Content-Range"))
+		if !ok || int64(len(trace.ResponseBody)) != end-start+1 {
+			return nil
+		}
+		object.Size = size
+		added := rangeSegment{start: start, data: trace.ResponseBody}
+		if old := lookup.object; old != nil && old.Size == size && old.validator() != "" && old.validator() == object.validator() {
+			object.segments = mergeSegments(old.segments, added)
+		} else {
+			object.segments = []rangeSegment{added}
+		}
+		if object.validator() == "" {
+			return object
+		}
+	default:
+		return nil
+	}
+
+	if object.Size > int64(config.MaxObjectSize) {
+		return object
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.objects[lookup.key]; !ok && len(c.objects) >= maxCacheEntries {
+		now := time.Now()
+		for key, cached := range c.objects {
+			if !now.Before(cached.Expires) {
+				delete(c.objects, key)
+			}
+		}
+		if len(c.objects) >= maxCacheEntries {
+			return object
+		}
+	}
+	c.objects[lookup.key] = object
+	return object
+}
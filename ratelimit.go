@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 按客户端限流时最多跟踪的客户端数，超出时清理已回满的令牌桶
+const maxRateLimitClients = 100000
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Redis中的令牌桶，使用Redis的时间计算补充的令牌，所有实例看到的时间一致；
+// 返回是否允许和被限流时需要等待的毫秒数
+const rateLimitScript = `
+if redis.replicate_commands then
+	redis.replicate_commands()
+end
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+if allowed == 1 then
+	return {1, 0}
+end
+return {0, math.ceil((1 - tokens) / rate * 1000)}
+`
+
+// Redis不可用后改用本地令牌桶，间隔多久再尝试Redis
+const redisRetryInterval = time.Second
+
+// 令牌桶限流，按客户端限流时每个客户端IP使用独立的令牌桶；配置了redis时令牌桶保存在Redis中由所有实例共享，
+// Redis不可用时改用本地令牌桶
+type RateLimiter struct {
+	name    string // 转发规则的key，用作Redis键的一部分
+	config  *RateLimitConfig
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	redis      *RedisClient
+	redisRetry atomic.Int64 // Redis不可用时下次尝试的时间（UnixNano），0表示可用
+
+	tiers map[string]*RateLimiter // 按用户等级使用独立的令牌桶
+	queue *priorityQueue          // max_concurrent的并发槽位，为空则不限制
+}
+
+func NewRateLimiter(name string, config *RateLimitConfig) *RateLimiter {
+	l := &RateLimiter{name: name, config: config, buckets: make(map[string]*tokenBucket), tiers: make(map[string]*RateLimiter)}
+	if config.Redis != nil {
+		l.redis = NewRedisClient(config.Redis)
+	}
+	for tier, tierConfig := range config.Tiers {
+		l.tiers[tier] = NewRateLimiter(name+":"+tier, &RateLimitConfig{Rate: tierConfig.Rate, Burst: tierConfig.Burst, PerClient: config.PerClient, Redis: config.Redis})
+	}
+	if config.MaxConcurrent > 0 {
+		l.queue = newPriorityQueue(config.MaxConcurrent)
+	}
+	return l
+}
+
+// 请求的用户等级：来自受信任代理的请求取tier_header，未配置或不在tiers中时返回空字符串
+func (l *RateLimiter) Tier(r *http.Request) string {
+	if l.config.TierHeader == "" {
+		return ""
+	}
+	if addr, ok := r.Context().Value(clientAddrKey{}).(clientAddr); !ok || !addr.trustedProxy {
+		return ""
+	}
+	tier := r.Header.Get(l.config.TierHeader)
+	if _, ok := l.tiers[tier]; !ok {
+		return ""
+	}
+	return tier
+}
+
+// 按用户等级取一个令牌，tier为空时使用顶层的限额
+func (l *RateLimiter) AllowTier(tier, client string) (time.Duration, bool) {
+	if limiter, ok := l.tiers[tier]; ok {
+		return limiter.Allow(client)
+	}
+	return l.Allow(client)
+}
+
+// 取一个max_concurrent的并发槽位，已满时按等级的priority排队，排队超过queue_timeout或ctx结束时返回false；
+// 未配置max_concurrent时总是成功
+func (l *RateLimiter) Acquire(ctx context.Context, tier string) (func(), bool) {
+	if l.queue == nil {
+		return func() {}, true
+	}
+	var priority int
+	if tierConfig, ok := l.config.Tiers[tier]; ok {
+		priority = tierConfig.Priority
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(l.config.QueueTimeout))
+	defer cancel()
+	return l.queue.Acquire(ctx, priority)
+}
+
+// 取一个令牌，被限流时返回需要等待的时间
+func (l *RateLimiter) Allow(client string) (time.Duration, bool) {
+	if !l.config.PerClient {
+		client = ""
+	}
+
+	if l.redis != nil {
+		if wait, ok, err := l.allowRedis(client); err == nil {
+			return wait, ok
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitClients {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: float64(l.config.Burst), last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.config.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.config.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / l.config.Rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
+
+// 从Redis中的令牌桶取一个令牌，Redis不可用时返回错误，之后redisRetryInterval内不再尝试
+func (l *RateLimiter) allowRedis(client string) (time.Duration, bool, error) {
+	if retry := l.redisRetry.Load(); retry != 0 && time.Now().UnixNano() < retry {
+		return 0, false, fmt.Errorf("Redis不可用")
+	}
+	reply, err := l.redis.Eval(rateLimitScript, []string{l.config.Redis.KeyPrefix + l.name + ":" + client},
+		strconv.FormatFloat(l.config.Rate, 'f', -1, 64), strconv.Itoa(l.config.Burst))
+	var result []interface{}
+	if err == nil {
+		if result, _ = reply.([]interface{}); len(result) != 2 {
+			err = fmt.Errorf("无效的脚本返回值: %v", reply)
+		}
+	}
+	if err != nil {
+		if l.redisRetry.Swap(time.Now().Add(redisRetryInterval).UnixNano()) == 0 {
+			log.Warnf("限流 %s: Redis不可用，改用本地限流: %v", l.name, err)
+		}
+		return 0, false, err
+	}
+	if l.redisRetry.Swap(0) != 0 {
+		log.Infof("限流 %s: Redis已恢复", l.name)
+	}
+	allowed, _ := result[0].(int64)
+	wait, _ := result[1].(int64)
+	return time.Duration(wait) * time.Millisecond, allowed == 1, nil
+}
+
+// 关闭到Redis的空闲连接
+func (l *RateLimiter) Close() {
+	if l.redis != nil {
+		l.redis.Close()
+	}
+	for _, limiter := range l.tiers {
+		limiter.Close()
+	}
+}
+
+// 已回满的令牌桶与新建的没有区别，可以删除
+func (l *RateLimiter) prune(now time.Time) {
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.config.Rate >= float64(l.config.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// 排队等待并发槽位的请求
+type queueWaiter struct {
+	priority int
+	ready    chan struct{} // 分配到槽位时关闭
+}
+
+// 按优先级分配的并发槽位，槽位释放时交给优先级最高的等待者，同优先级先到先得
+type priorityQueue struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiters []*queueWaiter // 按优先级从高到低排列
+}
+
+func newPriorityQueue(limit int) *priorityQueue {
+	return &priorityQueue{limit: limit}
+}
+
+func (q *priorityQueue) Acquire(ctx context.Context, priority int) (func(), bool) {
+	q.mu.Lock()
+	if q.active < q.limit {
+		q.active++
+		q.mu.Unlock()
+		return q.release, true
+	}
+	w := &queueWaiter{priority: priority, ready: make(chan struct{})}
+	i := sort.Search(len(q.waiters), func(i int) bool { return q.waiters[i].priority < priority })
+	q.waiters = append(q.waiters, nil)
+	copy(q.waiters[i+1:], q.waiters[i:])
+	q.waiters[i] = w
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return q.release, true
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, waiter := range q.waiters {
+		if waiter == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return nil, false
+		}
+	}
+	// 超时的同时已分配到槽位，交给下一个等待者
+	q.releaseLocked()
+	return nil, false
+}
+
+func (q *priorityQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *priorityQueue) releaseLocked() {
+	if len(q.waiters) == 0 {
+		q.active--
+		return
+	}
+	w := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	close(w.ready)
+}
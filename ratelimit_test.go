@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟执行限流脚本的Redis，令牌桶在Go中实现，只支持AUTH、SELECT、EVALSHA和EVAL
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu      sync.Mutex
+	scripts map[string]bool
+	buckets map[string]*tokenBucket
+	evals   int // 收到的EVAL次数
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, password: password, scripts: make(map[string]bool), buckets: make(map[string]*tokenBucket)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		request, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		args, _ := request.([]interface{})
+		cmd := args[0].(string)
+		switch {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			if !authed {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case cmd == "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "EVALSHA" || cmd == "EVAL":
+			fmt.Fprint(conn, f.eval(cmd, args[1:]))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+		}
+	}
+}
+
+func (f *fakeRedis) eval(cmd string, args []interface{}) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cmd == "EVAL" {
+		f.evals++
+		sum := sha1.Sum([]byte(args[0].(string)))
+		f.scripts[hex.EncodeToString(sum[:])] = true
+	} else if !f.scripts[args[0].(string)] {
+		return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	}
+	key := args[2].(string)
+	rate, _ := strconv.ParseFloat(args[3].(string), 64)
+	burst, _ := strconv.ParseFloat(args[4].(string), 64)
+	now := time.Now()
+	bucket, ok := f.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		f.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return fmt.Sprintf("*2\r\n:0\r\n:%d\r\n", int(math.Ceil((1-bucket.tokens)/rate*1000)))
+	}
+	bucket.tokens--
+	return "*2\r\n:1\r\n:0\r\n"
+}
+
+func redisRateLimitConfig(addr, password string) *RateLimitConfig {
+	return &RateLimitConfig{Rate: 0.1, Burst: 2, Redis: &RedisConfig{Addr: addr, Password: password, DB: 1, KeyPrefix: "test:", Timeout: Duration(time.Second)}}
+}
+
+// 多个实例通过Redis共享同一个令牌桶
+func TestRateLimiterRedisSharedAcrossInstances(t *testing.T) {
+	redis := newFakeRedis(t, "secret")
+	a := NewRateLimiter("a.test", redisRateLimitConfig(redis.listener.Addr().String(), "secret"))
+	defer a.Close()
+	b := NewRateLimiter("a.test", redisRateLimitConfig(redis.listener.Addr().String(), "secret"))
+	defer b.Close()
+
+	if _, ok := a.Allow(""); !ok {
+		t.Fatal("实例a的第1个请求被限流")
+	}
+	if _, ok := b.Allow(""); !ok {
+		t.Fatal("实例b的第1个请求被限流")
+	}
+	wait, ok := a.Allow("")
+	if ok {
+		t.Fatal("两个实例共享burst=2，第3个请求应被限流")
+	}
+	if wait < 9*time.Second || wait > 10*time.Second {
+		t.Errorf("等待时间 %v, 期望约10s", wait)
+	}
+	if _, ok := b.Allow(""); ok {
+		t.Error("实例b的第2个请求应被限流")
+	}
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	if _, ok := redis.buckets["test:a.test:"]; !ok {
+		t.Errorf("Redis键不符合预期: %v", redis.buckets)
+	}
+	// 每个连接只在首次执行时发送脚本，之后使用EVALSHA
+	if redis.evals != 1 {
+		t.Errorf("EVAL执行了 %d 次, 期望1次", redis.evals)
+	}
+}
+
+func TestRateLimiterRedisPerClient(t *testing.T) {
+	redis := newFakeRedis(t, "")
+	config := redisRateLimitConfig(redis.listener.Addr().String(), "")
+	config.Burst, config.PerClient = 1, true
+	l := NewRateLimiter("a.test", config)
+	defer l.Close()
+
+	if _, ok := l.Allow("10.0.0.1"); !ok {
+		t.Fatal("10.0.0.1的第1个请求被限流")
+	}
+	if _, ok := l.Allow("10.0.0.2"); !ok {
+		t.Fatal("10.0.0.2的第1个请求被限流")
+	}
+	if _, ok := l.Allow("10.0.0.1"); ok {
+		t.Error("10.0.0.1的第2个请求应被限流")
+	}
+}
+
+// Redis不可用或认证失败时改用本地令牌桶
+func TestRateLimiterRedisFallback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+	redis := newFakeRedis(t, "secret")
+
+	for name, config := range map[string]*RateLimitConfig{
+		"连接失败": redisRateLimitConfig(closed, ""),
+		"认证失败": redisRateLimitConfig(redis.listener.Addr().String(), "wrong"),
+	} {
+		l := NewRateLimiter("a.test", config)
+		for i := 0; i < 2; i++ {
+			if _, ok := l.Allow(""); !ok {
+				t.Fatalf("%s: 第%d个请求被限流", name, i+1)
+			}
+		}
+		if _, ok := l.Allow(""); ok {
+			t.Errorf("%s: 本地限流未生效", name)
+		}
+		l.Close()
+	}
+}
+
+// 来自受信任代理的请求按tier_header使用对应等级的限额，直连客户端携带的等级被忽略
+func TestRateLimitTiers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	handlerConfig := `{"server": {"trusted_proxies": ["192.0.2.1"]}, "transit_map": {"a.test": {"backend_base": "BACKEND",
+		"rate_limit": {"rate": 0.001, "burst": 1, "tier_header": "X-User-Tier", "tiers": {"free": {"rate": 0.001, "burst": 2}, "premium": {"rate": 0.001, "burst": 5}}}}}}`
+
+	cases := []struct {
+		name        string
+		remoteAddr  string
+		tier        string
+		wantAllowed int
+	}{
+		{"premium", "192.0.2.1:1234", "premium", 5},
+		{"free", "192.0.2.1:1234", "free", 2},
+		{"无等级", "192.0.2.1:1234", "", 1},
+		{"未配置的等级", "192.0.2.1:1234", "gold", 1},
+		{"直连客户端伪造等级", "203.0.113.9:1234", "premium", 1},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, handlerConfig)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+			req.RemoteAddr = c.remoteAddr
+			if c.tier != "" {
+				req.Header.Set("X-User-Tier", c.tier)
+			}
+			if rec := serveProxy(handler, req); rec.Code == http.StatusOK {
+				allowed++
+			}
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: 允许 %d 个请求, 期望 %d", c.name, allowed, c.wantAllowed)
+		}
+	}
+}
+
+func TestRateLimitTierConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		server  string
+		limit   string
+		wantErr bool
+	}{
+		{"有效配置", `{"trusted_proxies": ["10.0.0.0/8"]}`, `{"rate": 1, "tier_header": "X-User-Tier", "tiers": {"premium": {"priority": 1}}}`, false},
+		{"未配置trusted_proxies", `{}`, `{"rate": 1, "tier_header": "X-User-Tier", "tiers": {"premium": {}}}`, true},
+		{"未配置tier_header", `{"trusted_proxies": ["10.0.0.0/8"]}`, `{"rate": 1, "tiers": {"premium": {}}}`, true},
+		{"等级rate为负数", `{"trusted_proxies": ["10.0.0.0/8"]}`, `{"rate": 1, "tier_header": "X-User-Tier", "tiers": {"premium": {"rate": -1}}}`, true},
+	}
+	for _, c := range cases {
+		config, err := ParseConfig([]byte(`{"server": ` + c.server + `, "transit_map": {"a.test": {"backend_base": "http://b", "rate_limit": ` + c.limit + `}}}`))
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: 错误 %v, 期望出错 %v", c.name, err, c.wantErr)
+			continue
+		}
+		// 未设置rate的等级使用顶层的rate
+		if err == nil {
+			if tier := config.TransitMap["a.test"].RateLimit.Tiers["premium"]; tier.Rate != 1 || tier.Burst != 1 {
+				t.Errorf("%s: 等级限额 %+v, 期望rate=1 burst=1", c.name, tier)
+			}
+		}
+	}
+}
+
+// 并发槽位释放时交给优先级最高的等待者，同优先级先到先得，排队超时返回false
+func TestPriorityQueue(t *testing.T) {
+	q := newPriorityQueue(1)
+	release, ok := q.Acquire(context.Background(), 0)
+	if !ok {
+		t.Fatal("第一个请求未取得槽位")
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, w := range []struct {
+		name     string
+		priority int
+	}{{"free-1", 0}, {"premium", 10}, {"free-2", 0}, {"paid", 5}} {
+		wg.Add(1)
+		go func(name string, priority int) {
+			defer wg.Done()
+			release, ok := q.Acquire(context.Background(), priority)
+			if !ok {
+				t.Errorf("%s 未取得槽位", name)
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			release()
+		}(w.name, w.priority)
+		// 等待进入队列，保证入队顺序
+		for deadline := time.Now().Add(time.Second); ; {
+			q.mu.Lock()
+			queued := len(q.waiters)
+			q.mu.Unlock()
+			if queued == i+1 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	release()
+	wg.Wait()
+	if want := []string{"premium", "paid", "free-1", "free-2"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("转发顺序 %v, 期望 %v", order, want)
+	}
+
+	release, _ = q.Acquire(context.Background(), 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, ok := q.Acquire(ctx, 10); ok {
+		t.Error("槽位被占用时排队超时仍取得了槽位")
+	}
+	release()
+	if _, ok := q.Acquire(context.Background(), 0); !ok {
+		t.Error("超时的等待者离开队列后槽位未释放")
+	}
+}
+
+// 达到max_concurrent时新请求排队，超过queue_timeout返回503
+func TestRateLimitMaxConcurrent(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+	handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "rate_limit": {"rate": 100, "max_concurrent": 1, "queue_timeout": "20ms"}}}}`)
+
+	done := make(chan int)
+	go func() {
+		done <- serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil)).Code
+	}()
+	<-entered
+	if rec := serveProxy(handler, httptest.NewRequest(http.MethodGet, "http://a.test/", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("排队超时: 状态 %d, 期望 503", rec.Code)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("第一个请求: 状态 %d, 期望 200", code)
+	}
+}
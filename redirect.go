@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type redirectPolicyKey struct{}
+
+type noFollowRedirectsKey struct{}
+
+// 连接池按域名在规则间共享，规则的重定向策略通过请求的context传给CheckRedirect
+func withRedirectPolicy(ctx context.Context, config *RedirectConfig) context.Context {
+	return context.WithValue(ctx, redirectPolicyKey{}, config)
+}
+
+// 开启rewrite_location的规则不跟随重定向，改写Location后返回给客户端
+func withoutRedirects(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noFollowRedirectsKey{}, true)
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if noFollow, _ := req.Context().Value(noFollowRedirectsKey{}).(bool); noFollow {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= 10 {
+		return errors.New("重定向次数超过10次")
+	}
+
+	config, _ := req.Context().Value(redirectPolicyKey{}).(*RedirectConfig)
+	if config != nil && config.BlockDowngrade {
+		prev := via[len(via)-1].URL
+		if prev.Scheme == "https" && req.URL.Scheme == "http" {
+			log.Warnf("拦截协议降级的重定向: %s -> %s", prev, req.URL)
+			return &HTTPError{Status: http.StatusBadGateway, Err: fmt.Errorf("后端重定向从https降级为http: %s", req.URL)}
+		}
+	}
+	return nil
+}
+
+// 按redirect_to的模板生成重定向地址并返回，不请求后端
+func (c *RedirectToConfig) Serve(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	location := strings.NewReplacer(
+		"{scheme}", scheme,
+		"{host}", host,
+		"{path}", r.URL.EscapedPath(),
+		"{query}", r.URL.RawQuery,
+		"{request_uri}", r.URL.RequestURI(),
+	).Replace(c.URL)
+	http.Redirect(w, r, location, c.Status)
+}
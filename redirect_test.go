@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckRedirectBlocksDowngrade(t *testing.T) {
+	blocking := &RedirectConfig{BlockDowngrade: true}
+	cases := []struct {
+		name   string
+		config *RedirectConfig
+		urls   []string // 重定向链，最后一个为即将请求的地址
+		want   int      // 期望的错误状态码，0表示允许重定向
+	}{
+		{"https降级为http", blocking, []string{"https://b.test/login", "http://b.test/home"}, http.StatusBadGateway},
+		{"http升级为https", blocking, []string{"http://b.test/", "https://b.test/"}, 0},
+		{"https之间重定向", blocking, []string{"https://b.test/", "https://c.test/"}, 0},
+		{"未开启block_downgrade", &RedirectConfig{}, []string{"https://b.test/", "http://b.test/"}, 0},
+		{"未配置redirect", nil, []string{"https://b.test/", "http://b.test/"}, 0},
+		{"重定向次数过多", nil, strings.Split(strings.Repeat("http://b.test/,", 10)+"http://b.test/", ","), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		ctx := context.Background()
+		if c.config != nil {
+			ctx = withRedirectPolicy(ctx, c.config)
+		}
+		var via []*http.Request
+		for _, u := range c.urls {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			via = append(via, req)
+		}
+		err := checkRedirect(via[len(via)-1], via[:len(via)-1])
+		if got := errorStatus(err); (err != nil || c.want != 0) && got != c.want {
+			t.Errorf("%s: %v, 期望状态 %d", c.name, err, c.want)
+		}
+	}
+
+	// 开启rewrite_location时不跟随重定向，由代理将后端的重定向返回给客户端
+	req, _ := http.NewRequestWithContext(withoutRedirects(context.Background()), http.MethodGet, "http://b.test/home", nil)
+	if err := checkRedirect(req, []*http.Request{req}); err != http.ErrUseLastResponse {
+		t.Errorf("不跟随重定向时: %v, 期望 http.ErrUseLastResponse", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 最多保留的空闲连接数
+const maxRedisIdleConns = 16
+
+// Redis返回的错误回复，如NOSCRIPT
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// 只支持执行Lua脚本的最小Redis客户端，按需建立连接，空闲连接复用
+type RedisClient struct {
+	config *RedisConfig
+	idle   chan *redisConn
+}
+
+func NewRedisClient(config *RedisConfig) *RedisClient {
+	return &RedisClient{config: config, idle: make(chan *redisConn, maxRedisIdleConns)}
+}
+
+// 执行Lua脚本，先用EVALSHA避免每次发送脚本，Redis中没有缓存该脚本时改用EVAL
+func (c *RedisClient) Eval(script string, keys []string, args ...string) (interface{}, error) {
+	sum := sha1.Sum([]byte(script))
+	params := append([]string{hex.EncodeToString(sum[:]), strconv.Itoa(len(keys))}, keys...)
+	params = append(params, args...)
+	reply, err := c.do(append([]string{"EVALSHA"}, params...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		params[0] = script
+		reply, err = c.do(append([]string{"EVAL"}, params...)...)
+	}
+	return reply, err
+}
+
+func (c *RedisClient) do(args ...string) (interface{}, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(time.Duration(c.config.Timeout), args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// 网络错误后连接状态未知，不再复用
+		conn.conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+func (c *RedisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	timeout := time.Duration(c.config.Timeout)
+	nc, err := net.DialTimeout("tcp", c.config.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: nc, r: bufio.NewReader(nc)}
+	if c.config.Password != "" {
+		if _, err := conn.do(timeout, "AUTH", c.config.Password); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("认证失败: %v", err)
+		}
+	}
+	if c.config.DB != 0 {
+		if _, err := conn.do(timeout, "SELECT", strconv.Itoa(c.config.DB)); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("选择数据库失败: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *RedisClient) put(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// 关闭空闲连接，正在使用的连接归还时仍会放回
+func (c *RedisClient) Close() {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// 按RESP协议发送命令并读取回复
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.r)
+}
+
+// 读取一个回复：简单字符串和批量字符串返回string，整数返回int64，数组返回[]interface{}，空值返回nil
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("无效的Redis回复: %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// 数组中的错误回复作为元素返回，不中断读取
+			item, err := readRedisReply(r)
+			if replyErr, ok := err.(redisError); ok {
+				item, err = replyErr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("无效的Redis回复: %q", line)
+}
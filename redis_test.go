@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	cases := []struct {
+		name    string
+		reply   string
+		want    interface{}
+		wantErr string // 期望的错误，为空表示没有错误
+	}{
+		{"简单字符串", "+OK\r\n", "OK", ""},
+		{"错误回复", "-NOSCRIPT No matching script\r\n", nil, "NOSCRIPT No matching script"},
+		{"整数", ":42\r\n", int64(42), ""},
+		{"批量字符串", "$5\r\nhello\r\n", "hello", ""},
+		{"空批量字符串", "$0\r\n\r\n", "", ""},
+		{"nil批量字符串", "$-1\r\n", nil, ""},
+		{"nil数组", "*-1\r\n", nil, ""},
+		{"数组", "*3\r\n:1\r\n$-1\r\n+OK\r\n", []interface{}{int64(1), nil, "OK"}, ""},
+		{"数组中的错误回复", "*2\r\n:1\r\n-ERR bad\r\n", []interface{}{int64(1), redisError("ERR bad")}, ""},
+		{"未知类型", "?1\r\n", nil, "无效的Redis回复"},
+		{"缺少CRLF", "+OK\n", nil, "无效的Redis回复"},
+		{"批量字符串不完整", "$5\r\nhel", nil, "EOF"},
+	}
+	for _, c := range cases {
+		got, err := readRedisReply(bufio.NewReader(strings.NewReader(c.reply)))
+		if c.wantErr == "" && err != nil || c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+			t.Errorf("%s: 错误 %v, 期望 %q", c.name, err, c.wantErr)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: 回复 %#v, 期望 %#v", c.name, got, c.want)
+		}
+	}
+
+	var replyErr redisError
+	if _, err := readRedisReply(bufio.NewReader(strings.NewReader("-ERR x\r\n"))); !errors.As(err, &replyErr) {
+		t.Errorf("错误回复应返回redisError: %T", err)
+	}
+}
+
+// 按命令返回预设回复的Redis，记录收到的命令和建立的连接数
+type scriptedRedis struct {
+	listener net.Listener
+	reply    func(args []interface{}) string
+
+	mu       sync.Mutex
+	commands []string
+	conns    []net.Conn
+}
+
+func newScriptedRedis(t *testing.T, reply func(args []interface{}) string) *scriptedRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &scriptedRedis{listener: listener, reply: reply}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *scriptedRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		request, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		args, _ := request.([]interface{})
+		s.mu.Lock()
+		s.commands = append(s.commands, args[0].(string))
+		s.mu.Unlock()
+		conn.Write([]byte(s.reply(args)))
+	}
+}
+
+// 断开所有已建立的连接，模拟Redis重启或空闲连接被服务端关闭
+func (s *scriptedRedis) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *scriptedRedis) stats() ([]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...), len(s.conns)
+}
+
+func testRedisClient(s *scriptedRedis) *RedisClient {
+	return NewRedisClient(&RedisConfig{Addr: s.listener.Addr().String(), Timeout: Duration(time.Second)})
+}
+
+// Redis中没有缓存脚本时由EVALSHA改用EVAL，之后使用EVALSHA
+func TestRedisEvalNoScriptFallback(t *testing.T) {
+	var mu sync.Mutex
+	loaded := false
+	redis := newScriptedRedis(t, func(args []interface{}) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case args[0] == "EVAL":
+			loaded = true
+			return ":1\r\n"
+		case !loaded:
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return ":2\r\n"
+	})
+	client := testRedisClient(redis)
+	defer client.Close()
+
+	for i, want := range []int64{1, 2} {
+		reply, err := client.Eval("return 1", []string{"k"}, "a")
+		if err != nil || reply != want {
+			t.Fatalf("第 %d 次执行: %v %v, 期望 %d", i+1, reply, err, want)
+		}
+	}
+	if commands, conns := redis.stats(); !reflect.DeepEqual(commands, []string{"EVALSHA", "EVAL", "EVALSHA"}) || conns != 1 {
+		t.Errorf("收到的命令 %v, 建立了 %d 个连接", commands, conns)
+	}
+}
+
+// 错误回复返回redisError并继续复用连接，脚本中的其他错误不改用EVAL
+func TestRedisErrorReply(t *testing.T) {
+	redis := newScriptedRedis(t, func(args []interface{}) string {
+		return "-ERR Error running script: boom\r\n"
+	})
+	client := testRedisClient(redis)
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Eval("return 1", nil)
+		var replyErr redisError
+		if !errors.As(err, &replyErr) || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("第 %d 次执行: %v, 期望错误回复", i+1, err)
+		}
+	}
+	if commands, conns := redis.stats(); !reflect.DeepEqual(commands, []string{"EVALSHA", "EVALSHA"}) || conns != 1 {
+		t.Errorf("收到的命令 %v, 建立了 %d 个连接", commands, conns)
+	}
+}
+
+// 连接断开后丢弃该连接，之后的命令重新建立连接
+func TestRedisReconnect(t *testing.T) {
+	redis := newScriptedRedis(t, func(args []interface{}) string { return ":1\r\n" })
+	client := testRedisClient(redis)
+	defer client.Close()
+
+	if _, err := client.Eval("return 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	redis.dropConns()
+	// 空闲连接已被服务端关闭，本次命令失败，连接不再放回
+	if _, err := client.Eval("return 1", nil); err == nil {
+		t.Fatal("连接断开后的命令应返回错误")
+	}
+	if reply, err := client.Eval("return 1", nil); err != nil || reply != int64(1) {
+		t.Fatalf("重新连接后: %v %v", reply, err)
+	}
+	if _, conns := redis.stats(); conns != 2 {
+		t.Errorf("建立了 %d 个连接, 期望 2", conns)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func isRemoteConfig(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// 远程配置的版本信息，用于判断配置是否变化
+type remoteVersion struct {
+	ETag         string
+	LastModified string
+	Hash         [sha256.Size]byte
+}
+
+// 拉取远程配置内容，服务端返回304时data为空
+func fetchRemoteConfig(source string, timeout time.Duration, current remoteVersion) ([]byte, remoteVersion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, current, err
+	}
+	if current.ETag != "" {
+		req.Header.Set("If-None-Match", current.ETag)
+	}
+	if current.LastModified != "" {
+		req.Header.Set("If-Modified-Since", current.LastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, current, fmt.Errorf("拉取远程配置失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, current, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, current, fmt.Errorf("拉取远程配置失败: 状态码 %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, current, fmt.Errorf("读取远程配置失败: %v", err)
+	}
+	return data, remoteVersion{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified"), Hash: sha256.Sum256(data)}, nil
+}
+
+// 定期拉取远程配置，内容变化时热加载；拉取或解析失败时保留当前配置
+type RemoteConfigWatcher struct {
+	source  string
+	version remoteVersion
+}
+
+func NewRemoteConfigWatcher(source string) *RemoteConfigWatcher {
+	return &RemoteConfigWatcher{source: source}
+}
+
+// 首次加载远程配置并记录版本
+func (w *RemoteConfigWatcher) Load() (*Config, error) {
+	data, version, err := fetchRemoteConfig(w.source, 10*time.Second, remoteVersion{})
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	w.version = version
+	return config, nil
+}
+
+func (w *RemoteConfigWatcher) Run(handler *ProxyHandler, stop <-chan struct{}) {
+	for {
+		// 每轮使用当前生效配置中的拉取间隔，间隔为0时停止拉取
+		remote := handler.state.Load().config.Remote
+		if remote == nil || remote.PollInterval <= 0 {
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(remote.PollInterval)):
+		}
+
+		w.poll(handler, time.Duration(remote.Timeout))
+	}
+}
+
+func (w *RemoteConfigWatcher) poll(handler *ProxyHandler, timeout time.Duration) {
+	data, version, err := fetchRemoteConfig(w.source, timeout, w.version)
+	if err != nil {
+		log.Warnf("%v, 继续使用当前配置", err)
+		return
+	}
+	if data == nil || version.Hash == w.version.Hash {
+		w.version = version
+		return
+	}
+
+	config, err := ParseConfig(data)
+	if err != nil {
+		log.Warnf("解析远程配置失败: %v, 继续使用当前配置", err)
+		return
+	}
+
+	w.version = version
+	handler.Reload(config)
+	log.Infof("远程配置已更新并重新加载: %s", w.source)
+}
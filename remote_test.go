@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 远程配置内容变化时重新加载，未变化、无效或拉取失败时保留当前配置
+func TestRemoteConfigPoll(t *testing.T) {
+	const rule = `{"transit_map": {"a.test": {"backend_base": "http://127.0.0.1:%d"}}}`
+	var mu sync.Mutex
+	version, content, down := 1, fmt.Sprintf(rule, 9001), false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		etag := fmt.Sprintf(`"v%d"`, version)
+		switch {
+		case down:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.Header.Get("If-None-Match") == etag:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", etag)
+			w.Write([]byte(content))
+		}
+	}))
+	defer server.Close()
+
+	watcher := NewRemoteConfigWatcher(server.URL)
+	config, err := watcher.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewProxyHandler(config)
+	defer handler.Close()
+
+	steps := []struct {
+		name    string
+		content string // 为空表示内容不变
+		down    bool
+		reload  bool
+		want    string
+	}{
+		{"未变化", "", false, false, "http://127.0.0.1:9001"},
+		{"内容变化", fmt.Sprintf(rule, 9002), false, true, "http://127.0.0.1:9002"},
+		{"新配置无效", `{"transit_map": {"a.test": {"backend_base": "http://127.0.0.1:9003", "circuit_breaker": {}}}}`, false, false, "http://127.0.0.1:9002"},
+		{"拉取失败", "", true, false, "http://127.0.0.1:9002"},
+	}
+	for _, step := range steps {
+		mu.Lock()
+		if step.content != "" {
+			version, content = version+1, step.content
+		}
+		down = step.down
+		mu.Unlock()
+
+		state := handler.state.Load()
+		watcher.poll(handler, time.Second)
+		current := handler.state.Load()
+		if (current != state) != step.reload || current.config.TransitMap["a.test"].BackendBase != step.want {
+			t.Errorf("%s: 重新加载 %t, 后端 %s, 期望 %t %s", step.name, current != state, current.config.TransitMap["a.test"].BackendBase, step.reload, step.want)
+		}
+	}
+}
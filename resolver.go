@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type dnsEntry struct {
+	addrs      []net.IPAddr
+	srvs       []*dns.SRV // SRV查询的结果，key为srvCacheKey
+	ttl        time.Duration
+	expires    time.Time
+	refreshing bool
+}
+
+// 向指定DNS服务器查询后端域名，按记录的TTL缓存结果，TTL限制在min_ttl和max_ttl之间；
+// 缓存剩余时间不足20%时在后台刷新，请求继续使用缓存的结果。
+// hosts中的域名直接使用配置的IP，未配置DNS服务器时其他域名使用系统解析
+type DNSResolver struct {
+	config *ResolveConfig // 为空时只使用hosts和系统解析
+	hosts  map[string][]net.IPAddr
+	client *dns.Client
+
+	mu    sync.Mutex
+	cache map[string]*dnsEntry
+}
+
+func NewDNSResolver(config *ResolveConfig, hosts map[string][]net.IPAddr) *DNSResolver {
+	client := &dns.Client{Timeout: 5 * time.Second}
+	if config != nil && config.TLS {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			log.Warnf("配置DNS-over-TLS失败: %v", err)
+		}
+		client.Net, client.TLSConfig = "tcp-tls", tlsConfig
+	}
+	return &DNSResolver{config: config, hosts: hosts, client: client, cache: make(map[string]*dnsEntry)}
+}
+
+// 与net.Resolver相同的签名，失败时返回*net.DNSError
+func (r *DNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	if addrs, ok := r.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		return addrs, nil
+	}
+	if r.config == nil || len(r.config.DNS) == 0 {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+
+	if entry, ok := r.cached(host, func(ctx context.Context) error {
+		_, err := r.query(ctx, host)
+		return err
+	}); ok {
+		return entry.addrs, nil
+	}
+	return r.query(ctx, host)
+}
+
+// 返回key未过期的缓存，剩余时间不足20%时在后台调用query刷新
+func (r *DNSResolver) cached(key string, query func(ctx context.Context) error) (*dnsEntry, bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[key]
+	if !ok || !now.Before(entry.expires) {
+		return nil, false
+	}
+	if !entry.refreshing && entry.expires.Sub(now) < entry.ttl/5 {
+		entry.refreshing = true
+		go r.refresh(key, query)
+	}
+	return entry, true
+}
+
+func (r *DNSResolver) refresh(key string, query func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.client.Timeout)
+	defer cancel()
+	if err := query(ctx); err != nil {
+		log.Warnf("后台刷新 %s 的解析结果失败: %v", key, err)
+		r.mu.Lock()
+		if entry, ok := r.cache[key]; ok {
+			entry.refreshing = false
+		}
+		r.mu.Unlock()
+	}
+}
+
+// 按family查询A和/或AAAA记录，同时查询时有一种记录即可，IPv6地址排在前面
+func (r *DNSResolver) query(ctx context.Context, host string) ([]net.IPAddr, error) {
+	qtypes := []uint16{dns.TypeA}
+	switch r.config.Family {
+	case "ipv6":
+		qtypes = []uint16{dns.TypeAAAA}
+	case "auto":
+		qtypes = []uint16{dns.TypeAAAA, dns.TypeA}
+	}
+
+	type result struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			results[i].addrs, results[i].ttl, results[i].err = r.lookup(ctx, host, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var addrs []net.IPAddr
+	var err error
+	ttl := time.Duration(r.config.MaxTTL)
+	for _, result := range results {
+		if result.err != nil {
+			if err == nil {
+				err = result.err
+			}
+			continue
+		}
+		addrs = append(addrs, result.addrs...)
+		ttl = min(ttl, result.ttl)
+	}
+	if len(addrs) == 0 {
+		return nil, err
+	}
+	ttl = max(ttl, time.Duration(r.config.MinTTL))
+
+	r.mu.Lock()
+	r.cache[host] = &dnsEntry{addrs: addrs, ttl: ttl, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// 查询一种地址记录，返回地址和记录中最短的TTL
+func (r *DNSResolver) lookup(ctx context.Context, host string, qtype uint16) ([]net.IPAddr, time.Duration, error) {
+	resp, server, err := r.exchange(ctx, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, 0, &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: host, Server: server, IsNotFound: resp.Rcode == dns.RcodeNameError}
+	}
+
+	var addrs []net.IPAddr
+	ttl := time.Duration(r.config.MaxTTL)
+	for _, answer := range resp.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			if qtype == dns.TypeA {
+				addrs = append(addrs, net.IPAddr{IP: rr.A})
+				ttl = min(ttl, time.Duration(rr.Hdr.Ttl)*time.Second)
+			}
+		case *dns.AAAA:
+			if qtype == dns.TypeAAAA {
+				addrs = append(addrs, net.IPAddr{IP: rr.AAAA})
+				ttl = min(ttl, time.Duration(rr.Hdr.Ttl)*time.Second)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("没有%s的%s记录", host, dns.TypeToString[qtype]), Name: host, Server: server, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
+
+// 按顺序向配置的DNS服务器查询，查询失败或服务器返回SERVFAIL、REFUSED时尝试下一个，
+// 返回应答及给出应答的服务器
+func (r *DNSResolver) exchange(ctx context.Context, host string, qtype uint16) (*dns.Msg, string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+
+	var err error
+	for i, server := range r.config.DNS {
+		var resp *dns.Msg
+		resp, _, err = r.client.ExchangeContext(ctx, msg, server)
+		if err == nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused {
+			return resp, server, nil
+		}
+		if err == nil {
+			err = &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: host, Server: server}
+		} else {
+			err = &net.DNSError{Err: err.Error(), Name: host, Server: server, IsTimeout: ctx.Err() != nil}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(r.config.DNS)-1 {
+			log.Warnf("DNS服务器 %s 查询 %s 失败, 尝试下一个: %v", server, host, err)
+		}
+	}
+	return nil, "", err
+}
+
+// 使用DNSResolver解析域名后拨号，解析出多个地址时每次拨号从下一个地址开始，失败时依次尝试其余地址；
+// family为auto时先连接IPv6地址，未在fallback_delay内成功时同时连接IPv4地址（Happy Eyeballs），使用先建立的连接
+type resolvingDialer struct {
+	resolver *DNSResolver
+	dialer   *net.Dialer
+
+	mu   sync.Mutex
+	next int
+}
+
+// Happy Eyeballs中开始连接IPv4地址前的等待时间，与net.Dialer的默认值相同
+const happyEyeballsDelay = 300 * time.Millisecond
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if isSRVName(host) {
+		return d.dialSRV(ctx, network, host)
+	}
+	return d.dialHost(ctx, network, host, port)
+}
+
+func (d *resolvingDialer) dialHost(ctx context.Context, network, host, port string) (net.Conn, error) {
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	start := d.next
+	d.next++
+	d.mu.Unlock()
+
+	var primaries, fallbacks []net.IPAddr
+	for i := range addrs {
+		ip := addrs[(start+i)%len(addrs)]
+		if d.resolver.config != nil && d.resolver.config.Family == "auto" && ip.IP.To4() != nil {
+			fallbacks = append(fallbacks, ip)
+		} else {
+			primaries = append(primaries, ip)
+		}
+	}
+	if len(primaries) == 0 || len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, port, append(primaries, fallbacks...))
+	}
+	return d.dialParallel(ctx, network, port, primaries, fallbacks)
+}
+
+// 依次连接各地址，返回第一个成功的连接
+func (d *resolvingDialer) dialSerial(ctx context.Context, network, port string, addrs []net.IPAddr) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	for _, ip := range addrs {
+		if conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// 先连接primaries，等待happyEyeballsDelay或primaries全部失败后同时连接fallbacks，
+// 返回先建立的连接并关闭另一个
+func (d *resolvingDialer) dialParallel(ctx context.Context, network, port string, primaries, fallbacks []net.IPAddr) (net.Conn, error) {
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result)
+	returned := make(chan struct{})
+	defer close(returned)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	race := func(addrs []net.IPAddr, primary bool) {
+		conn, err := d.dialSerial(ctx, network, port, addrs)
+		select {
+		case results <- result{conn: conn, err: err, primary: primary}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	delay := d.dialer.FallbackDelay
+	if delay <= 0 {
+		delay = happyEyeballsDelay
+	}
+	go race(primaries, true)
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr error
+	var primaryDone, fallbackDone bool
+	for {
+		select {
+		case <-fallbackTimer.C:
+			go race(fallbacks, false)
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryDone, primaryErr = true, res.err
+				// IPv6连接全部失败时不再等待，立即连接IPv4地址
+				if fallbackTimer.Stop() {
+					fallbackTimer.Reset(0)
+				}
+			} else {
+				fallbackDone = true
+			}
+			if primaryDone && fallbackDone {
+				return nil, primaryErr
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 一次向后端发送的请求，开启max_attempts重试时记录在trace中
+type AttemptTrace struct {
+	BackendURL string
+	StatusCode int
+	Duration   time.Duration
+	Error      error
+}
+
+// 重试可能使后端重复处理请求，只重试幂等方法
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// 本次结果是否满足retry_on，error表示转发失败（连接、超时等），其余为状态码
+func (c *RetryConfig) retryable(trace *ProxyTrace) bool {
+	for _, on := range c.RetryOn {
+		if on == "error" && trace.Error != nil {
+			return true
+		}
+		if trace.Error == nil && on == strconv.Itoa(trace.StatusCode) {
+			return true
+		}
+	}
+	return false
+}
+
+// 第attempt次失败后的等待时间，从backoff开始每次翻倍，不超过max_backoff
+func (c *RetryConfig) delay(attempt int) time.Duration {
+	delay := time.Duration(c.Backoff)
+	for i := 1; i < attempt && delay < time.Duration(c.MaxBackoff); i++ {
+		delay *= 2
+	}
+	return min(delay, time.Duration(c.MaxBackoff))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
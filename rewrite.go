@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 将后端路径还原为客户端路径，与buildTransitBackendURL相反：去掉backend_prefix，加回strip_prefix去掉的前缀；
+// 不以backend_prefix开头的路径不属于本规则，返回false
+func (rule TransitRule) clientPath(backendPath string) (string, bool) {
+	prefix := strings.TrimSuffix(rule.BackendPrefix, "/")
+	if prefix != "" {
+		if !pathHasPrefix(backendPath, prefix) {
+			return "", false
+		}
+		backendPath = strings.TrimPrefix(backendPath, prefix)
+	}
+	path := rule.stripPrefix + backendPath
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path, true
+}
+
+// 改写指向后端的Location：绝对地址的域名为本规则的后端时替换为客户端请求的协议和Host，路径按backend_prefix和strip_prefix还原
+func rewriteLocation(r *http.Request, trace *ProxyTrace, rule TransitRule) {
+	location := trace.ResponseHeaders.Get("Location")
+	if location == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil || (u.Host == "" && !strings.HasPrefix(u.Path, "/")) {
+		return
+	}
+
+	if u.Host != "" {
+		backendHosts := map[string]bool{}
+		if backendURL, err := url.Parse(trace.BackendURL); err == nil {
+			backendHosts[strings.ToLower(backendURL.Host)] = true
+		}
+		for _, backend := range rule.Backends() {
+			if !strings.HasPrefix(backend, "http://") && !strings.HasPrefix(backend, "https://") {
+				backend = "http://" + backend
+			}
+			if backendURL, err := url.Parse(backend); err == nil {
+				backendHosts[strings.ToLower(backendURL.Host)] = true
+			}
+		}
+		if !backendHosts[strings.ToLower(u.Host)] {
+			return
+		}
+		u.Scheme, u.Host = "http", r.Host
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+
+	if path, ok := rule.clientPath(u.Path); ok {
+		u.Path, u.RawPath = path, ""
+	}
+	trace.ResponseHeaders.Set("Location", u.String())
+}
+
+// 改写Set-Cookie的Domain和Path属性，其他属性原样保留：Domain改为客户端请求的域名，
+// Path按backend_prefix和strip_prefix还原，不属于本规则的Path保持不变
+func rewriteCookies(r *http.Request, trace *ProxyTrace, rule TransitRule) {
+	cookies := trace.ResponseHeaders.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	domain := r.Host
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+
+	rewritten := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		parts := strings.Split(cookie, ";")
+		for i := 1; i < len(parts); i++ {
+			name, value, _ := strings.Cut(strings.TrimSpace(parts[i]), "=")
+			switch strings.ToLower(name) {
+			case "domain":
+				parts[i] = " " + name + "=" + domain
+			case "path":
+				if path, ok := rule.clientPath(value); ok {
+					parts[i] = " " + name + "=" + path
+				}
+			}
+		}
+		rewritten = append(rewritten, strings.Join(parts, ";"))
+	}
+	trace.ResponseHeaders["Set-Cookie"] = rewritten
+}
+
+// 按规则改写后端响应头中的地址
+func rewriteResponseHeaders(r *http.Request, trace *ProxyTrace, rule TransitRule) {
+	if rule.RewriteLocation {
+		rewriteLocation(r, trace, rule)
+	}
+	if rule.RewriteCookies {
+		rewriteCookies(r, trace, rule)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"net/http"
+	"regexp"
+)
+
+// 是否在debug日志中记录该路径的trace：命中exclude不记录，命中include始终记录，其余按rate采样
+func (c *TraceSamplingConfig) Sampled(path string) bool {
+	if c == nil {
+		return true
+	}
+	if matchAny(c.exclude, path) {
+		return false
+	}
+	if matchAny(c.include, path) {
+		return true
+	}
+	return rand.Float64() < c.Rate
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// 采样决定与链路追踪保持一致：开启tracing时与本次转发的span是否被采样一致；否则请求携带traceparent时
+// 使用其sampled标志，没有时沿用上游传入的决定，再按X-Request-ID的哈希决定，没有请求ID时按客户端IP和请求URI的哈希决定，
+// 同一请求的决定总是一致
+func (c *SamplingHeaderConfig) Sampled(r *http.Request, tracing bool) bool {
+	// 只有被采样的请求才有span
+	if tracing {
+		return spanFromContext(r.Context()) != nil
+	}
+	if _, _, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		return sampled
+	}
+	switch r.Header.Get(c.Header) {
+	case "1":
+		return true
+	case "0":
+		return false
+	}
+
+	key := r.Header.Get("X-Request-ID")
+	if key == "" {
+		key = clientIP(r) + " " + r.Method + " " + r.Host + r.URL.RequestURI()
+	}
+	sum := sha256.Sum256([]byte(key))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64 < c.Rate
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTraceSampling(t *testing.T) {
+	sampling := func(rate string) *TraceSamplingConfig {
+		config := mustParseConfig(t, `{"transit_map": {"a.test": {"backend_base": "http://127.0.0.1:9", "trace_sampling": {
+			"exclude": ["^/health", "^/api/debug/skip"],
+			"include": ["^/api/debug"],
+			"rate": `+rate+`
+		}}}}`)
+		return config.TransitMap["a.test"].TraceSampling
+	}
+
+	cases := []struct {
+		name   string
+		config *TraceSamplingConfig
+		path   string
+		want   bool
+	}{
+		{"命中exclude", sampling("1"), "/healthz", false},
+		{"命中include", sampling("0"), "/api/debug/x", true},
+		{"exclude优先于include", sampling("1"), "/api/debug/skip", false},
+		{"rate为0", sampling("0"), "/api/orders", false},
+		{"rate为1", sampling("1"), "/api/orders", true},
+		{"未配置trace_sampling", nil, "/healthz", true},
+	}
+	for _, c := range cases {
+		if got := c.config.Sampled(c.path); got != c.want {
+			t.Errorf("%s: Sampled(%q) = %t, 期望 %t", c.name, c.path, got, c.want)
+		}
+	}
+
+	for _, invalid := range []string{`"rate": 1.5`, `"include": ["("]`, `"exclude": ["("]`} {
+		if _, err := ParseConfig([]byte(`{"transit_map": {"a.test": {"backend_base": "http://127.0.0.1:9", "trace_sampling": {` + invalid + `}}}}`)); err == nil {
+			t.Errorf("%s: 期望加载配置失败", invalid)
+		}
+	}
+}
+
+// sampling_header开启tracing时与span一致，否则traceparent的sampled标志优先，再沿用上游的决定，其余按X-Request-ID或请求的哈希决定
+func TestSamplingHeader(t *testing.T) {
+	const (
+		sampledParent   = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+		unsampledParent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"
+	)
+	cases := []struct {
+		name    string
+		rate    float64
+		tracing bool
+		span    bool // 本次转发是否有被采样的span
+		headers map[string]string
+		want    bool
+	}{
+		{"上游已采样", 0, false, false, map[string]string{"X-Sampled": "1"}, true},
+		{"上游未采样", 1, false, false, map[string]string{"X-Sampled": "0"}, false},
+		{"traceparent已采样", 0, false, false, map[string]string{"traceparent": sampledParent}, true},
+		{"traceparent未采样", 1, false, false, map[string]string{"traceparent": unsampledParent, "X-Request-ID": "req-1"}, false},
+		{"traceparent优先于上游决定", 1, false, false, map[string]string{"traceparent": unsampledParent, "X-Sampled": "1"}, false},
+		{"rate为0", 0, false, false, map[string]string{"X-Request-ID": "req-1"}, false},
+		{"rate为1", 1, false, false, map[string]string{"X-Request-ID": "req-1"}, true},
+		{"无效的traceparent", 1, false, false, map[string]string{"traceparent": "invalid"}, true},
+		{"没有请求ID", 1, false, false, nil, true},
+		{"span已采样", 0, true, true, nil, true},
+		{"span未采样", 1, true, false, map[string]string{"X-Request-ID": "req-1"}, false},
+		{"开启tracing时忽略上游决定", 1, true, false, map[string]string{"X-Sampled": "1"}, false},
+		{"开启tracing时忽略上游未采样的决定", 0, true, true, map[string]string{"X-Sampled": "0"}, true},
+	}
+	for _, c := range cases {
+		config := &SamplingHeaderConfig{Header: "X-Sampled", Rate: c.rate}
+		r := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+		for key, value := range c.headers {
+			r.Header.Set(key, value)
+		}
+		if c.span {
+			r = r.WithContext(context.WithValue(r.Context(), spanKey{}, &Span{}))
+		}
+		if got := config.Sampled(r, c.tracing); got != c.want {
+			t.Errorf("%s: 采样 %t, 期望 %t", c.name, got, c.want)
+		}
+	}
+
+	// 同一请求ID或同一请求的决定一致，且采样比例接近rate
+	config := &SamplingHeaderConfig{Header: "X-Sampled", Rate: 0.3}
+	for _, key := range []string{"X-Request-ID", "URI"} {
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			r := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+			if key == "URI" {
+				r = httptest.NewRequest(http.MethodGet, "http://a.test/orders/"+strconv.Itoa(i), nil)
+			} else {
+				r.Header.Set("X-Request-ID", "req-"+strconv.Itoa(i))
+			}
+			first := config.Sampled(r, false)
+			if config.Sampled(r, false) != first {
+				t.Fatalf("%s: %s 的采样决定不一致", key, r.URL)
+			}
+			if first {
+				sampled++
+			}
+		}
+		if sampled < 250 || sampled > 350 {
+			t.Errorf("%s: rate为0.3时采样了 %d/1000 个请求", key, sampled)
+		}
+	}
+}
+
+// 开启tracing时转发给后端的采样决定与span一致
+func TestSamplingHeaderFollowsSpan(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Sampled", r.Header.Get("X-Sampled"))
+		w.Header().Set("X-Got-Traceparent", r.Header.Get("traceparent"))
+	}))
+	defer backend.Close()
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+
+	cases := []struct {
+		name        string
+		rate        string // tracing.rate
+		traceparent string
+		upstream    string // 客户端传入的X-Sampled
+		want        string
+	}{
+		{"tracing采样", "1", "", "", "1"},
+		{"tracing未采样", "1e-12", "", "", "0"},
+		{"沿用上游已采样的traceparent", "1e-12", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "", "1"},
+		{"沿用上游未采样的traceparent", "1", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", "", "0"},
+		{"客户端传入的决定被span覆盖", "1e-12", "", "1", "0"},
+		{"客户端传入的未采样被span覆盖", "1", "", "0", "1"},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"tracing": {"endpoint": "`+collector.URL+`", "rate": `+c.rate+`},
+			"transit_map": {"a.test": {"backend_base": "BACKEND", "sampling_header": {"rate": 0.5}}}}`)
+		req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+		if c.traceparent != "" {
+			req.Header.Set("traceparent", c.traceparent)
+		}
+		if c.upstream != "" {
+			req.Header.Set("X-Sampled", c.upstream)
+		}
+		rec := serveProxy(handler, req)
+		if got := rec.Header().Get("X-Got-Sampled"); got != c.want {
+			t.Errorf("%s: 后端收到X-Sampled %q, 期望 %q", c.name, got, c.want)
+		}
+		if spanSent := strings.HasSuffix(rec.Header().Get("X-Got-Traceparent"), "-01"); spanSent != (c.want == "1") {
+			t.Errorf("%s: 后端收到traceparent %q", c.name, rec.Header().Get("X-Got-Traceparent"))
+		}
+	}
+}
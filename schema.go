@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"mime"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+func (c *SchemaDriftConfig) load() error {
+	schema, err := jsonschema.Compile(c.Schema)
+	if err != nil {
+		return err
+	}
+	c.schema = schema
+	return nil
+}
+
+// 按采样率校验2xx的JSON响应体，不符合schema时只记录日志，不影响返回给客户端的响应
+func checkSchemaDrift(trace *ProxyTrace, config *SchemaDriftConfig) {
+	if trace.StatusCode < 200 || trace.StatusCode >= 300 || len(trace.ResponseBody) == 0 || trace.ResponseHeaders.Get("Content-Encoding") != "" {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(trace.ResponseHeaders.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return
+	}
+	if rand.Float64() >= config.Rate {
+		return
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(trace.ResponseBody))
+	decoder.UseNumber()
+	reason := ""
+	if err := decoder.Decode(&doc); err != nil {
+		reason = "响应体不是有效的JSON: " + err.Error()
+	} else if err := config.schema.Validate(doc); err != nil {
+		reason = err.Error()
+	}
+	if reason != "" {
+		drifts := config.drifts.Add(1)
+		log.Warnf("%s %s | 后端响应不符合schema %s (累计 %d 次): %s", trace.Method, trace.RequestURL, config.Schema, drifts, reason)
+	}
+}
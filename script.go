@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+)
+
+// 加载并编译规则的Starlark脚本，脚本需定义on_request(req)和/或on_response(resp)，
+// 两个函数直接修改传入的dict
+func (c *ScriptConfig) load() error {
+	thread := &starlark.Thread{Name: c.File, Print: c.print}
+	globals, err := starlark.ExecFile(thread, c.File, nil, starlark.StringDict{"json": json.Module})
+	if err != nil {
+		return err
+	}
+	globals.Freeze()
+
+	var ok bool
+	if fn := globals["on_request"]; fn != nil {
+		if c.onRequest, ok = fn.(starlark.Callable); !ok {
+			return fmt.Errorf("on_request不是函数")
+		}
+	}
+	if fn := globals["on_response"]; fn != nil {
+		if c.onResponse, ok = fn.(starlark.Callable); !ok {
+			return fmt.Errorf("on_response不是函数")
+		}
+	}
+	if c.onRequest == nil && c.onResponse == nil {
+		return fmt.Errorf("脚本未定义on_request或on_response")
+	}
+	return nil
+}
+
+func (c *ScriptConfig) print(_ *starlark.Thread, msg string) {
+	log.Infof("脚本 %s: %s", c.File, msg)
+}
+
+// 每次调用使用独立的线程，限制执行步数和时间
+func (c *ScriptConfig) call(fn starlark.Callable, arg *starlark.Dict) error {
+	thread := &starlark.Thread{Name: c.File, Print: c.print}
+	thread.SetMaxExecutionSteps(c.MaxSteps)
+	timer := time.AfterFunc(time.Duration(c.Timeout), func() { thread.Cancel("执行超时") })
+	defer timer.Stop()
+
+	if _, err := starlark.Call(thread, fn, starlark.Tuple{arg}, nil); err != nil {
+		return fmt.Errorf("执行脚本%s失败: %v", fn.Name(), err)
+	}
+	return nil
+}
+
+// 调用on_request，脚本可修改method、path、query、headers和body
+func (c *ScriptConfig) OnRequest(method, targetURL string, headers http.Header, body []byte) (string, string, http.Header, []byte, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+
+	req := starlark.NewDict(5)
+	req.SetKey(starlark.String("method"), starlark.String(method))
+	req.SetKey(starlark.String("path"), starlark.String(u.Path))
+	req.SetKey(starlark.String("query"), starlark.String(u.RawQuery))
+	req.SetKey(starlark.String("headers"), headersToStarlark(headers))
+	req.SetKey(starlark.String("body"), starlark.String(body))
+	if err := c.call(c.onRequest, req); err != nil {
+		return "", "", nil, nil, err
+	}
+
+	if method, err = dictString(req, "method"); err != nil {
+		return "", "", nil, nil, err
+	}
+	path, err := dictString(req, "path")
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	if path != u.Path {
+		u.Path, u.RawPath = path, ""
+	}
+	if u.RawQuery, err = dictString(req, "query"); err != nil {
+		return "", "", nil, nil, err
+	}
+	if headers, err = dictHeaders(req, headers); err != nil {
+		return "", "", nil, nil, err
+	}
+	newBody, err := dictString(req, "body")
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	return method, u.String(), headers, []byte(newBody), nil
+}
+
+// 调用on_response，脚本可修改status、headers和body
+func (c *ScriptConfig) OnResponse(trace *ProxyTrace) error {
+	resp := starlark.NewDict(3)
+	resp.SetKey(starlark.String("status"), starlark.MakeInt(trace.StatusCode))
+	resp.SetKey(starlark.String("headers"), headersToStarlark(trace.ResponseHeaders))
+	resp.SetKey(starlark.String("body"), starlark.String(trace.ResponseBody))
+	if err := c.call(c.onResponse, resp); err != nil {
+		return err
+	}
+
+	value, _, _ := resp.Get(starlark.String("status"))
+	status, err := starlark.AsInt32(value)
+	if err != nil || status < 100 || status > 599 {
+		return fmt.Errorf("脚本返回的status无效: %v", value)
+	}
+	headers, err := dictHeaders(resp, trace.ResponseHeaders)
+	if err != nil {
+		return err
+	}
+	body, err := dictString(resp, "body")
+	if err != nil {
+		return err
+	}
+	if body != string(trace.ResponseBody) {
+		headers.Del("Content-Length")
+	}
+
+	trace.StatusCode, trace.ResponseHeaders, trace.ResponseBody = status, headers, []byte(body)
+	return nil
+}
+
+// 多个值以", "连接为一个字符串
+func headersToStarlark(headers http.Header) *starlark.Dict {
+	dict := starlark.NewDict(len(headers))
+	for key, values := range headers {
+		dict.SetKey(starlark.String(key), starlark.String(strings.Join(values, ", ")))
+	}
+	return dict
+}
+
+// 读取脚本修改后的headers，值未变化的Header保留原有的多个值
+func dictHeaders(dict *starlark.Dict, original http.Header) (http.Header, error) {
+	value, _, _ := dict.Get(starlark.String("headers"))
+	items, ok := value.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("脚本返回的headers必须为dict")
+	}
+
+	headers := make(http.Header, items.Len())
+	for _, item := range items.Items() {
+		key, ok1 := starlark.AsString(item[0])
+		value, ok2 := starlark.AsString(item[1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("脚本返回的headers的键和值必须为字符串")
+		}
+		if values := original.Values(key); len(values) > 0 && strings.Join(values, ", ") == value {
+			headers[http.CanonicalHeaderKey(key)] = values
+			continue
+		}
+		headers.Set(key, value)
+	}
+	return headers, nil
+}
+
+func dictString(dict *starlark.Dict, key string) (string, error) {
+	value, _, _ := dict.Get(starlark.String(key))
+	s, ok := starlark.AsString(value)
+	if !ok {
+		return "", fmt.Errorf("脚本返回的%s必须为字符串", key)
+	}
+	return s, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+var errBodyTooSlow = errors.New("请求体上传速度过慢")
+
+// 限制请求体的最低平均上传速度，在连接上设置读取截止时间，客户端完全停止发送时同样生效
+type slowBodyReader struct {
+	io.ReadCloser
+	rc     *http.ResponseController
+	config *MinBodyRateConfig
+	start  time.Time
+	read   int64
+}
+
+func newSlowBodyReader(w http.ResponseWriter, body io.ReadCloser, config *MinBodyRateConfig) *slowBodyReader {
+	return &slowBodyReader{ReadCloser: body, rc: http.NewResponseController(w), config: config, start: time.Now()}
+}
+
+// 已读字节数按最低速度折算的时长加上宽限时间，即为下一次读取的截止时间
+func (b *slowBodyReader) deadline() time.Time {
+	allowed := time.Duration(b.config.Grace) + time.Duration(float64(b.read)/float64(b.config.Rate)*float64(time.Second))
+	return b.start.Add(allowed)
+}
+
+func (b *slowBodyReader) Read(p []byte) (int, error) {
+	deadline := b.deadline()
+	supported := b.rc.SetReadDeadline(deadline) == nil
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) || !supported && err == nil && time.Now().After(deadline) {
+		return n, errBodyTooSlow
+	}
+	if err == io.EOF {
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
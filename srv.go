@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 形如_http._tcp.api.internal的域名按SRV记录发现后端
+func isSRVName(host string) bool {
+	return strings.HasPrefix(host, "_") && strings.Contains(host, "._tcp.")
+}
+
+// backend_base的域名是否为SRV名称
+func isSRVBackend(backend string) bool {
+	if !strings.HasPrefix(backend, "http://") && !strings.HasPrefix(backend, "https://") {
+		backend = "http://" + backend
+	}
+	parsedURL, err := url.Parse(backend)
+	return err == nil && isSRVName(parsedURL.Hostname())
+}
+
+func srvCacheKey(name string) string {
+	return "SRV " + name
+}
+
+// 查询SRV记录，结果与地址记录一样按TTL缓存和后台刷新
+func (r *DNSResolver) LookupSRV(ctx context.Context, name string) ([]*dns.SRV, error) {
+	if entry, ok := r.cached(srvCacheKey(name), func(ctx context.Context) error {
+		_, err := r.querySRV(ctx, name)
+		return err
+	}); ok {
+		return entry.srvs, nil
+	}
+	return r.querySRV(ctx, name)
+}
+
+func (r *DNSResolver) querySRV(ctx context.Context, name string) ([]*dns.SRV, error) {
+	resp, server, err := r.exchange(ctx, name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: name, Server: server, IsNotFound: resp.Rcode == dns.RcodeNameError}
+	}
+
+	var srvs []*dns.SRV
+	ttl := time.Duration(r.config.MaxTTL)
+	for _, answer := range resp.Answer {
+		if srv, ok := answer.(*dns.SRV); ok && srv.Target != "." {
+			srvs = append(srvs, srv)
+			ttl = min(ttl, time.Duration(srv.Hdr.Ttl)*time.Second)
+		}
+	}
+	if len(srvs) == 0 {
+		return nil, &net.DNSError{Err: fmt.Sprintf("没有%s的SRV记录", name), Name: name, Server: server, IsNotFound: true}
+	}
+	ttl = max(ttl, time.Duration(r.config.MinTTL))
+
+	r.mu.Lock()
+	r.cache[srvCacheKey(name)] = &dnsEntry{srvs: srvs, ttl: ttl, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return srvs, nil
+}
+
+// 按RFC 2782排列SRV记录：priority小的在前，同一priority内按weight加权随机排列，weight为0的排在最后
+func orderSRV(srvs []*dns.SRV) []*dns.SRV {
+	ordered := make([]*dns.SRV, len(srvs))
+	copy(ordered, srvs)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Priority < ordered[j].Priority })
+
+	for start := 0; start < len(ordered); {
+		end := start
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+		for i := start; i < end; i++ {
+			total := 0
+			for _, srv := range ordered[i:end] {
+				total += int(srv.Weight)
+			}
+			if total == 0 {
+				rand.Shuffle(end-i, func(a, b int) { ordered[i+a], ordered[i+b] = ordered[i+b], ordered[i+a] })
+				break
+			}
+			pick := rand.Intn(total)
+			j := i
+			for ; pick >= int(ordered[j].Weight); j++ {
+				pick -= int(ordered[j].Weight)
+			}
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+		start = end
+	}
+	return ordered
+}
+
+// 按SRV记录的顺序连接各目标，使用记录中的端口，返回第一个成功的连接
+func (d *resolvingDialer) dialSRV(ctx context.Context, network, name string) (net.Conn, error) {
+	srvs, err := d.resolver.LookupSRV(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, srv := range orderSRV(srvs) {
+		target := strings.TrimSuffix(srv.Target, ".")
+		if conn, err = d.dialHost(ctx, network, target, strconv.Itoa(int(srv.Port))); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// 只暴露目录中的普通文件：拒绝以.开头的路径段（如.git、.env），未开启browse时不列出目录
+type staticFS struct {
+	dir    http.Dir
+	browse bool
+}
+
+func (s staticFS) Open(name string) (http.File, error) {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+	f, err := s.dir.Open(name)
+	if err != nil || s.browse {
+		return f, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := s.dir.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+func (s *StaticDir) newHandler() http.Handler {
+	return http.StripPrefix(s.Prefix, http.FileServer(staticFS{dir: http.Dir(s.Dir), browse: s.Browse}))
+}
+
+// 按最长前缀匹配static，未匹配时返回nil
+func (r TransitRule) matchStatic(path string) *StaticDir {
+	var matched *StaticDir
+	for i, static := range r.Static {
+		if pathHasPrefix(path, static.Prefix) && (matched == nil || len(static.Prefix) > len(matched.Prefix)) {
+			matched = &r.Static[i]
+		}
+	}
+	return matched
+}
+
+// 只支持GET和HEAD，其他方法返回405
+func (s *StaticDir) Serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "不允许的请求方法", http.StatusMethodNotAllowed)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
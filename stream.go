@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 流式转发时trace中记录的请求体和响应体的最大字节数
+const streamPreviewSize = 4096
+
+// 只保留前limit字节的Writer，用于在trace中记录流式转发的请求体和响应体
+type previewBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *previewBuffer) Write(p []byte) (int, error) {
+	if n := b.limit - len(b.buf); n > 0 {
+		b.buf = append(b.buf, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// EventSource等SSE客户端通过Accept声明text/event-stream，开启stream_on_sse时这类请求流式转发
+func streamed(r *http.Request, rule TransitRule) bool {
+	return rule.Stream || rule.StreamOnSSE && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// 每次写入后立即flush，使SSE事件和长轮询的分块响应及时到达客户端
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
+
+// SSE响应和长度未知的分块响应需要逐块flush
+func needsFlush(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || resp.ContentLength < 0
+}
+
+// 流式转发请求体和响应体，不在内存中缓冲，trace中只记录前streamPreviewSize字节。
+// 拿到后端响应前失败时不写出响应，由调用方处理trace.Error
+func (p *ProxyHandler) streamRequest(state *transitState, w http.ResponseWriter, r *http.Request, targetURL string, rule TransitRule) *ProxyTrace {
+	trace := &ProxyTrace{StartTime: time.Now(), RequestURL: fmt.Sprintf("%s%s", r.Host, r.URL.Path), BackendURL: targetURL, Method: r.Method, RequestHeaders: r.Header}
+
+	headers := p.processHeaders(r, rule)
+	// 告知后端该请求以早期数据发送，可能被重放
+	if state.config.Server.EarlyData && r.Header.Get("Early-Data") == "1" {
+		headers.Set("Early-Data", "1")
+	}
+	if sh := rule.SamplingHeader; sh != nil {
+		headers.Set(sh.Header, "0")
+		if sh.Sampled(r, p.tracer != nil) {
+			headers.Set(sh.Header, "1")
+		}
+	}
+	trace.TransitHeaders = headers
+
+	ctx := r.Context()
+	if rule.PayloadTimeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, payloadTimeout(r.ContentLength, rule.PayloadTimeout))
+		defer cancel()
+	}
+	if rule.Redirect != nil {
+		ctx = withRedirectPolicy(ctx, rule.Redirect)
+	}
+	if rule.RewriteLocation {
+		ctx = withoutRedirects(ctx)
+	}
+
+	reqPreview := &previewBuffer{limit: streamPreviewSize}
+	var body io.Reader = http.NoBody
+	if r.ContentLength != 0 {
+		body = io.TeeReader(r.Body, reqPreview)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, body)
+	if err != nil {
+		trace.Error = fmt.Errorf("创建请求失败: %v", err)
+		return trace
+	}
+	req.ContentLength = r.ContentLength
+	req.Header = headers
+	setRequestHost(req, headers, rule)
+
+	// 流式响应的时长不可预知，不使用连接池客户端的整体超时，由客户端断开或payload_timeout结束
+	client := *p.getClientForDomain(state, targetURL)
+	client.Timeout = 0
+	resp, sent, reused, err := doRequest(&client, req, trace)
+	if sent {
+		p.metrics.ObserveConn(p.extractDomain(targetURL), reused)
+	}
+	trace.RequestBody = reqPreview.buf
+	if err != nil {
+		trace.Error = fmt.Errorf("转发请求失败: %v", err)
+		var httpErr *HTTPError
+		if errors.Is(err, errBodyTooSlow) {
+			trace.Error = &HTTPError{Status: http.StatusRequestTimeout, Err: trace.Error}
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			trace.Error = &HTTPError{Status: http.StatusGatewayTimeout, Err: trace.Error}
+		} else if errors.As(err, &httpErr) {
+			trace.Error = &HTTPError{Status: httpErr.Status, Err: trace.Error}
+		}
+		return trace
+	}
+	defer resp.Body.Close()
+
+	trace.StatusCode, trace.ResponseHeaders = resp.StatusCode, resp.Header
+	if rule.LogTLS {
+		trace.TLS = resp.TLS
+	}
+	rewriteResponseHeaders(r, trace, rule)
+
+	for key, values := range resp.Header {
+		if isHopHeader(key) {
+			continue
+		}
+		w.Header()[key] = values
+	}
+	// 后端声明的Trailer在响应头中预告，响应体结束后发送
+	if rule.ForwardTrailers {
+		for key := range resp.Trailer {
+			w.Header().Add("Trailer", key)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var dst io.Writer = w
+	if needsFlush(resp) {
+		dst = &flushWriter{w: w, rc: http.NewResponseController(w)}
+	}
+	rspPreview := &previewBuffer{limit: streamPreviewSize}
+	if _, err := io.Copy(dst, io.TeeReader(resp.Body, rspPreview)); err != nil {
+		trace.Error = fmt.Errorf("流式转发响应体失败: %v", err)
+	}
+	trace.ResponseBody = rspPreview.buf
+
+	if rule.ForwardTrailers {
+		for key, values := range resp.Trailer {
+			w.Header()[key] = values
+		}
+		if len(resp.Trailer) > 0 {
+			trace.ResponseTrailers = resp.Trailer
+		}
+	}
+	return trace
+}
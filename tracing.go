@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 一次转发对应的span，traceparent中带有上游span时作为其子span
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	host     string
+}
+
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+type spanKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// 解析W3C traceparent，格式无效时返回false
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// 将转发的trace转换为OTLP span，异步批量发送到OTLP/HTTP接口，缓冲区满时丢弃
+type Tracer struct {
+	config  *TracingConfig
+	client  *http.Client
+	spans   chan map[string]interface{}
+	dropped atomic.Int64
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool // Close之后结束的span直接丢弃
+}
+
+func NewTracer(config *TracingConfig) *Tracer {
+	t := &Tracer{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.Timeout)},
+		spans:  make(chan map[string]interface{}, config.BufferSize),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// 上游已做出采样决定时沿用，否则按rate采样；未采样时返回nil
+func (t *Tracer) Start(r *http.Request, host string) *Span {
+	span := &Span{host: host}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return nil
+		}
+		span.traceID, span.parentID = traceID, parentID
+	} else {
+		if mrand.Float64() >= t.config.Rate {
+			return nil
+		}
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+func (t *Tracer) End(span *Span, trace *ProxyTrace) {
+	record := map[string]interface{}{
+		"traceId":           hex.EncodeToString(span.traceID[:]),
+		"spanId":            hex.EncodeToString(span.spanID[:]),
+		"name":              trace.Method + " " + span.host,
+		"kind":              3, // SPAN_KIND_CLIENT
+		"startTimeUnixNano": strconv.FormatInt(trace.StartTime.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(trace.StartTime.Add(trace.Duration).UnixNano(), 10),
+		"attributes":        spanAttributes(span, trace),
+	}
+	if span.parentID != [8]byte{} {
+		record["parentSpanId"] = hex.EncodeToString(span.parentID[:])
+	}
+	if trace.Error != nil {
+		record["status"] = map[string]interface{}{"code": 2, "message": trace.Error.Error()}
+	} else if trace.StatusCode >= 500 {
+		record["status"] = map[string]interface{}{"code": 2}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		t.dropped.Add(1)
+		return
+	}
+	select {
+	case t.spans <- record:
+	default:
+		if dropped := t.dropped.Add(1); dropped%1000 == 1 {
+			log.Warnf("trace导出缓冲区已满, 累计丢弃span: %d", dropped)
+		}
+	}
+}
+
+func spanAttributes(span *Span, trace *ProxyTrace) []map[string]interface{} {
+	var attributes []map[string]interface{}
+	add := func(key string, value map[string]interface{}) {
+		attributes = append(attributes, map[string]interface{}{"key": key, "value": value})
+	}
+	add("transit.host", map[string]interface{}{"stringValue": span.host})
+	add("http.request.method", map[string]interface{}{"stringValue": trace.Method})
+	add("url.full", map[string]interface{}{"stringValue": trace.BackendURL})
+	if trace.StatusCode != 0 {
+		add("http.response.status_code", map[string]interface{}{"intValue": strconv.Itoa(trace.StatusCode)})
+	}
+	if trace.RemoteAddr != "" {
+		add("network.peer.address", map[string]interface{}{"stringValue": trace.RemoteAddr})
+	}
+	if trace.DNS != nil {
+		add("transit.dns.host", map[string]interface{}{"stringValue": trace.DNS.Host})
+		add("transit.dns.duration_ms", map[string]interface{}{"doubleValue": float64(trace.DNS.Duration) / float64(time.Millisecond)})
+		addrs := make([]map[string]interface{}, 0, len(trace.DNS.Addrs))
+		for _, addr := range trace.DNS.Addrs {
+			addrs = append(addrs, map[string]interface{}{"stringValue": addr})
+		}
+		add("transit.dns.addresses", map[string]interface{}{"arrayValue": map[string]interface{}{"values": addrs}})
+		if trace.DNS.Err != nil {
+			add("transit.dns.error", map[string]interface{}{"stringValue": trace.DNS.Err.Error()})
+		}
+	}
+	return attributes
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	batch := make([]map[string]interface{}, 0, 100)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			log.Warnf("导出trace失败, 丢弃 %d 个span: %v", len(batch), err)
+			t.dropped.Add(int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == cap(batch) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// 按OTLP/HTTP JSON格式发送一批span
+func (t *Tracer) export(spans []map[string]interface{}) error {
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []interface{}{
+				map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": t.config.ServiceName}},
+			}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "http-transit"},
+				"spans": spans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.config.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("状态码: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// 发送完缓冲区中剩余的span
+func (t *Tracer) Close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+	<-t.done
+}
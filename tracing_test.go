@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 关闭期间和关闭后结束的span被丢弃，不会向已关闭的缓冲区发送
+func TestTracerEndAfterClose(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+	tracer := NewTracer(&TracingConfig{Endpoint: collector.URL, Rate: 1, BufferSize: 10, Timeout: Duration(time.Second)})
+
+	req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+	trace := &ProxyTrace{Method: http.MethodGet, StartTime: time.Now(), StatusCode: http.StatusOK}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tracer.End(tracer.Start(req, "a.test"), trace)
+			}
+		}()
+	}
+	tracer.Close()
+	wg.Wait()
+	tracer.End(tracer.Start(req, "a.test"), trace)
+	if tracer.dropped.Load() == 0 {
+		t.Error("关闭后结束的span未计入丢弃数")
+	}
+}
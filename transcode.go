@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var transcodeFormats = map[string]string{
+	"application/json":        "json",
+	"application/msgpack":     "msgpack",
+	"application/x-msgpack":   "msgpack",
+	"application/vnd.msgpack": "msgpack",
+}
+
+var transcodeContentTypes = map[string]string{"json": "application/json", "msgpack": "application/msgpack"}
+
+func bodyFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return transcodeFormats[mediaType]
+}
+
+// 客户端期望的响应格式，优先取Accept，其次取请求体的格式
+func acceptFormat(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if format := bodyFormat(strings.TrimSpace(part)); format != "" {
+			return format
+		}
+	}
+	return bodyFormat(r.Header.Get("Content-Type"))
+}
+
+// 在JSON和MessagePack之间转换
+func transcode(body []byte, from, to string) ([]byte, error) {
+	if from == to {
+		return body, nil
+	}
+
+	var value interface{}
+	if from == "json" {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		return msgpack.Marshal(jsonNumbers(value))
+	}
+	if err := msgpack.Unmarshal(body, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// 整数保持为整数编码，其余数字编码为浮点数
+func jsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumbers(item)
+		}
+	}
+	return value
+}
+
+// 将请求体转换为后端使用的格式，并要求后端以该格式响应
+func transcodeRequest(r *http.Request, headers http.Header, body []byte, config *TranscodeConfig) ([]byte, error) {
+	if acceptFormat(r) != "" {
+		headers.Set("Accept", transcodeContentTypes[config.Backend])
+	}
+
+	format := bodyFormat(r.Header.Get("Content-Type"))
+	if len(body) == 0 || format == "" || format == config.Backend {
+		return body, nil
+	}
+	transcoded, err := transcode(body, format, config.Backend)
+	if err != nil {
+		return nil, &HTTPError{Status: http.StatusBadRequest, Err: fmt.Errorf("转换请求体失败: %v", err)}
+	}
+	headers.Set("Content-Type", transcodeContentTypes[config.Backend])
+	return transcoded, nil
+}
+
+// 将后端响应体转换为客户端期望的格式
+func transcodeResponse(trace *ProxyTrace, format string) error {
+	from := bodyFormat(trace.ResponseHeaders.Get("Content-Type"))
+	if len(trace.ResponseBody) == 0 || format == "" || from == "" || from == format {
+		return nil
+	}
+	if encoding := trace.ResponseHeaders.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+
+	transcoded, err := transcode(trace.ResponseBody, from, format)
+	if err != nil {
+		return &HTTPError{Status: http.StatusBadGateway, Err: fmt.Errorf("转换响应体失败: %v", err)}
+	}
+	trace.ResponseBody = transcoded
+	trace.ResponseHeaders.Set("Content-Type", transcodeContentTypes[format])
+	trace.ResponseHeaders.Set("Content-Length", strconv.Itoa(len(transcoded)))
+	return nil
+}
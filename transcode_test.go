@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// 请求体转换为后端格式转发，响应体再按客户端的格式转换回来，并更新Content-Type和Content-Length
+func TestTranscodeRoundTrip(t *testing.T) {
+	value := map[string]interface{}{"id": int64(1), "price": 9.5, "tags": []interface{}{"a", "b"}, "meta": map[string]interface{}{"ok": true}}
+	jsonBody, _ := json.Marshal(value)
+	msgpackBody, _ := msgpack.Marshal(value)
+
+	// 后端校验收到的请求体格式后原样返回
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(body)) {
+			http.Error(w, "Content-Length不一致", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("garbage") != "" {
+			body = []byte{0xc1}
+		}
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		w.Header().Set("X-Accept", r.Header.Get("Accept"))
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	decode := map[string]func([]byte, interface{}) error{"application/json": json.Unmarshal, "application/msgpack": msgpack.Unmarshal}
+	cases := []struct {
+		name        string
+		backend     string
+		contentType string
+		body        []byte
+		query       string
+		wantCode    int
+		wantType    string // 客户端收到的Content-Type，也是后端收到的Accept
+	}{
+		{"JSON客户端, MessagePack后端", "msgpack", "application/json", jsonBody, "", http.StatusOK, "application/json"},
+		{"MessagePack客户端, JSON后端", "json", "application/x-msgpack", msgpackBody, "", http.StatusOK, "application/msgpack"},
+		{"格式相同不转换", "json", "application/json", jsonBody, "", http.StatusOK, "application/json"},
+		{"请求体无效", "msgpack", "application/json", []byte("{"), "", http.StatusBadRequest, ""},
+		{"响应体无效", "msgpack", "application/json", jsonBody, "?garbage=1", http.StatusBadGateway, ""},
+	}
+	for _, c := range cases {
+		handler := newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", "headers": {"forward_client": true}, "transcode": {"backend": "`+c.backend+`"}}}}`)
+		req := httptest.NewRequest(http.MethodPost, "http://a.test/"+c.query, bytes.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		rec := serveProxy(handler, req)
+		if rec.Code != c.wantCode {
+			t.Errorf("%s: 状态 %d, 期望 %d: %s", c.name, rec.Code, c.wantCode, rec.Body)
+			continue
+		}
+		if c.wantCode != http.StatusOK {
+			continue
+		}
+
+		if backendType := transcodeContentTypes[c.backend]; rec.Header().Get("X-Accept") != backendType {
+			t.Errorf("%s: 后端收到的Accept %q, 期望 %q", c.name, rec.Header().Get("X-Accept"), backendType)
+		}
+		if rec.Header().Get("Content-Type") != c.wantType || rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%s: Content-Type %q, Content-Length %q, 响应体 %d 字节", c.name, rec.Header().Get("Content-Type"), rec.Header().Get("Content-Length"), rec.Body.Len())
+		}
+		var got map[string]interface{}
+		if err := decode[c.wantType](rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("%s: 解析响应体失败: %v", c.name, err)
+			continue
+		}
+		if fmt.Sprint(got["id"]) != "1" || got["price"] != 9.5 || !reflect.DeepEqual(got["tags"], value["tags"]) || !reflect.DeepEqual(got["meta"], value["meta"]) {
+			t.Errorf("%s: 响应体 %v", c.name, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 配置重新加载后，为新增或变更的后端预先建立连接，避免首批请求承担建连耗时
+func (p *ProxyHandler) warmup(state, old *transitState) {
+	warmed := make(map[string]struct{})
+	for _, rule := range state.config.TransitMap {
+		if rule.ReloadWarmup <= 0 {
+			continue
+		}
+		for _, backend := range rule.Backends() {
+			domain := p.extractDomain(backend)
+			// 沿用原有连接池的后端已有连接，不需要预热
+			if state.clients[domain] == old.clients[domain] {
+				continue
+			}
+			if _, ok := warmed[domain]; ok {
+				continue
+			}
+			warmed[domain] = struct{}{}
+			if !strings.HasPrefix(backend, "http://") && !strings.HasPrefix(backend, "https://") {
+				backend = "http://" + backend
+			}
+			go p.warmupBackend(state.clients[domain], backend, rule.ReloadWarmup)
+		}
+	}
+}
+
+// 并发发送HEAD请求，请求完成后连接保留在连接池中
+func (p *ProxyHandler) warmupBackend(client *http.Client, backend string, conns int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ready := 0
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, backend, nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Debugf("预热后端连接失败: %s: %v", backend, err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			mu.Lock()
+			ready++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	log.Infof("预热后端连接: %s, 成功 %d/%d", backend, ready, conns)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket握手中原样转发给后端的客户端Header，不受headers.forward_client影响
+var webSocketHeaders = []string{"Origin", "Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions"}
+
+// 客户端是否请求升级为WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 客户端请求的子协议，按Sec-WebSocket-Protocol中的顺序
+func webSocketSubprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// 检查客户端是否请求了websocket.subprotocols中的至少一个子协议
+func (c *WebSocketConfig) check(r *http.Request) error {
+	if len(c.Subprotocols) == 0 {
+		return nil
+	}
+	for _, protocol := range webSocketSubprotocols(r) {
+		for _, supported := range c.Subprotocols {
+			if protocol == supported {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("需要以下WebSocket子协议之一: %s", strings.Join(c.Subprotocols, ", "))
+}
+
+// 将WebSocket握手转发给后端，后端同意升级时劫持客户端连接并双向转发数据，直到任一方向关闭。
+// 客户端的Sec-WebSocket-Protocol原样转发，后端选定的子协议随101响应原样返回；
+// 后端拒绝升级时按普通响应返回给客户端。返回写给客户端的状态码
+func (p *ProxyHandler) proxyWebSocket(state *transitState, w http.ResponseWriter, r *http.Request, targetURL string, rule TransitRule) int {
+	start := time.Now()
+	if err := rule.WebSocket.check(r); err != nil {
+		log.Infof("%s %s%s | %v", r.Method, r.Host, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return http.StatusBadRequest
+	}
+
+	headers := p.processHeaders(r, rule)
+	for _, key := range webSocketHeaders {
+		headers.Del(key)
+		for _, value := range r.Header.Values(key) {
+			headers.Add(key, value)
+		}
+	}
+	headers.Set("Connection", "Upgrade")
+	headers.Set("Upgrade", "websocket")
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, targetURL, nil)
+	if err != nil {
+		log.Warnf("%s %s%s | 创建WebSocket请求失败: %v", r.Method, r.Host, r.URL.Path, err)
+		http.Error(w, "内部错误", http.StatusInternalServerError)
+		return http.StatusInternalServerError
+	}
+	req.Header = headers
+	setRequestHost(req, headers, rule)
+
+	// 不使用http.Client，其请求超时会中断升级后的长连接
+	resp, err := p.getClientForDomain(state, targetURL).Transport.RoundTrip(req)
+	if err != nil {
+		log.Warnf("%s %s | WebSocket握手失败: %v", r.Method, targetURL, err)
+		http.Error(w, "后端连接失败", http.StatusBadGateway)
+		return http.StatusBadGateway
+	}
+	defer resp.Body.Close()
+
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		for key, values := range resp.Header {
+			if !isHopHeader(key) {
+				w.Header()[key] = append([]string(nil), values...)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		log.Infof("%s %s | 后端拒绝升级WebSocket, 状态: %d", r.Method, targetURL, resp.StatusCode)
+		return resp.StatusCode
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Warnf("%s %s%s | 无法劫持客户端连接: %v", r.Method, r.Host, r.URL.Path, err)
+		http.Error(w, "WebSocket需要HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return http.StatusHTTPVersionNotSupported
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		log.Warnf("%s %s%s | 写入WebSocket握手响应失败: %v", r.Method, r.Host, r.URL.Path, err)
+		return http.StatusSwitchingProtocols
+	}
+	log.Infof("%s %s | WebSocket已建立, 子协议: %q", r.Method, targetURL, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// 任一方向结束后关闭两端的连接，另一方向随之结束
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			conn.Close()
+			backend.Close()
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer closeBoth()
+		// 劫持前客户端已发送的数据保存在buffered.Reader中
+		io.Copy(backend, buffered.Reader)
+	}()
+	io.Copy(conn, backend)
+	closeBoth()
+	<-done
+	log.Infof("%s %s | WebSocket已关闭, 持续: %v", r.Method, targetURL, time.Since(start))
+	return http.StatusSwitchingProtocols
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 只支持chat子协议的WebSocket后端，升级后原样返回收到的数据；记录收到的Sec-WebSocket-Protocol
+func newWebSocketBackend(t *testing.T, received chan<- string) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("Sec-WebSocket-Protocol")
+		if !isWebSocketUpgrade(r) {
+			http.Error(w, "需要WebSocket", http.StatusBadRequest)
+			return
+		}
+		if !webSocketOffers(r, "chat") {
+			http.Error(w, "不支持的子协议", http.StatusBadRequest)
+			return
+		}
+		accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		conn, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		buffered.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\nSec-WebSocket-Protocol: chat\r\n\r\n")
+		buffered.Flush()
+		io.Copy(conn, buffered)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// 客户端是否请求了指定的子协议
+func webSocketOffers(r *http.Request, protocol string) bool {
+	for _, offered := range webSocketSubprotocols(r) {
+		if offered == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// 客户端请求的子协议原样转发给后端，后端选定的子协议返回给客户端，升级后双向转发数据
+func TestWebSocketSubprotocol(t *testing.T) {
+	received := make(chan string, 1)
+	backend := newWebSocketBackend(t, received)
+
+	cases := []struct {
+		name         string
+		rule         string
+		protocols    string
+		wantCode     int
+		wantProtocol string // 客户端收到的子协议
+		wantBackend  string // 后端收到的子协议，"-"表示请求不应到达后端
+	}{
+		{"协商子协议", `"websocket": {}`, "v2.chat, chat", http.StatusSwitchingProtocols, "chat", "v2.chat, chat"},
+		{"满足要求的子协议", `"websocket": {"subprotocols": ["chat"]}`, "chat", http.StatusSwitchingProtocols, "chat", "chat"},
+		{"缺少要求的子协议", `"websocket": {"subprotocols": ["chat"]}`, "v2.chat", http.StatusBadRequest, "", "-"},
+		{"后端拒绝升级", `"websocket": {}`, "v2.chat", http.StatusBadRequest, "", "v2.chat"},
+		{"未开启websocket", `"headers": {}`, "chat", http.StatusBadRequest, "", ""},
+	}
+	for _, c := range cases {
+		proxy := httptest.NewServer(newTestProxy(t, backend, `{"transit_map": {"a.test": {"backend_base": "BACKEND", `+c.rule+`}}}`))
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: a.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Protocol: "+c.protocols+"\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if resp.StatusCode != c.wantCode || resp.Header.Get("Sec-WebSocket-Protocol") != c.wantProtocol {
+			t.Errorf("%s: 状态 %d, 子协议 %q, 期望 %d %q", c.name, resp.StatusCode, resp.Header.Get("Sec-WebSocket-Protocol"), c.wantCode, c.wantProtocol)
+		}
+
+		select {
+		case got := <-received:
+			if got != c.wantBackend {
+				t.Errorf("%s: 后端收到子协议 %q, 期望 %q", c.name, got, c.wantBackend)
+			}
+		default:
+			if c.wantBackend != "-" {
+				t.Errorf("%s: 请求未到达后端", c.name)
+			}
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			io.WriteString(conn, "ping")
+			echo := make([]byte, 4)
+			if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != "ping" {
+				t.Errorf("%s: 收到 %q %v, 期望后端原样返回ping", c.name, echo, err)
+			}
+		}
+		conn.Close()
+		proxy.Close()
+	}
+}